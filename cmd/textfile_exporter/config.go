@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/config"
+	"textfile_exporter/internal/push"
+	"textfile_exporter/internal/relabel"
+	"textfile_exporter/internal/scanner"
+	"textfile_exporter/internal/webconfig"
+)
+
+// flagConfig returns the configuration given by the command-line flags.
+func flagConfig() *config.Config {
+	pathUpdateModes := make(map[string]collector.UpdateMode, len(*scannerPathUpdateModes))
+	for pattern, mode := range *scannerPathUpdateModes {
+		pathUpdateModes[pattern] = collector.UpdateMode(mode)
+	}
+
+	cfg := &config.Config{}
+	cfg.Web.ListenAddress = *webListenAddress
+	cfg.Web.ConfigFile = *webConfigFile
+	cfg.Web.EnableOpenMetrics = *webEnableOpenMetrics
+	cfg.Web.OpenMetricsCreatedSamples = *webOpenMetricsCreatedSamples
+	cfg.Web.EnablePush = *webEnablePush
+	cfg.Web.EnableLifecycle = *webEnableLifecycle
+	cfg.Push.PersistDir = *pushPersistDir
+	cfg.Push.MaxBodySize = *pushMaxBodySize
+	cfg.Scanner.Directory = *promPath
+	cfg.Scanner.Recursive = *scannerRecursive
+	cfg.Scanner.Watch = *scannerWatch
+	cfg.Scanner.ContentHash = *scannerContentHash
+	cfg.Scanner.Interval = *scanInterval
+	cfg.Scanner.UpdateMode = collector.UpdateMode(*scannerUpdateMode)
+	cfg.Scanner.PathUpdateModes = pathUpdateModes
+	cfg.Scanner.FilesMinAge = *enableFilesMinAge
+	cfg.Scanner.FilesMinAgeDuration = *filesMinAgeDuration
+	cfg.Scanner.OldFilesExternalCommand = *oldFilesExternalCmd
+	for _, expr := range *scannerPathLabelRegex {
+		cfg.Scanner.PathLabels = append(cfg.Scanner.PathLabels, config.PathLabelConfig{Regex: expr})
+	}
+	for _, template := range *scannerPathLabelTemplate {
+		cfg.Scanner.PathLabels = append(cfg.Scanner.PathLabels, config.PathLabelConfig{Template: template})
+	}
+	cfg.Scanner.PathLabelConflict = *scannerPathLabelConflict
+	cfg.Scanner.Include = *scannerInclude
+	cfg.Scanner.IncludeRegex = *scannerIncludeRegex
+	cfg.Scanner.Exclude = *scannerExclude
+	cfg.Scanner.ExcludeRegex = *scannerExcludeRegex
+	cfg.Scanner.FileMetrics = *scannerFileMetrics
+	cfg.Scanner.FileMetricsMaxFiles = *scannerFileMetricsMaxFiles
+	cfg.Scanner.SettleTime = *scannerSettleTime
+	cfg.Scanner.SkipTempFiles = *scannerSkipTempFiles
+	cfg.Scanner.LockFileSuffix = *scannerLockFileSuffix
+	cfg.Scanner.OnParseError = *scannerOnParseError
+	cfg.Scanner.LastGoodMaxAge = *scannerLastGoodMaxAge
+	cfg.Scanner.MaxSeriesPerFile = *scannerMaxSeriesPerFile
+	cfg.Scanner.MaxSeriesPerFamily = *scannerMaxSeriesPerFamily
+	cfg.Scanner.SeriesLimitAction = *scannerSeriesLimitAction
+	cfg.Scanner.TimestampPolicy = *scannerTimestampPolicy
+	cfg.Scanner.TimestampMaxAge = *scannerTimestampMaxAge
+	cfg.Scanner.TimestampMaxFuture = *scannerTimestampMaxFuture
+	cfg.Scanner.UntimestampedSamples = *scannerUntimestampedSamples
+	cfg.Collector.MemoryMaxAge = *memoryMaxAge
+	cfg.Collector.ExternalLabels = *collectorExternalLabels
+	cfg.Collector.ExternalLabelsPolicy = *collectorExternalLabelsPolicy
+	cfg.Collector.MaxSeries = *collectorMaxSeries
+	cfg.Collector.SnapshotFile = *collectorSnapshotFile
+	cfg.Collector.SnapshotInterval = *collectorSnapshotInterval
+	cfg.Collector.ConflictPolicy = *collectorConflictPolicy
+	cfg.Collector.MetadataPolicy = *collectorMetadataPolicy
+	cfg.Log.Level = *logLevel
+	return cfg
+}
+
+// loadConfig returns the configuration from the flags, overridden by the
+// configuration file if one was given.
+func loadConfig() (*config.Config, error) {
+	cfg := flagConfig()
+	if *configFile == "" {
+		return cfg, cfg.Validate()
+	}
+	return config.Load(*configFile, *cfg)
+}
+
+// loadWebConfig returns the TLS and basic authentication settings of cfg,
+// reading them from the web configuration file if one is set. It returns nil
+// if none are configured.
+func loadWebConfig(cfg *config.Config) (*webconfig.WebConfig, error) {
+	if cfg.Web.ConfigFile != "" {
+		return webconfig.LoadConfig(cfg.Web.ConfigFile)
+	}
+	if cfg.Web.TLS == nil && cfg.Web.BasicAuth == nil {
+		return nil, nil
+	}
+	webConfig := cfg.Web.WebConfig
+	return &webConfig, nil
+}
+
+// scannerConfig converts the settings of a directory into the settings of
+// its scanner. The global relabeling rules of cfg come first.
+func scannerConfig(cfg *config.Config, dir config.DirectoryConfig) scanner.Config {
+	return scanner.Config{
+		Path:                dir.Directory,
+		Recursive:           dir.Recursive,
+		Watch:               dir.Watch,
+		EnableFilesMinAge:   dir.FilesMinAge,
+		FilesMinAgeDuration: dir.FilesMinAgeDuration,
+		OldFilesExternalCmd: dir.OldFilesExternalCommand,
+		ScanInterval:        dir.Interval,
+		ContentHash:         dir.ContentHash,
+		UpdateMode:          dir.UpdateMode,
+		PathUpdateModes:     dir.PathUpdateModes,
+		FilePattern:         dir.FilePattern,
+		TTL:                 dir.TTL,
+		Labels:              dir.Labels,
+		PathLabels:          compilePathLabels(dir.PathLabels),
+		PathLabelConflict:   scanner.LabelConflictPolicy(dir.PathLabelConflict),
+		Relabel:             append(compileRelabel(cfg.Relabel, "global"), compileRelabel(dir.Relabel, dir.Name)...),
+		Filters: scanner.Filters{
+			Include:      dir.Include,
+			IncludeRegex: compileRegexes(dir.IncludeRegex),
+			Exclude:      dir.Exclude,
+			ExcludeRegex: compileRegexes(dir.ExcludeRegex),
+		},
+		FileMetrics:         dir.FileMetrics,
+		FileMetricsMaxFiles: dir.FileMetricsMaxFiles,
+		SettleTime:          dir.SettleTime,
+		SkipTempFiles:       dir.SkipTempFiles,
+		LockFileSuffix:      dir.LockFileSuffix,
+		OnParseError:        scanner.ParseErrorPolicy(dir.OnParseError),
+		LastGoodMaxAge:      dir.LastGoodMaxAge,
+		MaxSeriesPerFile:    dir.MaxSeriesPerFile,
+		MaxSeriesPerFamily:  dir.MaxSeriesPerFamily,
+		SeriesLimitAction:   scanner.SeriesLimitAction(dir.SeriesLimitAction),
+		TimestampPolicy:     collector.TimestampPolicy(dir.TimestampPolicy),
+		TimestampMaxAge:     dir.TimestampMaxAge,
+		TimestampMaxFuture:  dir.TimestampMaxFuture,
+		UntimestampedPolicy: scanner.UntimestampedPolicy(dir.UntimestampedSamples),
+	}
+}
+
+// metadataOverrides converts the metadata overrides of cfg for the collector.
+func metadataOverrides(cfg *config.Config) map[string]collector.MetadataOverride {
+	overrides := make(map[string]collector.MetadataOverride, len(cfg.Collector.MetadataOverrides))
+	for name, override := range cfg.Collector.MetadataOverrides {
+		overrides[name] = collector.MetadataOverride{Help: override.Help, Type: override.Type}
+	}
+	return overrides
+}
+
+// compileRegexes compiles regular expressions that were already validated
+// with the configuration.
+func compileRegexes(exprs []string) []*regexp.Regexp {
+	regexes := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		regexes = append(regexes, regexp.MustCompile(expr))
+	}
+	return regexes
+}
+
+// compilePathLabels compiles path label rules that were already validated
+// with the configuration.
+func compilePathLabels(rules []config.PathLabelConfig) []*regexp.Regexp {
+	regexes := make([]*regexp.Regexp, 0, len(rules))
+	for _, rule := range rules {
+		re, _ := rule.Compile()
+		regexes = append(regexes, re)
+	}
+	return regexes
+}
+
+// compileRelabel compiles relabeling rules that were already validated with
+// the configuration.
+func compileRelabel(configs []relabel.Config, scope string) []*relabel.Rule {
+	rules, _ := relabel.Compile(configs, scope)
+	return rules
+}
+
+// pushConfig converts cfg into the settings of the push API. Pushes are
+// persisted in push.persist_dir, which must be an existing directory.
+func pushConfig(cfg *config.Config) (push.Config, error) {
+	pushCfg := push.Config{
+		MaxBodySize:        cfg.Push.MaxBodySize,
+		Relabel:            compileRelabel(cfg.Relabel, "global"),
+		TimestampPolicy:    collector.TimestampPolicy(cfg.Scanner.TimestampPolicy),
+		TimestampMaxAge:    cfg.Scanner.TimestampMaxAge,
+		TimestampMaxFuture: cfg.Scanner.TimestampMaxFuture,
+	}
+	if dir := cfg.Push.PersistDir; cfg.Web.EnablePush && dir != "" {
+		fileinfo, err := os.Stat(dir)
+		if err != nil || !fileinfo.IsDir() {
+			return pushCfg, fmt.Errorf("the push persistence directory %s must be a directory", dir)
+		}
+		pushCfg.PersistDir = filepath.Clean(dir)
+	}
+	return pushCfg, nil
+}
+
+// logConfig logs the settings in use.
+func logConfig(cfg *config.Config) {
+	log.Printf("Listen address: %s", cfg.Web.ListenAddress)
+	log.Printf("OpenMetrics output: %t (created samples: %t)", cfg.Web.EnableOpenMetrics, cfg.Web.OpenMetricsCreatedSamples)
+	log.Printf("Push API: %t (persistence directory: %q)", cfg.Web.EnablePush, cfg.Push.PersistDir)
+	log.Printf("Max metric age: %s", cfg.Collector.MemoryMaxAge.String())
+	log.Printf("Global relabeling rules: %d", len(cfg.Relabel))
+	for name, value := range cfg.Collector.ExternalLabels {
+		log.Printf("External label: %s=%q (%s)", name, value, cfg.Collector.ExternalLabelsPolicy)
+	}
+	if cfg.Collector.MaxSeries > 0 {
+		log.Printf("Max stored series: %d", cfg.Collector.MaxSeries)
+	}
+	if cfg.Collector.SnapshotFile != "" {
+		log.Printf("Snapshot file: %s (every %s)", cfg.Collector.SnapshotFile, cfg.Collector.SnapshotInterval.String())
+	}
+	log.Printf("Conflict policy: %s", cfg.Collector.ConflictPolicy)
+	log.Printf("Metadata policy: %s", cfg.Collector.MetadataPolicy)
+	for name, override := range cfg.Collector.MetadataOverrides {
+		log.Printf("Metadata override for %s: help=%q type=%q", name, override.Help, override.Type)
+	}
+	for _, dir := range cfg.ScanDirectories() {
+		log.Printf("Metrics path: %s (name: %s)", dir.Directory, dir.Name)
+		log.Printf("  Recursive scan: %t", dir.Recursive)
+		log.Printf("  Watch mode: %t", dir.Watch)
+		log.Printf("  Scan interval: %s", dir.Interval.String())
+		log.Printf("  Content hash check: %t", dir.ContentHash)
+		log.Printf("  Update mode: %s", dir.UpdateMode)
+		for pattern, mode := range dir.PathUpdateModes {
+			log.Printf("  Update mode for %s: %s", pattern, mode)
+		}
+		if dir.FilePattern != "" {
+			log.Printf("  File pattern: %s", dir.FilePattern)
+		}
+		for _, patterns := range [][]string{dir.Include, dir.IncludeRegex} {
+			for _, pattern := range patterns {
+				log.Printf("  Include: %s", pattern)
+			}
+		}
+		for _, patterns := range [][]string{dir.Exclude, dir.ExcludeRegex} {
+			for _, pattern := range patterns {
+				log.Printf("  Exclude: %s", pattern)
+			}
+		}
+		log.Printf("  Per-file metrics: %t (max files: %d)", dir.FileMetrics, dir.FileMetricsMaxFiles)
+		log.Printf("  Skip temporary files: %t", dir.SkipTempFiles)
+		if dir.SettleTime > 0 {
+			log.Printf("  Settle time: %s", dir.SettleTime.String())
+		}
+		if dir.LockFileSuffix != "" {
+			log.Printf("  Lock file suffix: %s", dir.LockFileSuffix)
+		}
+		log.Printf("  On parse error: %s", dir.OnParseError)
+		if dir.OnParseError == string(scanner.ParseErrorKeepLast) && dir.LastGoodMaxAge > 0 {
+			log.Printf("  Last good version max age: %s", dir.LastGoodMaxAge.String())
+		}
+		if dir.MaxSeriesPerFile > 0 || dir.MaxSeriesPerFamily > 0 {
+			log.Printf("  Max series per file: %d, per family: %d (%s)", dir.MaxSeriesPerFile, dir.MaxSeriesPerFamily, dir.SeriesLimitAction)
+		}
+		log.Printf("  Timestamp policy: %s", dir.TimestampPolicy)
+		if dir.TimestampPolicy == string(collector.TimestampClamp) || dir.TimestampPolicy == string(collector.TimestampReject) {
+			log.Printf("  Timestamp max age: %s, max future: %s", dir.TimestampMaxAge.String(), dir.TimestampMaxFuture.String())
+		}
+		log.Printf("  Untimestamped samples: %s", dir.UntimestampedSamples)
+		if dir.TTL > 0 {
+			log.Printf("  Metric TTL: %s", dir.TTL.String())
+		}
+		for name, value := range dir.Labels {
+			log.Printf("  Label: %s=%q", name, value)
+		}
+		for _, rule := range dir.PathLabels {
+			if rule.Regex != "" {
+				log.Printf("  Path labels from regex: %s", rule.Regex)
+			} else {
+				log.Printf("  Path labels from template: %s", rule.Template)
+			}
+		}
+		if len(dir.PathLabels) > 0 {
+			log.Printf("  Path label conflicts: %s", dir.PathLabelConflict)
+		}
+		if len(dir.Relabel) > 0 {
+			log.Printf("  Relabeling rules: %d", len(dir.Relabel))
+		}
+		log.Printf("  Enable file min age check: %t", dir.FilesMinAge)
+		log.Printf("  Min file age duration: %s", dir.FilesMinAgeDuration.String())
+		log.Printf("  Cleanup command: %s", dir.OldFilesExternalCommand)
+	}
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"compress/gzip"
 	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/config"
+	"textfile_exporter/internal/parser"
+	"textfile_exporter/internal/push"
 	"textfile_exporter/internal/scanner"
 	"textfile_exporter/internal/webconfig"
 	"time"
@@ -18,6 +31,9 @@ import (
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -30,6 +46,10 @@ var (
 	goVersion string
 	projectURL string
 
+	configFile = kingpin.Flag(
+		"config.file",
+		"Path to a YAML configuration file that can set every other flag. It is reloaded on SIGHUP, or on POST /-/reload with --web.enable-lifecycle.",
+	).String()
 	webListenAddress = kingpin.Flag(
 		"web.listen-address",
 		"Address on which to expose metrics and web interface.",
@@ -38,6 +58,30 @@ var (
 		"web.config.file",
 		"Path to configuration file that can enable TLS or authentication.",
 	).String()
+	webEnableOpenMetrics = kingpin.Flag(
+		"web.enable-openmetrics",
+		"Serve the OpenMetrics format to clients that negotiate it, including exemplars and units.",
+	).Bool()
+	webOpenMetricsCreatedSamples = kingpin.Flag(
+		"web.openmetrics-created-samples",
+		"Emit the _created samples of counters, histograms and summaries in the OpenMetrics output.",
+	).Bool()
+	webEnablePush = kingpin.Flag(
+		"web.enable-push",
+		"Accept metrics pushed with the Pushgateway API on /metrics/job/<job>{/<label>/<value>}.",
+	).Bool()
+	webEnableLifecycle = kingpin.Flag(
+		"web.enable-lifecycle",
+		"Enable the reload of the configuration via HTTP POST on /-/reload.",
+	).Bool()
+	pushPersistDir = kingpin.Flag(
+		"push.persist-dir",
+		"Directory where the pushed metrics are written, so they survive restarts. It must not be scanned as a textfile directory.",
+	).String()
+	pushMaxBodySize = kingpin.Flag(
+		"push.max-body-size",
+		"Maximum size of a push request body, in bytes. Larger pushes are rejected with 413. 0 means no limit.",
+	).Default("10485760").Int64()
 	promPath = kingpin.Flag(
 		"textfile.directory",
 		"Path for prom file or dir of *.prom files.",
@@ -46,6 +90,106 @@ var (
 		"scanner.recursive",
 		"Recursively scan for .prom files in the given directory.",
 	).Bool()
+	scannerWatch = kingpin.Flag(
+		"scanner.watch",
+		"Watch the directory with inotify and re-read files as soon as they are written (Linux only). The scan interval is then used for a periodic full resync.",
+	).Bool()
+	scannerContentHash = kingpin.Flag(
+		"scanner.content-hash",
+		"Compare the content hash of files whose inode, size or mtime changed, and skip parsing them if the content is identical.",
+	).Bool()
+	scannerUpdateMode = kingpin.Flag(
+		"scanner.update-mode",
+		"What happens to series that vanish from a file or whose file is deleted: 'replace' drops them at the next scan, 'retain' keeps them until memory-max-age expires. One of: [replace, retain]",
+	).Default("replace").Enum("replace", "retain")
+	scannerPathUpdateModes = kingpin.Flag(
+		"scanner.path-update-mode",
+		"Override the update mode for files or directories matching a glob relative to the textfile directory, as GLOB=MODE (e.g. 'backups=retain'). Can be repeated.",
+	).StringMap()
+	scannerInclude = kingpin.Flag(
+		"scanner.include",
+		"Only read the files whose path relative to the textfile directory matches this glob ('**' matches any number of directories). Can be repeated.",
+	).Strings()
+	scannerIncludeRegex = kingpin.Flag(
+		"scanner.include-regex",
+		"Only read the files whose path relative to the textfile directory matches this regular expression. Can be repeated.",
+	).Strings()
+	scannerExclude = kingpin.Flag(
+		"scanner.exclude",
+		"Skip the files and directories whose path relative to the textfile directory matches this glob. Can be repeated.",
+	).Strings()
+	scannerExcludeRegex = kingpin.Flag(
+		"scanner.exclude-regex",
+		"Skip the files and directories whose path relative to the textfile directory matches this regular expression. Can be repeated.",
+	).Strings()
+	scannerPathLabelRegex = kingpin.Flag(
+		"scanner.path-label-regex",
+		"A regular expression matched against the path of each file relative to the textfile directory, whose named groups are added as labels to its series. Can be repeated.",
+	).Strings()
+	scannerPathLabelTemplate = kingpin.Flag(
+		"scanner.path-label-template",
+		"A path template relative to the textfile directory, such as '{team}/{job}.prom', whose placeholders are added as labels to the series of the matching files. Can be repeated.",
+	).Strings()
+	scannerPathLabelConflict = kingpin.Flag(
+		"scanner.path-label-conflict",
+		"What happens when a file already has a label derived from its path, with another value: 'keep_file' keeps the value of the file, 'override' replaces it, 'error' rejects the file. One of: [keep_file, override, error]",
+	).Default("keep_file").Enum("keep_file", "override", "error")
+	scannerFileMetrics = kingpin.Flag(
+		"scanner.file-metrics",
+		"Expose per-file metrics: mtime, size, number of series, parse success, parse duration and time of the last content change.",
+	).Default("true").Bool()
+	scannerFileMetricsMaxFiles = kingpin.Flag(
+		"scanner.file-metrics-max-files",
+		"The maximum number of files per directory with per-file metrics, including the metrics labeled by file, to bound their cardinality. 0 means no limit.",
+	).Default("1000").Int()
+	scannerSettleTime = kingpin.Flag(
+		"scanner.settle-time",
+		"Only read files that were not modified for this long, to skip files that are still being written. 0 disables the check.",
+	).Default("0s").Duration()
+	scannerSkipTempFiles = kingpin.Flag(
+		"scanner.skip-temp-files",
+		"Skip temporary files: files ending in ~, .tmp, .temp, .swp, .swx, .part or .partial, and Emacs lock files starting with .#.",
+	).Default("true").Bool()
+	scannerLockFileSuffix = kingpin.Flag(
+		"scanner.lock-file-suffix",
+		"Do not read a file while a file with the same name plus this suffix (e.g. .lock) exists. Empty disables lock files.",
+	).Default("").String()
+	scannerOnParseError = kingpin.Flag(
+		"scanner.on-parse-error",
+		"What happens to the metrics of a file that can no longer be parsed: 'drop' removes them, 'keep_last' keeps serving the last version that could be parsed. One of: [drop, keep_last]",
+	).Default("drop").Enum("drop", "keep_last")
+	scannerLastGoodMaxAge = kingpin.Flag(
+		"scanner.last-good-max-age",
+		"How long the last good version of a file is served with --scanner.on-parse-error=keep_last. 0 serves it until the file is fixed or removed.",
+	).Default("1h").Duration()
+	scannerMaxSeriesPerFile = kingpin.Flag(
+		"scanner.max-series-per-file",
+		"The maximum number of series read from a single file. 0 means no limit.",
+	).Default("0").Int()
+	scannerMaxSeriesPerFamily = kingpin.Flag(
+		"scanner.max-series-per-family",
+		"The maximum number of series of a single metric family read from a file. 0 means no limit.",
+	).Default("0").Int()
+	scannerSeriesLimitAction = kingpin.Flag(
+		"scanner.series-limit-action",
+		"What happens to a file over a series limit: 'reject' drops all its metrics, 'truncate' keeps the first series up to the limit, 'keep_last' keeps serving the last version within the limits. One of: [reject, truncate, keep_last]",
+	).Default("reject").Enum("reject", "truncate", "keep_last")
+	scannerTimestampPolicy = kingpin.Flag(
+		"scanner.timestamp-policy",
+		"What happens to the samples that have a timestamp: 'honor' keeps it, 'drop' removes it so that the scraper stamps the sample, 'mtime' replaces it with the modification time of the file or the time of the push, 'clamp' moves it into the accepted window, 'reject' drops the samples out of the window. Also applies to pushes. One of: [honor, drop, mtime, clamp, reject]",
+	).Default("honor").Enum("honor", "drop", "mtime", "clamp", "reject")
+	scannerTimestampMaxAge = kingpin.Flag(
+		"scanner.timestamp-max-age",
+		"How old a timestamp can be with --scanner.timestamp-policy=clamp or reject. 0 means no limit.",
+	).Default("1h").Duration()
+	scannerTimestampMaxFuture = kingpin.Flag(
+		"scanner.timestamp-max-future",
+		"How far in the future a timestamp can be with --scanner.timestamp-policy=clamp or reject. 0 means no limit.",
+	).Default("10m").Duration()
+	scannerUntimestampedSamples = kingpin.Flag(
+		"scanner.untimestamped-samples",
+		"The timestamp of the samples that have none: 'scan_time' stamps them at every scan, 'mtime' with the modification time of the file, 'none' exports them without timestamp. One of: [scan_time, mtime, none]",
+	).Default("scan_time").Enum("scan_time", "mtime", "none")
 	scanInterval = kingpin.Flag(
 		"scan-interval",
 		"The interval at which to scan the directory for .prom files.",
@@ -54,6 +198,34 @@ var (
 		"memory-max-age",
 		"Max age of in-memory metrics.",
 	).Default("25h").Duration()
+	collectorExternalLabels = kingpin.Flag(
+		"collector.external-label",
+		"A label added to every exported series from the textfiles and pushes, as NAME=VALUE (e.g. 'datacenter=eu1'). Can be repeated.",
+	).StringMap()
+	collectorExternalLabelsPolicy = kingpin.Flag(
+		"collector.external-labels-policy",
+		"What happens when a series already has an external label: 'preserve' keeps its value, 'override' replaces it with the external one. One of: [preserve, override]",
+	).Default("preserve").Enum("preserve", "override")
+	collectorMaxSeries = kingpin.Flag(
+		"collector.max-series",
+		"The maximum number of series stored from all files and pushes. A file or push that would exceed it is not stored. 0 means no limit.",
+	).Default("0").Int()
+	collectorSnapshotFile = kingpin.Flag(
+		"collector.snapshot-file",
+		"A file to which the metrics in memory are saved periodically and on shutdown, and from which they are restored at startup. Empty disables snapshots.",
+	).Default("").String()
+	collectorSnapshotInterval = kingpin.Flag(
+		"collector.snapshot-interval",
+		"How often the metrics in memory are saved to --collector.snapshot-file.",
+	).Default("5m").Duration()
+	collectorConflictPolicy = kingpin.Flag(
+		"collector.conflict-policy",
+		"Which version of a series defined by several files or pushes is exported: 'newest_file' that of the source modified last, 'newest_timestamp' the one with the newest timestamp, 'reject' none, 'file_label' all of them with a 'file' label. One of: [newest_file, newest_timestamp, reject, file_label]",
+	).Default("newest_file").Enum("newest_file", "newest_timestamp", "reject", "file_label")
+	collectorMetadataPolicy = kingpin.Flag(
+		"collector.metadata-policy",
+		"Which help text a metric is exported with when files or pushes disagree: 'first' that of the first one that gave one, 'longest' the longest one. One of: [first, longest]",
+	).Default("first").Enum("first", "longest")
 	enableFilesMinAge = kingpin.Flag(
 		"files-min-age",
 		"Enable or disable the minimum age check for files. If enabled, files older than 'files-min-age-duration' will be considered old.",
@@ -74,30 +246,229 @@ var (
 
 // Internal metrics exposed by the exporter itself.
 var (
-	scannedFilesCount = prometheus.NewGauge(prometheus.GaugeOpts{
+	scannedFilesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "textfile_exporter_scanned_files_count",
 		Help: "Number of .prom files found in the last scan.",
-	})
-	lastScanTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"directory"})
+	scanFilesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_scan_files_count",
+		Help: "Number of files parsed, reused unchanged from the previous scan, skipped as still being written, or served from their last good version in the last scan.",
+	}, []string{"directory", "result"})
+	lastScanTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "textfile_exporter_last_scan_timestamp",
 		Help: "Unix timestamp of the last scan.",
-	})
+	}, []string{"directory"})
 	fileScanErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "textfile_exporter_file_scan_errors_total",
 		Help: "Total number of errors encountered during file scanning.",
-	}, []string{"reason"})
+	}, []string{"directory", "reason"})
 	fileParseErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "textfile_exporter_file_parse_errors_total",
 		Help: "Total number of errors encountered during .prom file parsing.",
+	}, []string{"directory", "reason"})
+	unstableFileEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_unstable_file_events_total",
+		Help: "Total number of times a file was not read because it was still being written.",
+	}, []string{"directory", "file", "reason"})
+	fileParseFailing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_parse_failing",
+		Help: "Whether the last attempt to parse the file failed, by error category.",
+	}, []string{"directory", "file", "category"})
+	fileMtimeSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_mtime_seconds",
+		Help: "Unix timestamp of the modification time of the file.",
+	}, []string{"directory", "file"})
+	fileSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_size_bytes",
+		Help: "Size of the file in bytes.",
+	}, []string{"directory", "file"})
+	fileSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_series",
+		Help: "Number of series read from the file.",
+	}, []string{"directory", "file"})
+	fileParseSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_parse_success",
+		Help: "Whether the last parse of the file succeeded.",
+	}, []string{"directory", "file"})
+	fileParseDurationSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_parse_duration_seconds",
+		Help: "Duration of the last parse of the file.",
+	}, []string{"directory", "file"})
+	fileContentChangeTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "textfile_exporter_file_content_change_timestamp_seconds",
+		Help: "Unix timestamp of the modification time of the file when its content last changed.",
+	}, []string{"directory", "file"})
+	relabelDroppedSeriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_relabel_dropped_series_total",
+		Help: "Total number of series dropped by relabeling, by scope (global or directory name) and index of the rule.",
+	}, []string{"scope", "rule"})
+	seriesLimitHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_series_limit_hits_total",
+		Help: "Total number of times a file exceeded a series limit, by limit (file, family or global).",
+	}, []string{"directory", "file", "limit"})
+	sampleTimestampsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_sample_timestamps_total",
+		Help: "Total number of samples with a timestamp, counted at every scan and push, by outcome of the timestamp policy (honored, dropped, mtime, clamped or rejected). Pushed samples have an empty directory.",
+	}, []string{"directory", "outcome"})
+	pushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_pushes_total",
+		Help: "Total number of successful requests to the push API.",
+	}, []string{"method"})
+	pushErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_push_errors_total",
+		Help: "Total number of failed requests to the push API.",
 	}, []string{"reason"})
+	droppedFamiliesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "textfile_exporter_dropped_families_total",
+		Help: "Total number of metric families dropped because their type is not supported.",
+	}, []string{"type"})
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "textfile_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "textfile_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful configuration reload.",
+	})
+	snapshotLastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "textfile_exporter_snapshot_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last snapshot of the metrics in memory successfully written.",
+	})
+	snapshotSeries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "textfile_exporter_snapshot_series",
+		Help: "Number of series in the last snapshot written.",
+	})
+	snapshotErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "textfile_exporter_snapshot_errors_total",
+		Help: "Total number of snapshots of the metrics in memory that could not be written.",
+	})
+)
+
+// ownerSeriesDesc describes the number of stored series of each owner.
+var ownerSeriesDesc = prometheus.NewDesc(
+	"textfile_exporter_owner_series",
+	"Number of series stored in memory, by owner set with the owner directive.",
+	[]string{"owner"}, nil,
+)
+
+// ownerCollector exposes the number of stored series of each owner.
+type ownerCollector struct {
+	coll *collector.TimeAwareCollector
+}
+
+func (c ownerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ownerSeriesDesc
+}
+
+func (c ownerCollector) Collect(ch chan<- prometheus.Metric) {
+	for owner, n := range c.coll.SeriesByOwner() {
+		ch <- prometheus.MustNewConstMetric(ownerSeriesDesc, prometheus.GaugeValue, float64(n), owner)
+	}
+}
+
+var (
+	// seriesConflictsDesc describes the number of series of each metric
+	// defined by several sources.
+	seriesConflictsDesc = prometheus.NewDesc(
+		"textfile_exporter_series_conflicts",
+		"Number of series defined by several files or pushes, by metric.",
+		[]string{"metric"}, nil,
+	)
+	// metadataConflictsDesc flags the metrics whose help, type or unit differ
+	// between sources.
+	metadataConflictsDesc = prometheus.NewDesc(
+		"textfile_exporter_metadata_conflicts",
+		"Set to 1 for the metrics whose help, type or unit differ between files or pushes, or some of whose series are withheld.",
+		[]string{"metric"}, nil,
+	)
+	// withheldSeriesDesc describes the number of series of each metric not
+	// exported because their type differs from that of the metric.
+	withheldSeriesDesc = prometheus.NewDesc(
+		"textfile_exporter_metadata_withheld_series",
+		"Number of series not exported because their type differs from the type the metric is exported with and cannot be converted to it.",
+		[]string{"metric"}, nil,
+	)
 )
 
+// conflictCollector exposes the current conflicts between sources.
+type conflictCollector struct {
+	coll *collector.TimeAwareCollector
+}
+
+func (c conflictCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seriesConflictsDesc
+	ch <- metadataConflictsDesc
+	ch <- withheldSeriesDesc
+}
+
+func (c conflictCollector) Collect(ch chan<- prometheus.Metric) {
+	series := make(map[string]int)
+	for _, conflict := range c.coll.SeriesConflicts() {
+		series[conflict.Metric]++
+	}
+	for metric, n := range series {
+		ch <- prometheus.MustNewConstMetric(seriesConflictsDesc, prometheus.GaugeValue, float64(n), metric)
+	}
+	for _, conflict := range c.coll.MetadataConflicts() {
+		ch <- prometheus.MustNewConstMetric(metadataConflictsDesc, prometheus.GaugeValue, 1, conflict.Metric)
+		ch <- prometheus.MustNewConstMetric(withheldSeriesDesc, prometheus.GaugeValue, float64(conflict.WithheldSeries), conflict.Metric)
+	}
+}
+
+// scannerMetrics returns the internal metrics of the scanner of the named
+// directory.
+func scannerMetrics(name string) scanner.Metrics {
+	labels := prometheus.Labels{"directory": name}
+	return scanner.Metrics{
+		ScannedFilesCount:       scannedFilesCount.With(labels),
+		ScanFilesCount:          scanFilesCount.MustCurryWith(labels),
+		LastScanTimestamp:       lastScanTimestamp.With(labels),
+		FileScanErrorsTotal:     fileScanErrorsTotal.MustCurryWith(labels),
+		FileParseErrorsTotal:    fileParseErrorsTotal.MustCurryWith(labels),
+		DroppedFamiliesTotal:    droppedFamiliesTotal,
+		UnstableFileEventsTotal: unstableFileEventsTotal.MustCurryWith(labels),
+		FileParseFailing:        fileParseFailing.MustCurryWith(labels),
+		Files: scanner.FileMetrics{
+			Mtime:         fileMtimeSeconds.MustCurryWith(labels),
+			Size:          fileSizeBytes.MustCurryWith(labels),
+			Series:        fileSeries.MustCurryWith(labels),
+			ParseSuccess:  fileParseSuccess.MustCurryWith(labels),
+			ParseDuration: fileParseDurationSeconds.MustCurryWith(labels),
+			ContentChange: fileContentChangeTimestamp.MustCurryWith(labels),
+		},
+		RelabelDroppedTotal:   relabelDroppedSeriesTotal,
+		SeriesLimitHitsTotal:  seriesLimitHitsTotal.MustCurryWith(labels),
+		SampleTimestampsTotal: sampleTimestampsTotal.MustCurryWith(labels),
+	}
+}
+
+// deleteScannerMetrics removes the internal metrics of the scanner of the
+// named directory.
+func deleteScannerMetrics(name string) {
+	labels := prometheus.Labels{"directory": name}
+	scannedFilesCount.Delete(labels)
+	scanFilesCount.DeletePartialMatch(labels)
+	lastScanTimestamp.Delete(labels)
+	fileScanErrorsTotal.DeletePartialMatch(labels)
+	fileParseErrorsTotal.DeletePartialMatch(labels)
+	unstableFileEventsTotal.DeletePartialMatch(labels)
+	fileParseFailing.DeletePartialMatch(labels)
+	seriesLimitHitsTotal.DeletePartialMatch(labels)
+	sampleTimestampsTotal.DeletePartialMatch(labels)
+	relabelDroppedSeriesTotal.DeletePartialMatch(prometheus.Labels{"scope": name})
+	for _, vec := range []*prometheus.GaugeVec{fileMtimeSeconds, fileSizeBytes, fileSeries, fileParseSuccess, fileParseDurationSeconds, fileContentChangeTimestamp} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
 // indexHTML is the HTML content for the root page.
 const indexHTML = `<html>
 <head><title>Textfile Exporter</title></head>
 <body>
 <h1>Textfile Exporter</h1>
 <p>Click <a href='/metrics'>here</a> to see the metrics.</p>
+<p>Click <a href='/api/v1/errors'>here</a> to see the files that fail to parse.</p>
+<p>Click <a href='/api/v1/conflicts'>here</a> to see the series and metrics defined differently by several files.</p>
 </body>
 </html>`
 
@@ -114,6 +485,372 @@ func basicAuthMiddleware(handler http.Handler, username, password string) http.H
 	})
 }
 
+// unitGatherer sets the OpenMetrics unit of the metric families gathered, which
+// a Desc cannot carry, from the units the collector read.
+type unitGatherer struct {
+	prometheus.Gatherer
+	coll *collector.TimeAwareCollector
+}
+
+func (g unitGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	units := g.coll.Units()
+	for _, mf := range mfs {
+		if unit, ok := units[mf.GetName()]; ok {
+			mf.Unit = proto.String(unit)
+		}
+	}
+	return mfs, err
+}
+
+// openMetricsHandler serves the OpenMetrics format, with the units of the
+// metric families, to the clients that negotiate it, and hands the other
+// requests to next. promhttp cannot be used for it since it never writes
+// "# UNIT" lines. Like promhttp, it fails if any metric cannot be gathered and
+// compresses the response with gzip when the client accepts it.
+func openMetricsHandler(g prometheus.Gatherer, createdSamples bool, next http.Handler) http.Handler {
+	options := []expfmt.EncoderOption{expfmt.WithUnit()}
+	if createdSamples {
+		options = append(options, expfmt.WithCreatedLines())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if format.FormatType() != expfmt.TypeOpenMetrics {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Printf("Error gathering metrics: %v", err)
+			http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		enc := expfmt.NewEncoder(out, format, options...)
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				log.Printf("Error encoding metric family %s: %v", mf.GetName(), err)
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// reloadableHandler serves requests with the handler built from the latest
+// configuration.
+type reloadableHandler struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+func (h *reloadableHandler) set(handler http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
+
+// exporter holds the components that live across configuration reloads.
+type exporter struct {
+	mu        sync.Mutex
+	cfg       *config.Config
+	webConfig *webconfig.WebConfig
+	registry  *prometheus.Registry
+	coll      *collector.TimeAwareCollector
+	scanners  map[string]*scanner.Scanner
+	push      *push.Handler
+	handler   reloadableHandler
+}
+
+// newHandler builds the HTTP handler for the given configuration.
+func (e *exporter) newHandler(cfg *config.Config, webConfig *webconfig.WebConfig) (http.Handler, error) {
+	var metricsHandler http.Handler = promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+	if cfg.Web.EnableOpenMetrics {
+		metricsHandler = openMetricsHandler(unitGatherer{Gatherer: e.registry, coll: e.coll}, cfg.Web.OpenMetricsCreatedSamples, metricsHandler)
+	}
+	var indexHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(indexHTML))
+	})
+	var reloadHandler http.Handler
+	if cfg.Web.EnableLifecycle {
+		reloadHandler = http.HandlerFunc(e.serveReload)
+	}
+	var errorsHandler http.Handler = http.HandlerFunc(e.serveErrors)
+	var conflictsHandler http.Handler = http.HandlerFunc(e.serveConflicts)
+	var pushHandler http.Handler
+	if cfg.Web.EnablePush {
+		pushHandler = e.push
+	}
+
+	if webConfig != nil && webConfig.BasicAuth != nil && webConfig.BasicAuth.Username != "" && webConfig.BasicAuth.PasswordFile != "" {
+		password, err := ioutil.ReadFile(webConfig.BasicAuth.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+		passwordStr := strings.TrimSpace(string(password))
+		metricsHandler = basicAuthMiddleware(metricsHandler, webConfig.BasicAuth.Username, passwordStr)
+		indexHandler = basicAuthMiddleware(indexHandler, webConfig.BasicAuth.Username, passwordStr)
+		if reloadHandler != nil {
+			reloadHandler = basicAuthMiddleware(reloadHandler, webConfig.BasicAuth.Username, passwordStr)
+		}
+		errorsHandler = basicAuthMiddleware(errorsHandler, webConfig.BasicAuth.Username, passwordStr)
+		conflictsHandler = basicAuthMiddleware(conflictsHandler, webConfig.BasicAuth.Username, passwordStr)
+		if pushHandler != nil {
+			pushHandler = basicAuthMiddleware(pushHandler, webConfig.BasicAuth.Username, passwordStr)
+		}
+		log.Println("Basic authentication is enabled.")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/api/v1/errors", errorsHandler)
+	mux.Handle("/api/v1/conflicts", conflictsHandler)
+	mux.Handle("/", indexHandler)
+	if reloadHandler != nil {
+		mux.Handle("/-/reload", reloadHandler)
+	}
+	if pushHandler != nil {
+		mux.Handle(push.PathPrefix, pushHandler)
+	}
+	return mux, nil
+}
+
+// reload reads the configuration again and applies it without dropping the
+// metrics in memory. The listen address and the TLS settings are only read at
+// startup.
+func (e *exporter) reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.applyConfig()
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (e *exporter) applyConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	webConfig, err := loadWebConfig(cfg)
+	if err != nil {
+		return err
+	}
+	pushCfg, err := pushConfig(cfg)
+	if err != nil {
+		return err
+	}
+	handler, err := e.newHandler(cfg, webConfig)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Web.ListenAddress != e.cfg.Web.ListenAddress || !reflect.DeepEqual(tlsConfigOf(webConfig), tlsConfigOf(e.webConfig)) {
+		log.Printf("Changes to the listen address or the TLS settings require a restart")
+	}
+	logConfig(cfg)
+	e.coll.SetDefaultExpireDuration(cfg.Collector.MemoryMaxAge)
+	e.coll.SetExternalLabels(cfg.Collector.ExternalLabels, cfg.Collector.ExternalLabelsPolicy == "override")
+	e.coll.SetMaxSeries(cfg.Collector.MaxSeries)
+	e.coll.SetConflictPolicy(collector.ConflictPolicy(cfg.Collector.ConflictPolicy))
+	e.coll.SetMetadataPolicy(collector.MetadataPolicy(cfg.Collector.MetadataPolicy), metadataOverrides(cfg))
+	e.push.SetConfig(pushCfg)
+	e.updateScanners(cfg)
+	e.handler.set(handler)
+	e.cfg = cfg
+	e.webConfig = webConfig
+	log.Printf("Configuration reloaded")
+	return nil
+}
+
+// updateScanners starts, reloads or stops scanners so that there is one for
+// each directory of cfg, identified by its name.
+func (e *exporter) updateScanners(cfg *config.Config) {
+	dirs := cfg.ScanDirectories()
+	wanted := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		wanted[dir.Name] = true
+	}
+	// Removed scanners are stopped first, since a new one may read the same
+	// files under another name.
+	for name, sc := range e.scanners {
+		if !wanted[name] {
+			log.Printf("Stopping scanner of directory %s", name)
+			sc.Stop()
+			delete(e.scanners, name)
+			deleteScannerMetrics(name)
+		}
+	}
+	for _, dir := range dirs {
+		if sc, ok := e.scanners[dir.Name]; ok {
+			sc.Reload(scannerConfig(cfg, dir))
+			continue
+		}
+		sc := scanner.New(scannerConfig(cfg, dir), e.coll, scannerMetrics(dir.Name))
+		e.scanners[dir.Name] = sc
+		go sc.Start()
+	}
+}
+
+// serveReload handles POST /-/reload, which is only mounted with
+// --web.enable-lifecycle.
+func (e *exporter) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.reload(); err != nil {
+		log.Printf("Error reloading configuration: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// runSnapshots saves the metrics in memory to the snapshot file of the
+// current configuration, if any, at the configured interval. It never
+// returns.
+func (e *exporter) runSnapshots() {
+	for {
+		e.mu.Lock()
+		interval := e.cfg.Collector.SnapshotInterval
+		e.mu.Unlock()
+		time.Sleep(interval)
+		e.saveSnapshot()
+	}
+}
+
+// saveSnapshot saves the metrics in memory to the snapshot file of the
+// current configuration, if any.
+func (e *exporter) saveSnapshot() {
+	e.mu.Lock()
+	path := e.cfg.Collector.SnapshotFile
+	e.mu.Unlock()
+	e.writeSnapshot(path)
+}
+
+// shutdown stops the scanners, keeping their metrics, and saves a last
+// snapshot once no scan is in progress.
+func (e *exporter) shutdown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for name, sc := range e.scanners {
+		sc.Shutdown()
+		delete(e.scanners, name)
+	}
+	e.writeSnapshot(e.cfg.Collector.SnapshotFile)
+}
+
+// writeSnapshot saves the metrics in memory to the snapshot file path, if not
+// empty.
+func (e *exporter) writeSnapshot(path string) {
+	if path == "" {
+		return
+	}
+	begin := time.Now()
+	n, err := e.coll.SaveSnapshot(path)
+	if err != nil {
+		log.Printf("Error writing snapshot %s: %v", path, err)
+		snapshotErrorsTotal.Inc()
+		return
+	}
+	log.Printf("Saved %d series to snapshot %s in %f seconds", n, path, time.Since(begin).Seconds())
+	snapshotSeries.Set(float64(n))
+	snapshotLastSuccessTimestamp.SetToCurrentTime()
+}
+
+// fileError is a parse error as listed by /api/v1/errors.
+type fileError struct {
+	Directory string `json:"directory"`
+	*parser.Error
+}
+
+// serveErrors lists the files that currently fail to parse, with the location
+// and category of their error.
+func (e *exporter) serveErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	e.mu.Lock()
+	errs := []fileError{}
+	for name, sc := range e.scanners {
+		for _, err := range sc.Errors() {
+			errs = append(errs, fileError{Directory: name, Error: err})
+		}
+	}
+	e.mu.Unlock()
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Directory != errs[j].Directory {
+			return errs[i].Directory < errs[j].Directory
+		}
+		return errs[i].File < errs[j].File
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string      `json:"status"`
+		Data   []fileError `json:"data"`
+	}{"success", errs})
+}
+
+// conflictList is the data listed by /api/v1/conflicts.
+type conflictList struct {
+	Series   []collector.SeriesConflict   `json:"series"`
+	Metadata []collector.MetadataConflict `json:"metadata"`
+}
+
+// serveConflicts lists the series defined by several sources, with the
+// version of each source, and the metrics whose metadata differ between
+// sources.
+func (e *exporter) serveConflicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	conflicts := conflictList{
+		Series:   e.coll.SeriesConflicts(),
+		Metadata: e.coll.MetadataConflicts(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string       `json:"status"`
+		Data   conflictList `json:"data"`
+	}{"success", conflicts})
+}
+
+// tlsConfigOf returns the TLS settings of webConfig, which may be nil.
+func tlsConfigOf(webConfig *webconfig.WebConfig) *webconfig.TLSConfig {
+	if webConfig == nil {
+		return nil
+	}
+	return webConfig.TLS
+}
+
 // main is the entrypoint of the application.
 func main() {
 	kingpin.Version(fmt.Sprintf(
@@ -124,60 +861,128 @@ func main() {
 	kingpin.Parse()
 
 	log.Printf("Starting textfile_exporter version %s", version)
-	log.Printf("Listen address: %s", *webListenAddress)
-	log.Printf("Metrics path: %s", *promPath)
-	log.Printf("Recursive scan: %t", *scannerRecursive)
-	log.Printf("Scan interval: %s", (*scanInterval).String())
-	log.Printf("Max metric age: %s", (*memoryMaxAge).String())
-	log.Printf("Enable file min age check: %t", *enableFilesMinAge)
-	log.Printf("Min file age duration: %s", (*filesMinAgeDuration).String())
-	log.Printf("Cleanup command: %s", *oldFilesExternalCmd)
-
-	var webConfig *webconfig.WebConfig
-	if *webConfigFile != "" {
-		var err error
-		webConfig, err = webconfig.LoadConfig(*webConfigFile)
-		if err != nil {
-			log.Fatalf("Failed to load web config: %v", err)
-		}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
+	logConfig(cfg)
 
-	coll := collector.NewTimeAwareCollector(*memoryMaxAge)
+	webConfig, err := loadWebConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load web config: %v", err)
+	}
+	pushCfg, err := pushConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid push configuration: %v", err)
+	}
+
+	coll := collector.NewTimeAwareCollector(cfg.Collector.MemoryMaxAge)
+	coll.SetExternalLabels(cfg.Collector.ExternalLabels, cfg.Collector.ExternalLabelsPolicy == "override")
+	coll.SetMaxSeries(cfg.Collector.MaxSeries)
+	coll.SetConflictPolicy(collector.ConflictPolicy(cfg.Collector.ConflictPolicy))
+	coll.SetMetadataPolicy(collector.MetadataPolicy(cfg.Collector.MetadataPolicy), metadataOverrides(cfg))
+	if path := cfg.Collector.SnapshotFile; path != "" {
+		restored, expired, invalid, err := coll.LoadSnapshot(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			log.Printf("No snapshot found at %s", path)
+		case err != nil:
+			log.Printf("Error restoring snapshot %s, starting empty: %v", path, err)
+		default:
+			log.Printf("Restored %d series from snapshot %s, dropped %d expired series and %d invalid lines", restored, path, expired, invalid)
+		}
+	}
 
-	go scanner.Start(*promPath, *scannerRecursive, *enableFilesMinAge, *filesMinAgeDuration, *oldFilesExternalCmd, *scanInterval, coll, scannedFilesCount, lastScanTimestamp, fileScanErrorsTotal, fileParseErrorsTotal)
+	pushHandler := push.NewHandler(pushCfg, coll, push.Metrics{
+		PushesTotal:           pushesTotal,
+		PushErrorsTotal:       pushErrorsTotal,
+		DroppedFamiliesTotal:  droppedFamiliesTotal,
+		RelabelDroppedTotal:   relabelDroppedSeriesTotal,
+		SampleTimestampsTotal: sampleTimestampsTotal.MustCurryWith(prometheus.Labels{"directory": ""}),
+	})
+	if restored, err := pushHandler.Restore(); err != nil {
+		log.Printf("Error restoring persisted pushes from %s: %v", pushCfg.PersistDir, err)
+	} else if pushCfg.PersistDir != "" {
+		log.Printf("Restored %d persisted push groups from %s", restored, pushCfg.PersistDir)
+	}
 
 	r := prometheus.NewRegistry()
 	r.MustRegister(coll)
 	r.MustRegister(scannedFilesCount)
+	r.MustRegister(scanFilesCount)
 	r.MustRegister(lastScanTimestamp)
 	r.MustRegister(fileScanErrorsTotal)
 	r.MustRegister(fileParseErrorsTotal)
+	r.MustRegister(droppedFamiliesTotal)
+	r.MustRegister(unstableFileEventsTotal)
+	r.MustRegister(fileParseFailing)
+	r.MustRegister(relabelDroppedSeriesTotal)
+	r.MustRegister(seriesLimitHitsTotal)
+	r.MustRegister(sampleTimestampsTotal)
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "textfile_exporter_stored_series",
+		Help: "Number of series stored in memory, from all files and pushes.",
+	}, func() float64 { return float64(coll.SeriesCount()) }))
+	r.MustRegister(ownerCollector{coll: coll})
+	r.MustRegister(conflictCollector{coll: coll})
+	r.MustRegister(fileMtimeSeconds)
+	r.MustRegister(fileSizeBytes)
+	r.MustRegister(fileSeries)
+	r.MustRegister(fileParseSuccess)
+	r.MustRegister(fileParseDurationSeconds)
+	r.MustRegister(fileContentChangeTimestamp)
+	r.MustRegister(pushesTotal)
+	r.MustRegister(pushErrorsTotal)
+	r.MustRegister(configLastReloadSuccessful)
+	r.MustRegister(configLastReloadSuccessTimestamp)
+	r.MustRegister(snapshotLastSuccessTimestamp)
+	r.MustRegister(snapshotSeries)
+	r.MustRegister(snapshotErrorsTotal)
 	r.MustRegister(prometheus.NewGoCollector())
 	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 
-	metricsHandler := promhttp.HandlerFor(r, promhttp.HandlerOpts{})
-	indexHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(indexHTML))
-	})
+	e := &exporter{
+		cfg:       cfg,
+		webConfig: webConfig,
+		registry:  r,
+		coll:      coll,
+		scanners:  make(map[string]*scanner.Scanner),
+		push:      pushHandler,
+	}
+	e.updateScanners(cfg)
+	handler, err := e.newHandler(cfg, webConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up web handlers: %v", err)
+	}
+	e.handler.set(handler)
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
 
-	if webConfig != nil && webConfig.BasicAuth != nil && webConfig.BasicAuth.Username != "" && webConfig.BasicAuth.PasswordFile != "" {
-		password, err := ioutil.ReadFile(webConfig.BasicAuth.PasswordFile)
-		if err != nil {
-			log.Fatalf("Failed to read password file: %v", err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := e.reload(); err != nil {
+				log.Printf("Error reloading configuration: %v", err)
+			}
 		}
-		passwordStr := strings.TrimSpace(string(password))
-		metricsHandler = basicAuthMiddleware(metricsHandler, webConfig.BasicAuth.Username, passwordStr)
-		http.Handle("/metrics", metricsHandler)
-		http.Handle("/", basicAuthMiddleware(indexHandler, webConfig.BasicAuth.Username, passwordStr))
-		log.Println("Basic authentication is enabled.")
-	} else {
-		http.Handle("/metrics", metricsHandler)
-		http.Handle("/", indexHandler)
-	}
+	}()
+
+	// A last snapshot is taken on shutdown, so that a restart or an upgrade
+	// loses nothing.
+	go e.runSnapshots()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-term
+		log.Printf("Received %s, exiting", sig)
+		e.shutdown()
+		os.Exit(0)
+	}()
 
 	s := &http.Server{
-		Addr:           *webListenAddress,
-		Handler:        nil,
+		Addr:           cfg.Web.ListenAddress,
+		Handler:        &e.handler,
 		ReadTimeout:    30 * time.Second,
 		WriteTimeout:   30 * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -205,4 +1010,4 @@ func main() {
 		log.Printf("Listening without TLS...")
 		log.Fatal(s.ListenAndServe())
 	}
-}
\ No newline at end of file
+}
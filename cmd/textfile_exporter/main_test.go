@@ -0,0 +1,354 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/config"
+	"textfile_exporter/internal/parser"
+	"textfile_exporter/internal/scanner"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const openMetricsAccept = "application/openmetrics-text;version=1.0.0,text/plain;q=0.5"
+
+// newTestExporter returns an exporter whose collector holds the metrics of
+// the OpenMetrics data.
+func newTestExporter(t *testing.T, data string) *exporter {
+	t.Helper()
+	coll := collector.NewTimeAwareCollector(time.Hour)
+	result, err := parser.ParseData([]byte(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := coll.FromResult(result, "test.om", 0, false)
+	if err := coll.UpdateSource("test.om", metrics, collector.UpdateReplace); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(coll)
+	return &exporter{registry: registry, coll: coll}
+}
+
+// scrape requests /metrics with the given Accept header and returns the
+// content type and body of the response.
+func scrape(t *testing.T, handler http.Handler, accept string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d: %s", rec.Code, rec.Body.String())
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Header().Get("Content-Type"), string(body)
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	const data = `# TYPE jobs counter
+# HELP jobs Jobs run.
+jobs_total{host="a"} 42 1700000000 # {trace_id="4bf9"} 1 1700000000
+jobs_created{host="a"} 1600000000
+# TYPE backup_size_bytes gauge
+# UNIT backup_size_bytes bytes
+backup_size_bytes{host="a"} 3
+# EOF
+`
+	tests := []struct {
+		name           string
+		enable         bool
+		created        bool
+		accept         string
+		wantType       string
+		wantContains   []string
+		wantNoContains []string
+	}{
+		{
+			name:         "negotiated",
+			enable:       true,
+			accept:       openMetricsAccept,
+			wantType:     "application/openmetrics-text",
+			wantContains: []string{"# TYPE jobs counter\n", `jobs_total{host="a"} 42.0 1.7e+09 # {trace_id="4bf9"} 1.0 1.7e+09`, "# UNIT backup_size_bytes bytes\n", "# EOF\n"},
+			wantNoContains: []string{
+				"jobs_created",
+			},
+		},
+		{
+			name:         "negotiated with created samples",
+			enable:       true,
+			created:      true,
+			accept:       openMetricsAccept,
+			wantType:     "application/openmetrics-text",
+			wantContains: []string{`jobs_created{host="a"} 1.6e+09`},
+		},
+		{
+			name:           "not negotiated",
+			enable:         true,
+			wantType:       "text/plain",
+			wantContains:   []string{"# TYPE jobs_total counter\n", `jobs_total{host="a"} 42 1700000000000`},
+			wantNoContains: []string{"# EOF", "trace_id", "# UNIT"},
+		},
+		{
+			name:           "disabled",
+			accept:         openMetricsAccept,
+			wantType:       "text/plain",
+			wantContains:   []string{`jobs_total{host="a"} 42 1700000000000`},
+			wantNoContains: []string{"# EOF", "trace_id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, data)
+			var cfg config.Config
+			cfg.Web.EnableOpenMetrics = tt.enable
+			cfg.Web.OpenMetricsCreatedSamples = tt.created
+			handler, err := e.newHandler(&cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contentType, body := scrape(t, handler, tt.accept)
+			if !strings.HasPrefix(contentType, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", contentType, tt.wantType)
+			}
+			for _, s := range tt.wantContains {
+				if !strings.Contains(body, s) {
+					t.Errorf("body does not contain %q:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.wantNoContains {
+				if strings.Contains(body, s) {
+					t.Errorf("body contains %q:\n%s", s, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerOpenMetricsGzip(t *testing.T) {
+	e := newTestExporter(t, "# TYPE a_bytes gauge\n# UNIT a_bytes bytes\na_bytes 1\n# EOF\n")
+	var cfg config.Config
+	cfg.Web.EnableOpenMetrics = true
+	handler, err := e.newHandler(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", openMetricsAccept)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# UNIT a_bytes bytes\n"; !strings.Contains(string(body), want) || !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Errorf("body = %q, want an OpenMetrics exposition with %q", body, want)
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	e := newTestExporter(t, "a 1\n# EOF\n")
+	for _, tt := range []struct {
+		name            string
+		enableLifecycle bool
+		method          string
+		want            string
+	}{
+		// Without --web.enable-lifecycle, /-/reload falls through to the
+		// index page and no reload happens.
+		{"disabled", false, http.MethodPost, "Textfile Exporter"},
+		{"GET", true, http.MethodGet, "Only POST requests allowed."},
+		{"PUT", true, http.MethodPut, "Only POST requests allowed."},
+		// The reload is attempted, and fails since the test has no valid
+		// configuration.
+		{"POST", true, http.MethodPost, "Failed to reload config"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			cfg.Web.EnableLifecycle = tt.enableLifecycle
+			handler, err := e.newHandler(&cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, "/-/reload", nil))
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("%s /-/reload returned %d %q, want %q", tt.method, rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// testDirectory returns the settings of a scanned directory named name.
+func testDirectory(name, path string) config.DirectoryConfig {
+	return config.DirectoryConfig{Name: name, ScannerConfig: config.ScannerConfig{
+		Directory:            path,
+		Interval:             time.Hour,
+		UpdateMode:           collector.UpdateReplace,
+		PathLabelConflict:    "keep_file",
+		OnParseError:         "drop",
+		SeriesLimitAction:    "reject",
+		TimestampPolicy:      "honor",
+		UntimestampedSamples: "scan_time",
+		Labels:               map[string]string{"dir": name},
+	}}
+}
+
+// waitFor polls cond until it returns true or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdateScanners(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		if err := os.WriteFile(filepath.Join(dir, "a.prom"), []byte("a 1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &exporter{coll: collector.NewTimeAwareCollector(time.Hour), scanners: map[string]*scanner.Scanner{}}
+	defer func() {
+		for _, sc := range e.scanners {
+			sc.Stop()
+		}
+	}()
+	series := func() int { return testutil.CollectAndCount(e.coll) }
+
+	cfg := &config.Config{Directories: []config.DirectoryConfig{testDirectory("a", dirA), testDirectory("b", dirB)}}
+	e.updateScanners(cfg)
+	waitFor(t, "both directories", func() bool { return series() == 2 })
+	for _, name := range []string{"a", "b"} {
+		waitFor(t, "the scan of "+name, func() bool {
+			return testutil.ToFloat64(scannedFilesCount.WithLabelValues(name)) == 1
+		})
+	}
+
+	// Removing a directory stops its scanner and deletes its metrics, but
+	// leaves the other one alone.
+	cfg = &config.Config{Directories: []config.DirectoryConfig{testDirectory("a", dirA)}}
+	e.updateScanners(cfg)
+	if _, ok := e.scanners["b"]; ok || len(e.scanners) != 1 {
+		t.Errorf("scanners = %v, want a only", e.scanners)
+	}
+	waitFor(t, "the metrics of b to go away", func() bool { return series() == 1 })
+	if n := testutil.CollectAndCount(scannedFilesCount); n != 1 {
+		t.Errorf("scanned_files_count has %d series, want the one of a", n)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bad.prom"), []byte("a 1\nb abc\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := &exporter{coll: collector.NewTimeAwareCollector(time.Hour), scanners: map[string]*scanner.Scanner{}}
+	e.updateScanners(&config.Config{Directories: []config.DirectoryConfig{testDirectory("team", dir)}})
+	defer e.scanners["team"].Stop()
+	waitFor(t, "the parse error", func() bool { return len(e.scanners["team"].Errors()) == 1 })
+
+	rec := httptest.NewRecorder()
+	e.serveErrors(rec, httptest.NewRequest(http.MethodGet, "/api/v1/errors", nil))
+	var resp struct {
+		Status string
+		Data   []map[string]interface{}
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"directory": "team",
+		"file":      filepath.Join(dir, "bad.prom"),
+		"line":      float64(2),
+		"column":    float64(3),
+		"text":      "b abc",
+		"category":  "invalid_value",
+		"message":   `expected float as value, got "abc"`,
+	}
+	if resp.Status != "success" || len(resp.Data) != 1 || !reflect.DeepEqual(resp.Data[0], want) {
+		t.Errorf("response = %+v, want %v", resp, want)
+	}
+
+	rec = httptest.NewRecorder()
+	e.serveErrors(rec, httptest.NewRequest(http.MethodPost, "/api/v1/errors", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServeConflicts(t *testing.T) {
+	coll := collector.NewTimeAwareCollector(time.Hour)
+	coll.SetConflictPolicy(collector.ConflictReject)
+	for _, source := range []string{"a.prom", "b.prom"} {
+		result, err := parser.ParseData([]byte("m{x=\"1\"} 1\nm{x=\"2\"} 1\nother 1\n"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source == "b.prom" {
+			delete(result.Families, "other")
+		}
+		metrics, _ := coll.FromResult(result, source, 0, false)
+		if err := coll.UpdateSource(source, metrics, collector.UpdateReplace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &exporter{coll: coll}
+
+	rec := httptest.NewRecorder()
+	e.serveConflicts(rec, httptest.NewRequest(http.MethodGet, "/api/v1/conflicts", nil))
+	var resp struct {
+		Status string
+		Data   conflictList
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	for _, conflict := range resp.Data.Series {
+		series = append(series, conflict.Series)
+		if len(conflict.Sources) != 2 || conflict.Sources[0].Source != "a.prom" || conflict.Sources[0].Exported {
+			t.Errorf("sources of %s = %+v, want a.prom and b.prom, none exported", conflict.Series, conflict.Sources)
+		}
+	}
+	if want := []string{`m{x="1"}`, `m{x="2"}`}; resp.Status != "success" || !reflect.DeepEqual(series, want) {
+		t.Errorf("response %s with series conflicts %v, want %v", resp.Status, series, want)
+	}
+
+	if got := testutil.ToFloat64(conflictCollector{coll: coll}); got != 2 {
+		t.Errorf("textfile_exporter_series_conflicts = %v, want 2 for m", got)
+	}
+
+	rec = httptest.NewRecorder()
+	e.serveConflicts(rec, httptest.NewRequest(http.MethodPost, "/api/v1/conflicts", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
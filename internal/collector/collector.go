@@ -1,13 +1,18 @@
 package collector
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // StoredMetric is a wrapper around a Prometheus metric that includes timestamps
@@ -16,44 +21,222 @@ type StoredMetric struct {
 	InsertionTime  time.Time
 	PromMetric     *prometheus.Metric
 	ExpirationTime time.Time
+	// Timestamp is attached to PromMetric when it is collected. If it is
+	// zero, PromMetric is collected without timestamp.
+	Timestamp time.Time
+	// ScanTimestamp is true when Timestamp was assigned at scan time because
+	// the source did not provide one.
+	ScanTimestamp bool
+	// SampleTimestamp is the timestamp of the sample as read from the
+	// source, which the timestamp policy turns into Timestamp. It is zero if
+	// the sample had none or it is not honored.
+	SampleTimestamp time.Time
+	// Source identifies where the metric was read from, usually a file path.
+	Source string
+	// SourceTime is the time the source was last modified, such as the mtime
+	// of a file. It decides which source wins a conflict; if it is zero,
+	// InsertionTime is used instead.
+	SourceTime time.Time
+	// Unit is the OpenMetrics unit of the metric family, if the source
+	// declared one.
+	Unit string
+	// Retain is true when the metric is kept until ExpirationTime after it
+	// vanished from its source, whatever the UpdateMode.
+	Retain bool
+	// Owner is the team that owns the metric, if the source named one.
+	Owner string
+	// name, help and typ are those of the Desc of PromMetric, which cannot
+	// be read back from it, kept for snapshots and conflicts.
+	name string
+	help string
+	typ  dto.MetricType
+}
+
+// SetCreatedTimestamp records the time a counter, histogram or summary was
+// created, as read from an OpenMetrics _created sample.
+func (m *StoredMetric) SetCreatedTimestamp(created time.Time) {
+	*m.PromMetric = &createdTimestampMetric{Metric: *m.PromMetric, created: timestamppb.New(created)}
+}
+
+// AddExemplars attaches exemplars to a counter or histogram. For a histogram,
+// each exemplar goes to the first bucket its value fits in.
+func (m *StoredMetric) AddExemplars(exemplars ...prometheus.Exemplar) error {
+	promMetric, err := prometheus.NewMetricWithExemplars(*m.PromMetric, exemplars...)
+	if err != nil {
+		return err
+	}
+	*m.PromMetric = promMetric
+	return nil
+}
+
+// createdTimestampMetric sets the created timestamp of the wrapped metric
+// when it is written.
+type createdTimestampMetric struct {
+	prometheus.Metric
+	created *timestamppb.Timestamp
+}
+
+func (m *createdTimestampMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	switch {
+	case pb.Counter != nil:
+		pb.Counter.CreatedTimestamp = m.created
+	case pb.Histogram != nil:
+		pb.Histogram.CreatedTimestamp = m.created
+	case pb.Summary != nil:
+		pb.Summary.CreatedTimestamp = m.created
+	}
+	return nil
+}
+
+// Renew returns a copy of the metric as if it had been created again at now
+// from the same data: the expiration is pushed back by the original duration
+// and a timestamp assigned at scan time is moved to now.
+func (m StoredMetric) Renew(now time.Time) StoredMetric {
+	m.ExpirationTime = now.Add(m.ExpirationTime.Sub(m.InsertionTime))
+	m.InsertionTime = now
+	if m.ScanTimestamp {
+		m.Timestamp = now
+	}
+	return m
+}
+
+// Extend returns a copy of the metric whose expiration is pushed back as if it
+// had been stored again at now, with its timestamp left unchanged.
+func (m StoredMetric) Extend(now time.Time) StoredMetric {
+	m.ExpirationTime = now.Add(m.ExpirationTime.Sub(m.InsertionTime))
+	m.InsertionTime = now
+	return m
+}
+
+// UpdateMode controls what happens to the stored series of a source that are
+// missing from its latest update.
+type UpdateMode string
+
+const (
+	// UpdateReplace drops the series that are not part of the latest update.
+	UpdateReplace UpdateMode = "replace"
+	// UpdateRetain keeps the series that vanished from the latest update, or
+	// whose source was deleted, until their ExpirationTime.
+	UpdateRetain UpdateMode = "retain"
+)
+
+// ParseUpdateMode converts a string into an UpdateMode.
+func ParseUpdateMode(s string) (UpdateMode, error) {
+	switch mode := UpdateMode(s); mode {
+	case UpdateReplace, UpdateRetain:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid update mode %q, must be one of: replace, retain", s)
 }
 
 // TimeAwareCollector is a custom Prometheus collector that stores metrics in memory
 // and manages their lifecycle, including garbage collection of expired metrics.
 type TimeAwareCollector struct {
 	metrics               map[string]StoredMetric
+	sources               map[string]map[string]struct{}
 	metricsMutex          sync.Mutex
 	defaultExpireDuration time.Duration
+	// externalLabels are added to every series created from now on. Unless
+	// overrideExternal is set, a series that already has one of these labels
+	// keeps its own value.
+	externalLabels   map[string]string
+	overrideExternal bool
+	// maxSeries is the maximum number of series stored, or 0 for no limit.
+	maxSeries int
+	// conflicts holds the versions of the series defined by several sources,
+	// by key. Only the versions chosen by conflictPolicy are in metrics.
+	conflicts      map[string]*conflict
+	conflictPolicy ConflictPolicy
+	// families is the family registry, which reconciles the help texts and
+	// types of the metric families across sources, by family name.
+	families          map[string]*family
+	familySeq         uint64
+	metadataPolicy    MetadataPolicy
+	metadataOverrides map[string]MetadataOverride
+	// withheld is the number of series of each family left out by the last
+	// collection because of their type, so that changes are logged once.
+	withheld map[string]int
 }
 
+// ErrSeriesLimit is returned by UpdateSource when the update would exceed the
+// maximum number of series.
+var ErrSeriesLimit = errors.New("series limit exceeded")
+
 // NewTimeAwareCollector creates and returns a new TimeAwareCollector.
 // It requires a default expiration duration for the metrics it will store.
 func NewTimeAwareCollector(expire time.Duration) *TimeAwareCollector {
 	return &TimeAwareCollector{
 		metrics:               make(map[string]StoredMetric),
+		sources:               make(map[string]map[string]struct{}),
+		conflicts:             make(map[string]*conflict),
+		conflictPolicy:        ConflictNewestFile,
+		families:              make(map[string]*family),
+		metadataPolicy:        MetadataFirst,
+		withheld:              make(map[string]int),
 		defaultExpireDuration: expire,
 	}
 }
 
-// Describe implements the prometheus.Collector interface. It sends the descriptions
-// of all stored metrics to the provided channel.
-func (c *TimeAwareCollector) Describe(ch chan<- *prometheus.Desc) {
+// SetDefaultExpireDuration changes the expiration applied to the metrics
+// created from now on. Metrics already stored keep their expiration until they
+// are renewed.
+func (c *TimeAwareCollector) SetDefaultExpireDuration(expire time.Duration) {
 	c.metricsMutex.Lock()
 	defer c.metricsMutex.Unlock()
-	for _, metric := range c.metrics {
-		ch <- (*metric.PromMetric).Desc()
-	}
+	c.defaultExpireDuration = expire
+}
+
+// SetExternalLabels sets the labels added to the series created from now on,
+// as constant labels of their Desc. With override, they replace the labels of
+// the same name of the series; otherwise the series keeps its own value.
+// Metrics already stored keep their labels until they are created again.
+func (c *TimeAwareCollector) SetExternalLabels(labels map[string]string, override bool) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	c.externalLabels = labels
+	c.overrideExternal = override
+}
+
+// SetMaxSeries sets the maximum number of series stored across all sources. 0
+// means no limit. Series already stored are kept.
+func (c *TimeAwareCollector) SetMaxSeries(max int) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	c.maxSeries = max
+}
+
+// SeriesCount returns the number of series stored, including expired series
+// that were not collected yet.
+func (c *TimeAwareCollector) SeriesCount() int {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	return len(c.metrics)
+}
+
+// Describe implements the prometheus.Collector interface. It sends no
+// description, which makes the collector unchecked: the stored metrics change
+// over time, and the help texts and label names of a metric family may differ
+// between sources until they are reconciled in Collect.
+func (c *TimeAwareCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 // Collect implements the prometheus.Collector interface. It is called by the
 // Prometheus registry to gather metrics. It first removes expired metrics and
-// then sends the remaining metrics to the provided channel.
+// then sends the remaining metrics to the provided channel, with the help text
+// and type of their family chosen by the family registry. Gauges, counters
+// and untyped metrics are converted to the type set by a metadata override;
+// other metrics of another type than their family are left out, since the
+// registry would reject them, and counted.
 func (c *TimeAwareCollector) Collect(ch chan<- prometheus.Metric) {
 	begin := time.Now()
 	var expiredKeys []string
 	var localMap = make(map[string]StoredMetric)
 
 	c.metricsMutex.Lock()
+	c.expireConflictsLocked(time.Now())
 
 	// First, identify expired metrics without modifying the map while iterating.
 	for k, metric := range c.metrics {
@@ -66,16 +249,43 @@ func (c *TimeAwareCollector) Collect(ch chan<- prometheus.Metric) {
 
 	// Now, remove the expired metrics from the main map.
 	for _, k := range expiredKeys {
+		c.forgetKeyLocked(k)
 		delete(c.metrics, k)
 	}
 
+	families := c.reconcileLocked(localMap)
 	c.metricsMutex.Unlock()
 
 	// Finally, emit the surviving metrics. This is done outside the lock to
 	// avoid blocking other operations while writing to the channel.
+	descs := make(map[string]*prometheus.Desc, len(families))
+	withheld := make(map[string]int)
 	for _, metric := range localMap {
-		ch <- *metric.PromMetric
+		promMetric := *metric.PromMetric
+		if md, ok := families[metric.name]; ok {
+			if md.withholds(metric.typ) {
+				withheld[metric.name]++
+				continue
+			}
+			if metric.typ != md.typ {
+				promMetric = retypedMetric{Metric: promMetric, typ: md.typ}
+			}
+			if metric.help != md.help {
+				desc, ok := descs[metric.name]
+				if !ok {
+					desc = prometheus.NewDesc(metric.name, md.help, nil, nil)
+					descs[metric.name] = desc
+				}
+				promMetric = helpMetric{Metric: promMetric, desc: desc}
+			}
+		}
+		if metric.Timestamp.IsZero() {
+			ch <- promMetric
+			continue
+		}
+		ch <- prometheus.NewMetricWithTimestamp(metric.Timestamp, promMetric)
 	}
+	c.reportWithheld(withheld)
 	log.Printf("emitted %d metrics in %f seconds\n", len(localMap), time.Now().Sub(begin).Seconds())
 }
 
@@ -87,12 +297,54 @@ var specialCharsRegex = regexp.MustCompile("[^a-zA-Z0-9]+")
 // The key is a combination of the metric name and its sorted labels, ensuring that
 // each time series is unique.
 func (c *TimeAwareCollector) CreateMetric(name string, labels map[string]string, promtype prometheus.ValueType, value float64, timestamp time.Time, expireDuration time.Duration, description string) (string, StoredMetric) {
+	fullname, desc, labelValues := c.newDesc(name, description, labels)
+	promMetric := prometheus.MustNewConstMetric(desc, promtype, value, labelValues...)
+	return fullname, c.newStoredMetric(name, description, metricType(promtype), promMetric, timestamp, expireDuration)
+}
+
+// CreateHistogram is the histogram counterpart of CreateMetric. buckets maps
+// upper bounds to cumulative counts, excluding the +Inf bucket which is implied
+// by count.
+func (c *TimeAwareCollector) CreateHistogram(name string, labels map[string]string, count uint64, sum float64, buckets map[float64]uint64, timestamp time.Time, expireDuration time.Duration, description string) (string, StoredMetric) {
+	fullname, desc, labelValues := c.newDesc(name, description, labels)
+	promMetric := prometheus.MustNewConstHistogram(desc, count, sum, buckets, labelValues...)
+	return fullname, c.newStoredMetric(name, description, dto.MetricType_HISTOGRAM, promMetric, timestamp, expireDuration)
+}
+
+// CreateSummary is the summary counterpart of CreateMetric. quantiles maps
+// quantile ranks to their values.
+func (c *TimeAwareCollector) CreateSummary(name string, labels map[string]string, count uint64, sum float64, quantiles map[float64]float64, timestamp time.Time, expireDuration time.Duration, description string) (string, StoredMetric) {
+	fullname, desc, labelValues := c.newDesc(name, description, labels)
+	promMetric := prometheus.MustNewConstSummary(desc, count, sum, quantiles, labelValues...)
+	return fullname, c.newStoredMetric(name, description, dto.MetricType_SUMMARY, promMetric, timestamp, expireDuration)
+}
+
+// newDesc sanitizes the label names and returns the unique key of the series,
+// its Desc and the label values in the order expected by the Desc. The
+// external labels become the constant labels of the Desc.
+func (c *TimeAwareCollector) newDesc(name, description string, labels map[string]string) (string, *prometheus.Desc, []string) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	return c.newDescLocked(name, description, labels)
+}
+
+// newDescLocked is newDesc for callers that hold metricsMutex.
+func (c *TimeAwareCollector) newDescLocked(name, description string, labels map[string]string) (string, *prometheus.Desc, []string) {
 	// Sanitize label keys to conform to Prometheus standards.
 	labelMap := make(map[string]string)
 	for k, v := range labels {
 		labelMap[specialCharsRegex.ReplaceAllString(k, "_")] = v
 	}
 
+	constLabels := make(prometheus.Labels, len(c.externalLabels))
+	for k, v := range c.externalLabels {
+		if _, ok := labelMap[k]; ok && !c.overrideExternal {
+			continue
+		}
+		delete(labelMap, k)
+		constLabels[k] = v
+	}
+
 	// Create a sorted list of label names to ensure consistent key generation.
 	var keys []string
 	for k := range labelMap {
@@ -108,30 +360,231 @@ func (c *TimeAwareCollector) CreateMetric(name string, labels map[string]string,
 	for _, k := range keys {
 		labelNames = append(labelNames, k)
 		labelValues = append(labelValues, labelMap[k])
-		fullname = fullname + "|" + k + "|" + labelMap[k]
+	}
+	// The key covers the constant labels too, in the same sorted order, so
+	// that two series that only differ by an overridden label are merged.
+	for k := range constLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, ok := labelMap[k]
+		if !ok {
+			value = constLabels[k]
+		}
+		fullname = fullname + "|" + k + "|" + value
 	}
 
-	// Create the Prometheus metric.
-	desc := prometheus.NewDesc(name, description, labelNames, nil)
-	promMetric := prometheus.MustNewConstMetric(desc, promtype, value, labelValues...)
-	promMetric = prometheus.NewMetricWithTimestamp(timestamp, promMetric)
+	return fullname, prometheus.NewDesc(name, description, labelNames, constLabels), labelValues
+}
 
-	// Wrap it in our StoredMetric structure with expiration info.
+// newStoredMetric wraps promMetric in our StoredMetric structure with
+// expiration info. The timestamp is attached at collection time.
+func (c *TimeAwareCollector) newStoredMetric(name, description string, typ dto.MetricType, promMetric prometheus.Metric, timestamp time.Time, expireDuration time.Duration) StoredMetric {
+	now := time.Now().UTC()
 	var metric StoredMetric
-	metric.InsertionTime = time.Now().UTC()
+	metric.name = name
+	metric.help = description
+	metric.typ = typ
+	metric.InsertionTime = now
 	metric.PromMetric = &promMetric
-	if expireDuration > 0 {
-		metric.ExpirationTime = time.Now().UTC().Add(expireDuration)
-	} else {
-		metric.ExpirationTime = time.Now().UTC().Add(c.defaultExpireDuration)
+	metric.Timestamp = timestamp
+	if expireDuration <= 0 {
+		c.metricsMutex.Lock()
+		expireDuration = c.defaultExpireDuration
+		c.metricsMutex.Unlock()
 	}
+	metric.ExpirationTime = now.Add(expireDuration)
+	return metric
+}
 
-	return fullname, metric
+// metricType returns the type of the metrics of the given value type.
+func metricType(promtype prometheus.ValueType) dto.MetricType {
+	switch promtype {
+	case prometheus.CounterValue:
+		return dto.MetricType_COUNTER
+	case prometheus.GaugeValue:
+		return dto.MetricType_GAUGE
+	}
+	return dto.MetricType_UNTYPED
 }
 
-// ReplaceMetrics atomically replaces the entire set of stored metrics with a new map.
-func (c *TimeAwareCollector) ReplaceMetrics(newMetrics map[string]StoredMetric) {
+// UpdateSource stores newMetrics for the given source. With UpdateReplace, the
+// metrics previously stored for the source are replaced; with UpdateRetain,
+// series missing from newMetrics are kept until they expire. Metrics belonging
+// to other sources are left untouched, so a single file can be re-read without
+// rebuilding the whole metric set. If the update would exceed the maximum
+// number of series, nothing changes and ErrSeriesLimit is returned.
+func (c *TimeAwareCollector) UpdateSource(source string, newMetrics map[string]StoredMetric, mode UpdateMode) error {
 	c.metricsMutex.Lock()
-	c.metrics = newMetrics
-	c.metricsMutex.Unlock()
+	defer c.metricsMutex.Unlock()
+
+	if c.maxSeries > 0 && c.countAfterLocked(source, newMetrics, mode) > c.maxSeries {
+		return ErrSeriesLimit
+	}
+
+	if mode != UpdateRetain {
+		c.removeSourceLocked(source, newMetrics)
+	}
+	for k, metric := range newMetrics {
+		c.storeLocked(source, k, metric)
+	}
+	return nil
+}
+
+// UpdateSourceTruncated is like UpdateSource, but when the update would exceed
+// the maximum number of series, it stores the series of newMetrics in the
+// order of their keys while they fit instead of failing. It returns the number
+// of series left out.
+func (c *TimeAwareCollector) UpdateSourceTruncated(source string, newMetrics map[string]StoredMetric, mode UpdateMode) int {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+
+	dropped := 0
+	if c.maxSeries > 0 && c.countAfterLocked(source, newMetrics, mode) > c.maxSeries {
+		keys := make([]string, 0, len(newMetrics))
+		for k := range newMetrics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		removed := c.removedLocked(source, mode)
+		count := len(c.metrics) - len(removed)
+		kept := make(map[string]StoredMetric, len(newMetrics))
+		for _, k := range keys {
+			if _, exists := c.metrics[k]; !exists || removed[k] {
+				if count >= c.maxSeries {
+					dropped++
+					continue
+				}
+				count++
+			}
+			kept[k] = newMetrics[k]
+		}
+		newMetrics = kept
+	}
+
+	if mode != UpdateRetain {
+		c.removeSourceLocked(source, newMetrics)
+	}
+	for k, metric := range newMetrics {
+		c.storeLocked(source, k, metric)
+	}
+	return dropped
+}
+
+// countAfterLocked returns the number of series that would be stored after
+// the given update. The caller must hold metricsMutex.
+func (c *TimeAwareCollector) countAfterLocked(source string, newMetrics map[string]StoredMetric, mode UpdateMode) int {
+	removed := c.removedLocked(source, mode)
+	count := len(c.metrics) - len(removed)
+	for k := range newMetrics {
+		if _, exists := c.metrics[k]; !exists || removed[k] {
+			count++
+		}
+	}
+	return count
+}
+
+// removedLocked returns the keys of the series that an update of source with
+// the given mode removes before storing the new ones. The caller must hold
+// metricsMutex.
+func (c *TimeAwareCollector) removedLocked(source string, mode UpdateMode) map[string]bool {
+	removed := make(map[string]bool)
+	if mode != UpdateRetain {
+		for k := range c.sources[source] {
+			if !c.metrics[k].Retain {
+				removed[k] = true
+			}
+		}
+	}
+	return removed
+}
+
+// RemoveSource handles the disappearance of the given source. With
+// UpdateReplace its metrics are dropped immediately; with UpdateRetain they are
+// kept until they expire.
+func (c *TimeAwareCollector) RemoveSource(source string, mode UpdateMode) {
+	if mode == UpdateRetain {
+		return
+	}
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	c.removeSourceLocked(source, nil)
+}
+
+// Sources returns the list of sources that currently have metrics stored.
+func (c *TimeAwareCollector) Sources() []string {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	sources := make([]string, 0, len(c.sources))
+	for source := range c.sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Units returns the OpenMetrics unit of each metric family that declared one.
+func (c *TimeAwareCollector) Units() map[string]string {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	units := make(map[string]string)
+	for k, metric := range c.metrics {
+		if metric.Unit != "" {
+			name, _, _ := strings.Cut(k, "|")
+			units[name] = metric.Unit
+		}
+	}
+	return units
+}
+
+// SeriesByOwner returns the number of stored series of each owner, for the
+// series whose source named one.
+func (c *TimeAwareCollector) SeriesByOwner() map[string]int {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	owners := make(map[string]int)
+	for _, metric := range c.metrics {
+		if metric.Owner != "" {
+			owners[metric.Owner]++
+		}
+	}
+	return owners
+}
+
+// removeSourceLocked deletes the metrics owned by source, except those to
+// retain until they expire and those about to be replaced by the ones in keep.
+// The caller must hold metricsMutex.
+func (c *TimeAwareCollector) removeSourceLocked(source string, keep map[string]StoredMetric) {
+	keys := c.sources[source]
+	for k := range keys {
+		if _, ok := keep[k]; !ok && !c.metrics[k].Retain {
+			delete(c.metrics, k)
+			delete(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.sources, source)
+	}
+	for k, cf := range c.conflicts {
+		if _, ok := keep[k]; ok {
+			continue
+		}
+		if metric, ok := cf.candidates[source]; ok && !metric.Retain {
+			delete(cf.candidates, source)
+			c.resolveLocked(k)
+		}
+	}
+}
+
+// forgetKeyLocked removes k from the index of the source that owns it. The
+// caller must hold metricsMutex.
+func (c *TimeAwareCollector) forgetKeyLocked(k string) {
+	source := c.metrics[k].Source
+	if keys, ok := c.sources[source]; ok {
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(c.sources, source)
+		}
+	}
 }
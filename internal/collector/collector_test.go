@@ -0,0 +1,302 @@
+package collector
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather collects c and returns its samples by series, formatted as
+// name{label="value",...}.
+func gather(t *testing.T, c *TimeAwareCollector) map[string]*dto.Metric {
+	t.Helper()
+	families := gatherFamilies(t, c)
+	series := make(map[string]*dto.Metric)
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			series[seriesName(mf.GetName(), m)] = m
+		}
+	}
+	return series
+}
+
+// gatherFamilies collects c through a registry, like the /metrics handler.
+func gatherFamilies(t *testing.T, c *TimeAwareCollector) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// seriesName formats the series of metric m of family name.
+func seriesName(name string, m *dto.Metric) string {
+	var labels []string
+	for _, lp := range m.Label {
+		labels = append(labels, lp.GetName()+"=\""+lp.GetValue()+"\"")
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// seriesNames returns the sorted series of c.
+func seriesNames(t *testing.T, c *TimeAwareCollector) []string {
+	t.Helper()
+	var names []string
+	for name := range gather(t, c) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// value returns the value of a gauge, counter or untyped sample.
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	return 0
+}
+
+// gauges builds the gauges of source, one per name, with value v.
+func gauges(c *TimeAwareCollector, source string, v float64, ttl time.Duration, names ...string) map[string]StoredMetric {
+	metrics := make(map[string]StoredMetric)
+	for _, name := range names {
+		k, metric := c.CreateMetric(name, nil, prometheus.GaugeValue, v, time.Time{}, ttl, name)
+		metric.Source = source
+		metrics[k] = metric
+	}
+	return metrics
+}
+
+func TestUpdateSource(t *testing.T) {
+	tests := []struct {
+		name string
+		mode UpdateMode
+		want []string
+	}{
+		{"replace", UpdateReplace, []string{"b{}", "c{}", "other{}"}},
+		{"retain", UpdateRetain, []string{"a{}", "b{}", "c{}", "other{}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			if err := c.UpdateSource("f", gauges(c, "f", 1, 0, "a", "b"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.UpdateSource("g", gauges(c, "g", 1, 0, "other"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.UpdateSource("f", gauges(c, "f", 2, 0, "b", "c"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if got := seriesNames(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+			if got := value(gather(t, c)["b{}"]); got != 2 {
+				t.Errorf("b = %v, want the latest value 2", got)
+			}
+		})
+	}
+}
+
+func TestRemoveSource(t *testing.T) {
+	tests := []struct {
+		name string
+		mode UpdateMode
+		want []string
+	}{
+		{"replace", UpdateReplace, []string{"other{}"}},
+		{"retain", UpdateRetain, []string{"a{}", "other{}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.UpdateSource("f", gauges(c, "f", 1, 0, "a"), tt.mode)
+			c.UpdateSource("g", gauges(c, "g", 1, 0, "other"), tt.mode)
+			c.RemoveSource("f", tt.mode)
+			if got := seriesNames(t, c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetainedSeriesExpire(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.UpdateSource("f", gauges(c, "f", 1, 50*time.Millisecond, "short"), UpdateRetain)
+	c.UpdateSource("f", gauges(c, "f", 1, 0, "long"), UpdateRetain)
+	c.RemoveSource("f", UpdateRetain)
+	if got, want := seriesNames(t, c), []string{"long{}", "short{}"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("series = %v, want %v", got, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got, want := seriesNames(t, c), []string{"long{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series after expiration = %v, want %v", got, want)
+	}
+	if got, want := c.SeriesCount(), 1; got != want {
+		t.Errorf("SeriesCount() = %d, want %d", got, want)
+	}
+}
+
+func TestParseUpdateMode(t *testing.T) {
+	for _, s := range []string{"replace", "retain"} {
+		if mode, err := ParseUpdateMode(s); err != nil || string(mode) != s {
+			t.Errorf("ParseUpdateMode(%q) = %q, %v", s, mode, err)
+		}
+	}
+	if _, err := ParseUpdateMode("merge"); err == nil {
+		t.Error("ParseUpdateMode(\"merge\") succeeded, want an error")
+	}
+}
+
+func TestRenewAndExtend(t *testing.T) {
+	stored := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := stored.Add(time.Hour)
+	sample := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		metric        StoredMetric
+		renew, extend time.Time
+	}{
+		{"sample timestamp", StoredMetric{Timestamp: sample}, sample, sample},
+		{"scan timestamp", StoredMetric{Timestamp: stored, ScanTimestamp: true}, now, stored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.metric.InsertionTime = stored
+			tt.metric.ExpirationTime = stored.Add(10 * time.Minute)
+			for _, c := range []struct {
+				method    string
+				got       StoredMetric
+				timestamp time.Time
+			}{
+				{"Renew", tt.metric.Renew(now), tt.renew},
+				{"Extend", tt.metric.Extend(now), tt.extend},
+			} {
+				if !c.got.InsertionTime.Equal(now) || !c.got.ExpirationTime.Equal(now.Add(10*time.Minute)) {
+					t.Errorf("%s: inserted at %v, expires at %v, want %v and 10m later", c.method, c.got.InsertionTime, c.got.ExpirationTime, now)
+				}
+				if !c.got.Timestamp.Equal(c.timestamp) {
+					t.Errorf("%s: timestamp = %v, want %v", c.method, c.got.Timestamp, c.timestamp)
+				}
+			}
+		})
+	}
+}
+
+func TestExternalLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		override bool
+		want     map[string]float64
+	}{
+		{
+			name: "preserve",
+			want: map[string]float64{`m{dc="eu",host="a"}`: 1, `m{dc="eu",host="b"}`: 2, `m{dc="eu",host="x"}`: 3},
+		},
+		{
+			// The series that only differed by host are merged into one.
+			name:     "override",
+			override: true,
+			want:     map[string]float64{`m{dc="eu",host="x"}`: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.SetExternalLabels(map[string]string{"host": "x", "dc": "eu"}, tt.override)
+			metrics := make(map[string]StoredMetric)
+			for i, labels := range []map[string]string{{"host": "a"}, {"host": "b"}, {}} {
+				k, metric := c.CreateMetric("m", labels, prometheus.GaugeValue, float64(i+1), time.Time{}, 0, "m")
+				metric.Source = "f"
+				metrics[k] = metric
+			}
+			if err := c.UpdateSource("f", metrics, UpdateReplace); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]float64)
+			for name, m := range gather(t, c) {
+				got[name] = value(m)
+			}
+			if tt.override {
+				// Which of the merged series wins is not specified.
+				for name := range got {
+					got[name] = 0
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalLabelsApplyToNewSeries(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.UpdateSource("old", gauges(c, "old", 1, 0, "old"), UpdateReplace)
+	c.SetExternalLabels(map[string]string{"dc": "eu"}, false)
+	c.UpdateSource("new", gauges(c, "new", 1, 0, "new"), UpdateReplace)
+	if got, want := seriesNames(t, c), []string{`new{dc="eu"}`, "old{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetMaxSeries(3)
+	if err := c.UpdateSource("a", gauges(c, "a", 1, 0, "a1", "a2"), UpdateReplace); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateSource("b", gauges(c, "b", 1, 0, "b1", "b2"), UpdateReplace); !errors.Is(err, ErrSeriesLimit) {
+		t.Errorf("UpdateSource() over the limit = %v, want ErrSeriesLimit", err)
+	}
+	// A source can replace its own series within the limit.
+	if err := c.UpdateSource("a", gauges(c, "a", 1, 0, "a3", "a4", "a5"), UpdateReplace); err != nil {
+		t.Errorf("UpdateSource() replacing a source = %v", err)
+	}
+	// Retained series count against the limit.
+	if err := c.UpdateSource("a", gauges(c, "a", 1, 0, "a6"), UpdateRetain); !errors.Is(err, ErrSeriesLimit) {
+		t.Errorf("UpdateSource() retaining over the limit = %v, want ErrSeriesLimit", err)
+	}
+	if got, want := seriesNames(t, c), []string{"a3{}", "a4{}", "a5{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+}
+
+func TestMaxSeriesTruncated(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetMaxSeries(4)
+	if dropped := c.UpdateSourceTruncated("a", gauges(c, "a", 1, 0, "a1", "a2"), UpdateReplace); dropped != 0 {
+		t.Errorf("UpdateSourceTruncated() within the limit dropped %d series", dropped)
+	}
+	// The first series by key are stored while they fit.
+	if dropped := c.UpdateSourceTruncated("b", gauges(c, "b", 1, 0, "b3", "b1", "b2"), UpdateReplace); dropped != 1 {
+		t.Errorf("UpdateSourceTruncated() over the limit dropped %d series, want 1", dropped)
+	}
+	if got, want := seriesNames(t, c), []string{"a1{}", "a2{}", "b1{}", "b2{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+	// The series replaced by the update make room for the new ones.
+	if dropped := c.UpdateSourceTruncated("b", gauges(c, "b", 1, 0, "b4", "b5"), UpdateReplace); dropped != 0 {
+		t.Errorf("UpdateSourceTruncated() replacing a source dropped %d series", dropped)
+	}
+	if got, want := seriesNames(t, c), []string{"a1{}", "a2{}", "b4{}", "b5{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,353 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ConflictPolicy controls which version of a series is exported when several
+// sources define it.
+type ConflictPolicy string
+
+const (
+	// ConflictNewestFile exports the version of the source modified last.
+	ConflictNewestFile ConflictPolicy = "newest_file"
+	// ConflictNewestTimestamp exports the version with the newest sample
+	// timestamp, or of the source modified last for samples without one.
+	ConflictNewestTimestamp ConflictPolicy = "newest_timestamp"
+	// ConflictReject exports none of the versions.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictFileLabel exports every version with a FileLabel label set to
+	// its source.
+	ConflictFileLabel ConflictPolicy = "file_label"
+)
+
+// FileLabel is the label that tells the versions of a series apart with
+// ConflictFileLabel.
+const FileLabel = "file"
+
+// conflict holds the versions of a series defined by several sources.
+type conflict struct {
+	// candidates are the versions of the series, by source.
+	candidates map[string]StoredMetric
+	// exported are the keys of the metrics exported for the series.
+	exported []string
+}
+
+// SeriesConflict is a series defined by several sources.
+type SeriesConflict struct {
+	Metric  string           `json:"metric"`
+	Series  string           `json:"series"`
+	Sources []ConflictSource `json:"sources"`
+}
+
+// ConflictSource is the version of a conflicting series defined by a source.
+type ConflictSource struct {
+	Source     string    `json:"source"`
+	SourceTime time.Time `json:"source_time"`
+	Timestamp  time.Time `json:"timestamp"`
+	Exported   bool      `json:"exported"`
+}
+
+// MetadataConflict is a metric family whose help, type or unit differ
+// between sources, or some of whose series are withheld. Help and Type are
+// those it is exported with, and WithheldSeries is the number of its series
+// not exported because they have another type that cannot be converted.
+type MetadataConflict struct {
+	Metric         string           `json:"metric"`
+	Help           string           `json:"help"`
+	Type           string           `json:"type"`
+	WithheldSeries int              `json:"withheld_series"`
+	Sources        []FamilyMetadata `json:"sources"`
+}
+
+// FamilyMetadata is the metadata of a metric family in a source.
+type FamilyMetadata struct {
+	Source string `json:"source"`
+	Help   string `json:"help"`
+	Type   string `json:"type"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+// SetConflictPolicy sets the policy applied to the series defined by several
+// sources, including the current conflicts.
+func (c *TimeAwareCollector) SetConflictPolicy(policy ConflictPolicy) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	if policy == c.conflictPolicy {
+		return
+	}
+	c.conflictPolicy = policy
+	for k := range c.conflicts {
+		c.resolveLocked(k)
+	}
+}
+
+// storeLocked stores metric as the version of the series k defined by source.
+// If another source already defines the series, the conflict is resolved with
+// the conflict policy. The family of metric is registered either way, so that
+// its metadata does not depend on the version exported. The caller must hold
+// metricsMutex.
+func (c *TimeAwareCollector) storeLocked(source, k string, metric StoredMetric) {
+	metric.Source = source
+	c.registerFamilyLocked(metric)
+	if cf, ok := c.conflicts[k]; ok {
+		cf.candidates[source] = metric
+		c.resolveLocked(k)
+		return
+	}
+	if old, ok := c.metrics[k]; ok && old.Source != source {
+		log.Printf("Series %s is defined by both %s and %s, applying the %s conflict policy\n", k, old.Source, source, c.conflictPolicy)
+		c.conflicts[k] = &conflict{
+			candidates: map[string]StoredMetric{old.Source: old, source: metric},
+			exported:   []string{k},
+		}
+		c.resolveLocked(k)
+		return
+	}
+	c.exportLocked(k, metric)
+}
+
+// exportLocked stores metric under the key k, owned by its source. The caller
+// must hold metricsMutex.
+func (c *TimeAwareCollector) exportLocked(k string, metric StoredMetric) {
+	keys, ok := c.sources[metric.Source]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.sources[metric.Source] = keys
+	}
+	c.metrics[k] = metric
+	keys[k] = struct{}{}
+	c.registerFamilyLocked(metric)
+}
+
+// resolveLocked exports the versions of the conflicting series k chosen by
+// the conflict policy, instead of those exported so far. Once a single
+// source defines the series, the conflict is over. The caller must hold
+// metricsMutex.
+func (c *TimeAwareCollector) resolveLocked(k string) {
+	cf := c.conflicts[k]
+	for _, e := range cf.exported {
+		if _, ok := c.metrics[e]; ok {
+			c.forgetKeyLocked(e)
+			delete(c.metrics, e)
+		}
+	}
+	cf.exported = nil
+
+	if len(cf.candidates) <= 1 {
+		delete(c.conflicts, k)
+		for _, metric := range cf.candidates {
+			c.exportLocked(k, metric)
+		}
+		return
+	}
+	switch c.conflictPolicy {
+	case ConflictReject:
+	case ConflictFileLabel:
+		for source, metric := range cf.candidates {
+			key, labeled, err := c.withLabelLocked(metric, FileLabel, source)
+			if err != nil {
+				log.Printf("Error adding the %s label to series %s of %s: %v\n", FileLabel, k, source, err)
+				continue
+			}
+			c.exportLocked(key, labeled)
+			cf.exported = append(cf.exported, key)
+		}
+	default:
+		c.exportLocked(k, c.winner(cf))
+		cf.exported = []string{k}
+	}
+}
+
+// winner returns the version of a conflicting series exported with the
+// newest_file and newest_timestamp policies. Ties go to the source that sorts
+// last.
+func (c *TimeAwareCollector) winner(cf *conflict) StoredMetric {
+	sources := make([]string, 0, len(cf.candidates))
+	for source := range cf.candidates {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	winner := cf.candidates[sources[0]]
+	for _, source := range sources[1:] {
+		metric := cf.candidates[source]
+		if c.conflictPolicy == ConflictNewestTimestamp {
+			if t, w := sampleTime(metric), sampleTime(winner); !t.Equal(w) {
+				if t.After(w) {
+					winner = metric
+				}
+				continue
+			}
+		}
+		if !sourceTime(metric).Before(sourceTime(winner)) {
+			winner = metric
+		}
+	}
+	return winner
+}
+
+// sourceTime returns the time the source of metric was last modified, or the
+// time the metric was stored if it is unknown.
+func sourceTime(metric StoredMetric) time.Time {
+	if metric.SourceTime.IsZero() {
+		return metric.InsertionTime
+	}
+	return metric.SourceTime
+}
+
+// sampleTime returns the timestamp of metric read from its source, or the
+// time its source was last modified if it had none.
+func sampleTime(metric StoredMetric) time.Time {
+	if metric.ScanTimestamp || metric.Timestamp.IsZero() {
+		return sourceTime(metric)
+	}
+	return metric.Timestamp
+}
+
+// withLabelLocked returns a copy of metric with the label name set to value,
+// and its key. The caller must hold metricsMutex.
+func (c *TimeAwareCollector) withLabelLocked(metric StoredMetric, name, value string) (string, StoredMetric, error) {
+	var pb dto.Metric
+	if err := (*metric.PromMetric).Write(&pb); err != nil {
+		return "", StoredMetric{}, err
+	}
+	labels := make(map[string]string, len(pb.GetLabel())+1)
+	for _, label := range pb.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	labels[name] = value
+	fullname, desc, labelValues := c.newDescLocked(metric.name, metric.help, labels)
+	promMetric, err := newConstMetric(desc, metric.typ, &pb, labelValues)
+	if err != nil {
+		return "", StoredMetric{}, err
+	}
+	metric.PromMetric = &promMetric
+	addOpenMetricsData(&metric, &pb, metric.Source)
+	return fullname, metric, nil
+}
+
+// expireConflictsLocked drops the expired versions of the conflicting series.
+// The caller must hold metricsMutex.
+func (c *TimeAwareCollector) expireConflictsLocked(now time.Time) {
+	for k, cf := range c.conflicts {
+		expired := false
+		for source, metric := range cf.candidates {
+			if now.After(metric.ExpirationTime) {
+				delete(cf.candidates, source)
+				expired = true
+			}
+		}
+		if expired {
+			c.resolveLocked(k)
+		}
+	}
+}
+
+// SeriesConflicts returns the series currently defined by several sources,
+// sorted by series.
+func (c *TimeAwareCollector) SeriesConflicts() []SeriesConflict {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	conflicts := make([]SeriesConflict, 0, len(c.conflicts))
+	for _, cf := range c.conflicts {
+		exported := make(map[string]bool)
+		for _, e := range cf.exported {
+			if metric, ok := c.metrics[e]; ok {
+				exported[metric.Source] = true
+			}
+		}
+		var sc SeriesConflict
+		for source, metric := range cf.candidates {
+			if sc.Series == "" {
+				sc.Metric = metric.name
+				sc.Series = seriesString(metric)
+			}
+			sc.Sources = append(sc.Sources, ConflictSource{
+				Source:     source,
+				SourceTime: sourceTime(metric),
+				Timestamp:  metric.Timestamp,
+				Exported:   exported[source],
+			})
+		}
+		sort.Slice(sc.Sources, func(i, j int) bool { return sc.Sources[i].Source < sc.Sources[j].Source })
+		conflicts = append(conflicts, sc)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Series < conflicts[j].Series })
+	return conflicts
+}
+
+// seriesString formats the name and labels of metric like in the text format.
+func seriesString(metric StoredMetric) string {
+	var pb dto.Metric
+	if err := (*metric.PromMetric).Write(&pb); err != nil {
+		return metric.name
+	}
+	labels := make([]string, 0, len(pb.GetLabel()))
+	for _, label := range pb.GetLabel() {
+		labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	return metric.name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// MetadataConflicts returns the metric families whose help, type or unit
+// differ between the sources that define them, or some of whose series are
+// withheld, sorted by name.
+func (c *TimeAwareCollector) MetadataConflicts() []MetadataConflict {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	families := make(map[string]map[string]FamilyMetadata)
+	add := func(metric StoredMetric) {
+		sources, ok := families[metric.name]
+		if !ok {
+			sources = make(map[string]FamilyMetadata)
+			families[metric.name] = sources
+		}
+		sources[metric.Source] = FamilyMetadata{
+			Source: metric.Source,
+			Help:   metric.help,
+			Type:   strings.ToLower(metric.typ.String()),
+			Unit:   metric.Unit,
+		}
+	}
+	for _, metric := range c.metrics {
+		add(metric)
+	}
+	for _, cf := range c.conflicts {
+		for _, metric := range cf.candidates {
+			add(metric)
+		}
+	}
+
+	conflicts := []MetadataConflict{}
+	for name, sources := range families {
+		distinct := make(map[FamilyMetadata]bool)
+		mc := MetadataConflict{Metric: name}
+		for _, md := range sources {
+			mc.Sources = append(mc.Sources, md)
+			md.Source = ""
+			distinct[md] = true
+		}
+		md := c.familyMetadataLocked(name)
+		mc.Help = md.help
+		mc.Type = strings.ToLower(md.typ.String())
+		for _, metric := range c.metrics {
+			if metric.name == name && md.withholds(metric.typ) {
+				mc.WithheldSeries++
+			}
+		}
+		if len(distinct) < 2 && mc.WithheldSeries == 0 {
+			continue
+		}
+		sort.Slice(mc.Sources, func(i, j int) bool { return mc.Sources[i].Source < mc.Sources[j].Source })
+		conflicts = append(conflicts, mc)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Metric < conflicts[j].Metric })
+	return conflicts
+}
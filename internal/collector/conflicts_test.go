@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// version stores the gauge name of source with value v, read from a source
+// modified at sourceTime and with the sample timestamp ts, if not zero.
+func version(t *testing.T, c *TimeAwareCollector, source, name string, v float64, sourceTime, ts time.Time) {
+	t.Helper()
+	k, metric := c.CreateMetric(name, nil, prometheus.GaugeValue, v, ts, 0, name)
+	metric.SourceTime = sourceTime
+	if ts.IsZero() {
+		metric.ScanTimestamp = true
+	}
+	if err := c.UpdateSource(source, map[string]StoredMetric{k: metric}, UpdateReplace); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		policy ConflictPolicy
+		want   map[string]float64
+	}{
+		// b.prom was modified last, but a.prom has the newest sample.
+		{ConflictNewestFile, map[string]float64{"m{}": 2}},
+		{ConflictNewestTimestamp, map[string]float64{"m{}": 1}},
+		{ConflictReject, map[string]float64{}},
+		{ConflictFileLabel, map[string]float64{`m{file="a.prom"}`: 1, `m{file="b.prom"}`: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.SetConflictPolicy(tt.policy)
+			version(t, c, "a.prom", "m", 1, now.Add(-time.Hour), now.Add(-time.Minute))
+			version(t, c, "b.prom", "m", 2, now, now.Add(-time.Hour))
+			got := make(map[string]float64)
+			for name, m := range gather(t, c) {
+				got[name] = value(m)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+
+			conflicts := c.SeriesConflicts()
+			if len(conflicts) != 1 || conflicts[0].Series != "m{}" || len(conflicts[0].Sources) != 2 {
+				t.Fatalf("SeriesConflicts() = %+v, want m defined by a.prom and b.prom", conflicts)
+			}
+			var exported []string
+			for _, source := range conflicts[0].Sources {
+				if source.Exported {
+					exported = append(exported, source.Source)
+				}
+			}
+			if len(exported) != len(tt.want) {
+				t.Errorf("exported sources = %v, want %d", exported, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestNewestTimestampFallsBackToSourceTime(t *testing.T) {
+	now := time.Now()
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetConflictPolicy(ConflictNewestTimestamp)
+	// Samples without timestamp compare by the time their source was
+	// modified.
+	version(t, c, "a.prom", "m", 1, now.Add(-time.Minute), time.Time{})
+	version(t, c, "b.prom", "m", 2, now.Add(-time.Hour), now.Add(-30*time.Minute))
+	if got := value(gather(t, c)["m{}"]); got != 1 {
+		t.Errorf("m = %v, want the version of a.prom", got)
+	}
+}
+
+func TestConflictEnds(t *testing.T) {
+	now := time.Now()
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetConflictPolicy(ConflictFileLabel)
+	version(t, c, "a.prom", "m", 1, now.Add(-time.Hour), time.Time{})
+	version(t, c, "b.prom", "m", 2, now, time.Time{})
+
+	c.RemoveSource("b.prom", UpdateReplace)
+	if got, want := seriesNames(t, c), []string{"m{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series after removing b.prom = %v, want %v", got, want)
+	}
+	if got := c.SeriesConflicts(); len(got) != 0 {
+		t.Errorf("SeriesConflicts() = %+v, want none", got)
+	}
+	if got := value(gather(t, c)["m{}"]); got != 1 {
+		t.Errorf("m = %v, want the version of a.prom", got)
+	}
+}
+
+func TestSetConflictPolicyResolvesAgain(t *testing.T) {
+	now := time.Now()
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetConflictPolicy(ConflictReject)
+	version(t, c, "a.prom", "m", 1, now.Add(-time.Hour), time.Time{})
+	version(t, c, "b.prom", "m", 2, now, time.Time{})
+	if got := len(gather(t, c)); got != 0 {
+		t.Errorf("%d series exported with the reject policy, want 0", got)
+	}
+
+	c.SetConflictPolicy(ConflictNewestFile)
+	if got := value(gather(t, c)["m{}"]); got != 2 {
+		t.Errorf("m = %v, want the version of b.prom once the policy changed", got)
+	}
+	// A source replacing its version keeps the conflict going.
+	version(t, c, "a.prom", "m", 3, now.Add(time.Minute), time.Time{})
+	if got := value(gather(t, c)["m{}"]); got != 3 {
+		t.Errorf("m = %v, want the new version of a.prom", got)
+	}
+}
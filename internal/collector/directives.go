@@ -0,0 +1,54 @@
+package collector
+
+import (
+	"log"
+	"strconv"
+	"textfile_exporter/internal/parser"
+	"time"
+)
+
+// seriesDirectives holds the settings of a series given by its directive
+// labels, see parser.DirectiveLabelPrefix.
+type seriesDirectives struct {
+	ttl             time.Duration
+	honorTimestamps bool
+	retain          bool
+	owner           string
+}
+
+// newSeriesDirectives reads the directive labels of a series. Settings without
+// a directive keep their default: the TTL is expireDuration and timestamps
+// are honored. Directives are validated by the parser, but relabeling may
+// still set an invalid value, which is ignored. source is only used in log
+// messages.
+func newSeriesDirectives(directives map[string]string, expireDuration time.Duration, source string) seriesDirectives {
+	d := seriesDirectives{ttl: expireDuration, honorTimestamps: true}
+	for name, value := range directives {
+		var err error
+		switch name {
+		case parser.LabelTTL:
+			var ttl time.Duration
+			if ttl, err = parser.ParseTTL(value); err == nil {
+				d.ttl = ttl
+			}
+		case parser.LabelHonorTimestamps:
+			var honor bool
+			if honor, err = strconv.ParseBool(value); err == nil {
+				d.honorTimestamps = honor
+			}
+		case parser.LabelRetain:
+			var retain bool
+			if retain, err = strconv.ParseBool(value); err == nil {
+				d.retain = retain
+			}
+		case parser.LabelOwner:
+			d.owner = value
+		default:
+			log.Printf("Ignoring unknown directive %s from %s\n", name, source)
+		}
+		if err != nil {
+			log.Printf("Ignoring invalid %s directive from %s: %v\n", name, source, err)
+		}
+	}
+	return d
+}
@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"log"
+	"math"
+	"strings"
+	"textfile_exporter/internal/parser"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromResult converts the metric families of a parsed file or push into
+// stored metrics, keyed like CreateMetric, that expire after expireDuration
+// (or the default expiration if it is zero) unless their ttl directive says
+// otherwise. Directive labels are not exported. Families whose type is not
+// supported are skipped and returned in dropped, by family name. source is only
+// used in log messages.
+func (c *TimeAwareCollector) FromResult(result *parser.Result, source string, expireDuration time.Duration, debugging bool) (map[string]StoredMetric, map[string]dto.MetricType) {
+	newMetrics := make(map[string]StoredMetric)
+	dropped := make(map[string]dto.MetricType)
+	for name, mf := range result.Families {
+		if debugging {
+			log.Println("Metric Name: ", name)
+			log.Println("Metric Type: ", mf.GetType())
+			log.Println("Metric Help: ", mf.GetHelp())
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_COUNTER, dto.MetricType_UNTYPED, dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		default:
+			dropped[name] = mf.GetType()
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			directives := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				if debugging {
+					log.Println("  Label_Name:  ", label.GetName())
+					log.Println("  Label_Value: ", label.GetValue())
+				}
+				if strings.HasPrefix(label.GetName(), parser.DirectiveLabelPrefix) {
+					directives[label.GetName()] = label.GetValue()
+					continue
+				}
+				labels[label.GetName()] = label.GetValue()
+			}
+			d := newSeriesDirectives(directives, expireDuration, source)
+
+			timestamp := m.GetTimestampMs()
+			if debugging {
+				log.Println("  Timestamp: ", timestamp)
+			}
+			// If the metric has no timestamp, or it must not be honored,
+			// assign the current time.
+			scanTimestamp := timestamp <= 0 || !d.honorTimestamps
+			if scanTimestamp {
+				timestamp = time.Now().UTC().UnixNano() / 1000000
+				if debugging {
+					log.Println("  Timestamp: ", timestamp, " (now)")
+				}
+			}
+			ts := time.Unix(0, timestamp*int64(time.Millisecond))
+
+			var fullname string
+			var metric StoredMetric
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				if debugging {
+					log.Println("  Metric Value: ", m.GetGauge().GetValue())
+				}
+				fullname, metric = c.CreateMetric(name, labels, prometheus.GaugeValue, m.GetGauge().GetValue(), ts, d.ttl, mf.GetHelp())
+			case dto.MetricType_COUNTER:
+				if debugging {
+					log.Println("  Metric Value: ", m.GetCounter().GetValue())
+				}
+				fullname, metric = c.CreateMetric(name, labels, prometheus.CounterValue, m.GetCounter().GetValue(), ts, d.ttl, mf.GetHelp())
+			case dto.MetricType_UNTYPED:
+				if debugging {
+					log.Println("  Metric Value: ", m.GetUntyped().GetValue())
+				}
+				fullname, metric = c.CreateMetric(name, labels, prometheus.UntypedValue, m.GetUntyped().GetValue(), ts, d.ttl, mf.GetHelp())
+			case dto.MetricType_HISTOGRAM:
+				count, sum, buckets := histogramValues(m.GetHistogram())
+				if debugging {
+					log.Println("  Count: ", count, " Sum: ", sum, " Buckets: ", buckets)
+				}
+				fullname, metric = c.CreateHistogram(name, labels, count, sum, buckets, ts, d.ttl, mf.GetHelp())
+			case dto.MetricType_SUMMARY:
+				count, sum, quantiles := summaryValues(m.GetSummary())
+				if debugging {
+					log.Println("  Count: ", count, " Sum: ", sum, " Quantiles: ", quantiles)
+				}
+				fullname, metric = c.CreateSummary(name, labels, count, sum, quantiles, ts, d.ttl, mf.GetHelp())
+			}
+			metric.ScanTimestamp = scanTimestamp
+			if !scanTimestamp {
+				metric.SampleTimestamp = ts
+			}
+			metric.Retain = d.retain
+			metric.Owner = d.owner
+			metric.Unit = result.Units[name]
+			if result.OpenMetrics {
+				addOpenMetricsData(&metric, m, source)
+			}
+			newMetrics[fullname] = metric
+
+			if debugging {
+				log.Println("-----------")
+			}
+		}
+	}
+	return newMetrics, dropped
+}
+
+// histogramValues extracts the sample count, sum and cumulative bucket counts
+// of a parsed histogram. The +Inf bucket is left out since it is implied by
+// the count; it is only used when the file has no _count line.
+func histogramValues(h *dto.Histogram) (uint64, float64, map[float64]uint64) {
+	count := h.GetSampleCount()
+	buckets := make(map[float64]uint64, len(h.GetBucket()))
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			if h.SampleCount == nil {
+				count = b.GetCumulativeCount()
+			}
+			continue
+		}
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return count, h.GetSampleSum(), buckets
+}
+
+// summaryValues extracts the sample count, sum and quantiles of a parsed
+// summary.
+func summaryValues(sm *dto.Summary) (uint64, float64, map[float64]float64) {
+	quantiles := make(map[float64]float64, len(sm.GetQuantile()))
+	for _, q := range sm.GetQuantile() {
+		quantiles[q.GetQuantile()] = q.GetValue()
+	}
+	return sm.GetSampleCount(), sm.GetSampleSum(), quantiles
+}
+
+// addOpenMetricsData attaches the created timestamp and exemplars of a parsed
+// OpenMetrics sample to metric.
+func addOpenMetricsData(metric *StoredMetric, m *dto.Metric, source string) {
+	var created *timestamppb.Timestamp
+	var exemplars []*dto.Exemplar
+	switch {
+	case m.Counter != nil:
+		created = m.Counter.GetCreatedTimestamp()
+		if e := m.Counter.GetExemplar(); e != nil {
+			exemplars = append(exemplars, e)
+		}
+	case m.Histogram != nil:
+		created = m.Histogram.GetCreatedTimestamp()
+		for _, b := range m.Histogram.GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				exemplars = append(exemplars, e)
+			}
+		}
+	case m.Summary != nil:
+		created = m.Summary.GetCreatedTimestamp()
+	}
+
+	if created != nil {
+		metric.SetCreatedTimestamp(created.AsTime())
+	}
+	if len(exemplars) == 0 {
+		return
+	}
+	promExemplars := make([]prometheus.Exemplar, 0, len(exemplars))
+	for _, e := range exemplars {
+		labels := make(prometheus.Labels, len(e.GetLabel()))
+		for _, l := range e.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		var ts time.Time
+		if e.Timestamp != nil {
+			ts = e.GetTimestamp().AsTime()
+		}
+		promExemplars = append(promExemplars, prometheus.Exemplar{Value: e.GetValue(), Labels: labels, Timestamp: ts})
+	}
+	if err := metric.AddExemplars(promExemplars...); err != nil {
+		log.Printf("Ignoring invalid exemplars from %s: %v\n", source, err)
+	}
+}
@@ -0,0 +1,194 @@
+package collector
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/parser"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// store parses data, converts it with FromResult and stores it as source.
+func store(t *testing.T, c *TimeAwareCollector, source, data string) map[string]StoredMetric {
+	t.Helper()
+	result, err := parser.ParseData([]byte(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, dropped := c.FromResult(result, source, 0, false)
+	if len(dropped) > 0 {
+		t.Fatalf("FromResult dropped %v", dropped)
+	}
+	for k, metric := range metrics {
+		metric.Source = source
+		metrics[k] = metric
+	}
+	if err := c.UpdateSource(source, metrics, UpdateReplace); err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func TestFromResultHistogram(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "f", `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="0.1"} 3 1700000000000
+latency_seconds_bucket{path="/",le="1"} 5 1700000000000
+latency_seconds_bucket{path="/",le="+Inf"} 6 1700000000000
+latency_seconds_sum{path="/"} 4.5 1700000000000
+latency_seconds_count{path="/"} 6 1700000000000
+`)
+	m, ok := gather(t, c)[`latency_seconds{path="/"}`]
+	if !ok {
+		t.Fatal("histogram is missing")
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 6 || h.GetSampleSum() != 4.5 {
+		t.Errorf("count, sum = %d, %v, want 6, 4.5", h.GetSampleCount(), h.GetSampleSum())
+	}
+	want := map[float64]uint64{0.1: 3, 1: 5}
+	if len(h.GetBucket()) != len(want) {
+		t.Errorf("buckets = %v, want %v", h.GetBucket(), want)
+	}
+	for _, b := range h.GetBucket() {
+		if want[b.GetUpperBound()] != b.GetCumulativeCount() {
+			t.Errorf("bucket %v = %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want[b.GetUpperBound()])
+		}
+	}
+	if got := m.GetTimestampMs(); got != 1700000000000 {
+		t.Errorf("timestamp = %d, want 1700000000000", got)
+	}
+}
+
+func TestFromResultHistogramWithoutCount(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "f", `# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 4
+h_sum 2
+`)
+	if got := gather(t, c)["h{}"].GetHistogram().GetSampleCount(); got != 4 {
+		t.Errorf("count = %d, want the +Inf bucket, 4", got)
+	}
+}
+
+func TestFromResultSummary(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "f", `# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.2
+rpc_seconds{quantile="0.99"} 1.5
+rpc_seconds_sum 12
+rpc_seconds_count 40
+`)
+	s := gather(t, c)["rpc_seconds{}"].GetSummary()
+	if s.GetSampleCount() != 40 || s.GetSampleSum() != 12 {
+		t.Errorf("count, sum = %d, %v, want 40, 12", s.GetSampleCount(), s.GetSampleSum())
+	}
+	want := map[float64]float64{0.5: 0.2, 0.99: 1.5}
+	if len(s.GetQuantile()) != len(want) {
+		t.Errorf("quantiles = %v, want %v", s.GetQuantile(), want)
+	}
+	for _, q := range s.GetQuantile() {
+		if want[q.GetQuantile()] != q.GetValue() {
+			t.Errorf("quantile %v = %v, want %v", q.GetQuantile(), q.GetValue(), want[q.GetQuantile()])
+		}
+	}
+}
+
+func TestFromResultDropsUnsupportedTypes(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	result := &parser.Result{Families: map[string]*dto.MetricFamily{
+		"gh": {
+			Name: proto.String("gh"),
+			Type: dto.MetricType_GAUGE_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(1),
+				Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(1)}},
+			}}},
+		},
+		"g": {
+			Name:   proto.String("g"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+	}}
+	metrics, dropped := c.FromResult(result, "f", 0, false)
+	if len(metrics) != 1 {
+		t.Errorf("FromResult returned %d metrics, want 1", len(metrics))
+	}
+	if typ, ok := dropped["gh"]; !ok || typ != dto.MetricType_GAUGE_HISTOGRAM || len(dropped) != 1 {
+		t.Errorf("dropped = %v, want gh", dropped)
+	}
+}
+
+func TestFromResultTTLDirective(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	metrics := store(t, c, "f", `# TFE ttl=26h
+# TFE metric=job_seconds ttl=5m
+last_success 1
+job_seconds{step="a"} 2
+job_seconds{step="b",__tfe_ttl="90s"} 3
+`)
+	want := map[string]time.Duration{
+		`last_success{}`:        26 * time.Hour,
+		`job_seconds{step="a"}`: 5 * time.Minute,
+		`job_seconds{step="b"}`: 90 * time.Second,
+	}
+	got := make(map[string]time.Duration)
+	for _, metric := range metrics {
+		var pb dto.Metric
+		if err := (*metric.PromMetric).Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		got[seriesName(metric.name, &pb)] = metric.ExpirationTime.Sub(metric.InsertionTime)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TTLs = %v, want %v", got, want)
+	}
+	// The directive labels are not exported.
+	for name := range gather(t, c) {
+		if strings.Contains(name, parser.DirectiveLabelPrefix) {
+			t.Errorf("series %s exported with a directive label", name)
+		}
+	}
+
+	// Without directives, series expire after the default expiration.
+	for _, metric := range store(t, c, "g", "plain 1\n") {
+		if got := metric.ExpirationTime.Sub(metric.InsertionTime); got != time.Hour {
+			t.Errorf("TTL without directive = %v, want the default 1h", got)
+		}
+	}
+}
+
+func TestFromResultSeriesDirectives(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "f", `# TFE metric=kept retain=true owner=backup
+# TFE metric=rewritten honor_timestamps=false
+kept 1
+honored 1 1700000000000
+rewritten 1 1700000000000
+other{__tfe_owner="storage"} 1
+`)
+	series := gather(t, c)
+	if got := series["honored{}"].GetTimestampMs(); got != 1700000000000 {
+		t.Errorf("timestamp of honored = %d, want the one of the file", got)
+	}
+	if got := series["rewritten{}"].GetTimestampMs(); got == 1700000000000 {
+		t.Error("timestamp of rewritten is the one of the file, want the scan time")
+	}
+	if got, want := c.SeriesByOwner(), map[string]int{"backup": 1, "storage": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SeriesByOwner() = %v, want %v", got, want)
+	}
+
+	// Retained series outlive their source until they expire.
+	c.RemoveSource("f", UpdateReplace)
+	if got, want := seriesNames(t, c), []string{"kept{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series after removing the source = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,254 @@
+package collector
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// MetadataPolicy controls which help text a metric family is exported with
+// when its sources disagree.
+type MetadataPolicy string
+
+const (
+	// MetadataFirst keeps the help text of the first source that gave one.
+	MetadataFirst MetadataPolicy = "first"
+	// MetadataLongest keeps the longest help text.
+	MetadataLongest MetadataPolicy = "longest"
+)
+
+// MetadataOverride is the help text and type configured for a metric family,
+// which win over those of its sources. Type is a type name in lower case,
+// such as "gauge". Empty fields are not overridden.
+type MetadataOverride struct {
+	Help string
+	Type string
+}
+
+// family is the entry of a metric family in the family registry.
+type family struct {
+	// sources holds the metadata of the family in each source that defines
+	// it, by source.
+	sources map[string]*familySource
+}
+
+// familySource is the metadata of a metric family in one of its sources.
+type familySource struct {
+	// seq orders the sources by the time they first defined the family.
+	seq  uint64
+	help string
+	typ  dto.MetricType
+}
+
+// familyMetadata is the help text and type a metric family is exported with.
+type familyMetadata struct {
+	help string
+	typ  dto.MetricType
+	// retype is true when typ comes from an override, so that the series of
+	// another type are converted to it when they can be.
+	retype bool
+}
+
+// withholds reports whether the series of type typ of a family exported
+// with md are left out. Only gauges, counters and untyped series can be
+// converted, by moving their value, and only to a type set by an override.
+func (md familyMetadata) withholds(typ dto.MetricType) bool {
+	if typ == md.typ {
+		return false
+	}
+	return !md.retype || !isScalar(typ) || !isScalar(md.typ)
+}
+
+// isScalar reports whether a series of type typ has a single value.
+func isScalar(typ dto.MetricType) bool {
+	return typ == dto.MetricType_GAUGE || typ == dto.MetricType_COUNTER || typ == dto.MetricType_UNTYPED
+}
+
+// SetMetadataPolicy sets the policy that reconciles the help texts of a
+// metric family across sources, and the metadata configured for some
+// families, by name.
+func (c *TimeAwareCollector) SetMetadataPolicy(policy MetadataPolicy, overrides map[string]MetadataOverride) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	c.metadataPolicy = policy
+	c.metadataOverrides = overrides
+}
+
+// registerFamilyLocked records the metadata of the family of metric in its
+// source. The caller must hold metricsMutex.
+func (c *TimeAwareCollector) registerFamilyLocked(metric StoredMetric) {
+	f, ok := c.families[metric.name]
+	if !ok {
+		f = &family{sources: make(map[string]*familySource)}
+		c.families[metric.name] = f
+	}
+	src, ok := f.sources[metric.Source]
+	if !ok {
+		c.familySeq++
+		src = &familySource{seq: c.familySeq}
+		f.sources[metric.Source] = src
+	}
+	src.help = metric.help
+	src.typ = metric.typ
+}
+
+// reconcileLocked updates the family registry with the metrics about to be
+// collected and the versions of the conflicting series, whether they are
+// exported or not, so that a family keeps the metadata of its first source
+// whichever version wins. It returns the metadata of the families whose
+// metrics must be changed because they disagree or have overrides. Families
+// not in the result are exported as they are. The caller must hold
+// metricsMutex.
+func (c *TimeAwareCollector) reconcileLocked(metrics map[string]StoredMetric) map[string]familyMetadata {
+	present := make(map[string]map[string]bool)
+	first := make(map[string]familyMetadata)
+	fix := make(map[string]bool)
+	for name := range c.metadataOverrides {
+		fix[name] = true
+	}
+	all := make([]StoredMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		all = append(all, metric)
+	}
+	for _, cf := range c.conflicts {
+		for _, metric := range cf.candidates {
+			all = append(all, metric)
+		}
+	}
+	for _, metric := range all {
+		sources, ok := present[metric.name]
+		if !ok {
+			sources = make(map[string]bool)
+			present[metric.name] = sources
+		}
+		if !sources[metric.Source] {
+			sources[metric.Source] = true
+			if f, ok := c.families[metric.name]; !ok || f.sources[metric.Source] == nil {
+				c.registerFamilyLocked(metric)
+			}
+		}
+		md := familyMetadata{help: metric.help, typ: metric.typ}
+		if seen, ok := first[metric.name]; !ok {
+			first[metric.name] = md
+		} else if seen != md {
+			fix[metric.name] = true
+		}
+	}
+
+	// Forget the sources that no longer define a family.
+	for name, f := range c.families {
+		for source := range f.sources {
+			if !present[name][source] {
+				delete(f.sources, source)
+			}
+		}
+		if len(f.sources) == 0 {
+			delete(c.families, name)
+		}
+	}
+
+	families := make(map[string]familyMetadata, len(fix))
+	for name := range fix {
+		if _, ok := present[name]; ok {
+			families[name] = c.familyMetadataLocked(name)
+		}
+	}
+	return families
+}
+
+// familyMetadataLocked returns the help text and type the family name is
+// exported with: those of its override if any, otherwise the help text chosen
+// by the metadata policy and the type of the first source that declared one.
+// The caller must hold metricsMutex.
+func (c *TimeAwareCollector) familyMetadataLocked(name string) familyMetadata {
+	var sources []*familySource
+	if f, ok := c.families[name]; ok {
+		for _, src := range f.sources {
+			sources = append(sources, src)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].seq < sources[j].seq })
+
+	md := familyMetadata{typ: dto.MetricType_UNTYPED}
+	typed := false
+	for _, src := range sources {
+		if !typed && src.typ != dto.MetricType_UNTYPED {
+			md.typ = src.typ
+			typed = true
+		}
+		if c.metadataPolicy == MetadataLongest {
+			if len(src.help) > len(md.help) {
+				md.help = src.help
+			}
+		} else if md.help == "" {
+			md.help = src.help
+		}
+	}
+	if o, ok := c.metadataOverrides[name]; ok {
+		if o.Help != "" {
+			md.help = o.Help
+		}
+		if typ, ok := dto.MetricType_value[strings.ToUpper(o.Type)]; ok {
+			md.typ = dto.MetricType(typ)
+			md.retype = true
+		}
+	}
+	return md
+}
+
+// helpMetric exposes the wrapped metric with the help text of desc. Only the
+// name and help text of desc are used by the registry.
+type helpMetric struct {
+	prometheus.Metric
+	desc *prometheus.Desc
+}
+
+func (m helpMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// retypedMetric exposes the value of the wrapped gauge, counter or untyped
+// metric as a metric of type typ, one of those three.
+type retypedMetric struct {
+	prometheus.Metric
+	typ dto.MetricType
+}
+
+func (m retypedMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	v := pb.GetGauge().GetValue() + pb.GetCounter().GetValue() + pb.GetUntyped().GetValue()
+	pb.Gauge, pb.Counter, pb.Untyped = nil, nil, nil
+	switch m.typ {
+	case dto.MetricType_GAUGE:
+		pb.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+	case dto.MetricType_COUNTER:
+		pb.Counter = &dto.Counter{Value: proto.Float64(v)}
+	default:
+		pb.Untyped = &dto.Untyped{Value: proto.Float64(v)}
+	}
+	return nil
+}
+
+// reportWithheld logs the families whose number of series withheld because
+// of their type changed since the last collection.
+func (c *TimeAwareCollector) reportWithheld(withheld map[string]int) {
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	for name, n := range withheld {
+		if c.withheld[name] != n {
+			log.Printf("Withholding %d series of %s whose type differs from the type %s is exported with\n", n, name, name)
+		}
+	}
+	for name := range c.withheld {
+		if _, ok := withheld[name]; !ok {
+			log.Printf("No series of %s withheld anymore\n", name)
+		}
+	}
+	c.withheld = withheld
+}
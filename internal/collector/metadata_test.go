@@ -0,0 +1,123 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherFamily returns the family name gathered from c, or nil.
+func gatherFamily(t *testing.T, c *TimeAwareCollector, name string) *dto.MetricFamily {
+	t.Helper()
+	for _, mf := range gatherFamilies(t, c) {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+func TestMetadataPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy MetadataPolicy
+		want   string
+	}{
+		{MetadataFirst, "Short."},
+		{MetadataLongest, "A longer help text."},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.SetMetadataPolicy(tt.policy, nil)
+			store(t, c, "a.prom", "# HELP m Short.\nm{x=\"a\"} 1\n")
+			store(t, c, "b.prom", "# HELP m A longer help text.\nm{x=\"b\"} 1\n")
+			store(t, c, "c.prom", "m{x=\"c\"} 1\n")
+			mf := gatherFamily(t, c, "m")
+			if mf.GetHelp() != tt.want || len(mf.Metric) != 3 {
+				t.Errorf("m exported with help %q and %d series, want %q and 3", mf.GetHelp(), len(mf.Metric), tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataFirstIgnoresConflictWinner(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictNewestFile, ConflictReject} {
+		t.Run(string(policy), func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.SetConflictPolicy(policy)
+			store(t, c, "a.prom", "# HELP m From a.\nm 1\n")
+			gatherFamilies(t, c)
+			// b.prom wins or blocks the conflict on m, and c.prom defines
+			// another series of the family.
+			store(t, c, "b.prom", "# HELP m From b.\nm 2\n")
+			store(t, c, "c.prom", "# HELP m From c.\nm{x=\"c\"} 3\n")
+			for i := 0; i < 2; i++ {
+				if got := gatherFamily(t, c, "m").GetHelp(); got != "From a." {
+					t.Errorf("collection %d: help of m = %q, want that of the first file", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataTypeConflict(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "a.prom", "# TYPE m gauge\nm{x=\"a\"} 1\n")
+	store(t, c, "b.prom", "# TYPE m counter\nm{x=\"b\"} 2\n")
+	mf := gatherFamily(t, c, "m")
+	if mf.GetType() != dto.MetricType_GAUGE || len(mf.Metric) != 1 {
+		t.Errorf("m exported as %s with %d series, want the gauge of a.prom only", mf.GetType(), len(mf.Metric))
+	}
+
+	conflicts := c.MetadataConflicts()
+	if len(conflicts) != 1 {
+		t.Fatalf("MetadataConflicts() = %+v, want m", conflicts)
+	}
+	got := conflicts[0]
+	want := MetadataConflict{
+		Metric:         "m",
+		Help:           "",
+		Type:           "gauge",
+		WithheldSeries: 1,
+		Sources: []FamilyMetadata{
+			{Source: "a.prom", Type: "gauge"},
+			{Source: "b.prom", Type: "counter"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MetadataConflicts() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMetadataOverrides(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.SetMetadataPolicy(MetadataFirst, map[string]MetadataOverride{
+		"jobs":    {Help: "Jobs run.", Type: "counter"},
+		"latency": {Type: "gauge"},
+	})
+	store(t, c, "a.prom", `# HELP jobs From the file.
+# TYPE jobs gauge
+jobs 5
+# TYPE latency histogram
+latency_bucket{le="+Inf"} 1
+latency_sum 0.5
+latency_count 1
+`)
+
+	// Scalar series are converted to the type of the override.
+	mf := gatherFamily(t, c, "jobs")
+	if mf.GetHelp() != "Jobs run." || mf.GetType() != dto.MetricType_COUNTER || len(mf.Metric) != 1 || mf.Metric[0].GetCounter().GetValue() != 5 {
+		t.Errorf("jobs = %v, want a counter of value 5 with the help of the override", mf)
+	}
+
+	// A histogram cannot be, so it is withheld and reported even though
+	// the files agree.
+	if mf := gatherFamily(t, c, "latency"); mf != nil {
+		t.Errorf("latency exported as %s, want it withheld", mf.GetType())
+	}
+	conflicts := c.MetadataConflicts()
+	if len(conflicts) != 1 || conflicts[0].Metric != "latency" || conflicts[0].Type != "gauge" || conflicts[0].WithheldSeries != 1 {
+		t.Errorf("MetadataConflicts() = %+v, want latency with 1 withheld series", conflicts)
+	}
+}
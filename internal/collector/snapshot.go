@@ -0,0 +1,300 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// SaveSnapshot. Snapshots of another version are not restored.
+const snapshotVersion = 1
+
+// snapshotHeader is the first line of a snapshot.
+type snapshotHeader struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// snapshotSeries is a line of a snapshot after the header: one stored series
+// with its lifecycle. Metric holds the labels and values of the series, in the
+// JSON form of its protobuf message.
+type snapshotSeries struct {
+	Name          string          `json:"name"`
+	Help          string          `json:"help,omitempty"`
+	Unit          string          `json:"unit,omitempty"`
+	Type          string          `json:"type"`
+	Source        string          `json:"source"`
+	SourceTime    time.Time       `json:"source_time"`
+	Metric        json.RawMessage `json:"metric"`
+	InsertionTime time.Time       `json:"insertion_time"`
+	Expiration    time.Time       `json:"expiration_time"`
+	Timestamp     time.Time       `json:"timestamp"`
+	ScanTimestamp bool            `json:"scan_timestamp,omitempty"`
+	Retain        bool            `json:"retain,omitempty"`
+	Owner         string          `json:"owner,omitempty"`
+}
+
+// SaveSnapshot writes the series that have not expired yet to path, with their
+// insertion and expiration times, and returns their number. Every version of a
+// series defined by several sources is written, so that the conflict is
+// resolved again on restore. The snapshot is written to a temporary file in
+// the same directory, synced and renamed over path, so that path always holds
+// a complete snapshot.
+func (c *TimeAwareCollector) SaveSnapshot(path string) (int, error) {
+	now := time.Now()
+	c.metricsMutex.Lock()
+	metrics := make([]StoredMetric, 0, len(c.metrics))
+	conflicting := make(map[string]bool)
+	for _, cf := range c.conflicts {
+		for _, e := range cf.exported {
+			conflicting[e] = true
+		}
+		for _, metric := range cf.candidates {
+			if !now.After(metric.ExpirationTime) {
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	for k, metric := range c.metrics {
+		if !conflicting[k] && !now.After(metric.ExpirationTime) {
+			metrics = append(metrics, metric)
+		}
+	}
+	c.metricsMutex.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, Time: now.UTC()}); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	for _, metric := range metrics {
+		series, err := newSnapshotSeries(metric)
+		if err != nil {
+			tmp.Close()
+			return 0, fmt.Errorf("series %s of %s: %w", metric.name, metric.Source, err)
+		}
+		if err := enc.Encode(series); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	// Sync the directory too, so that the rename survives a crash.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return len(metrics), nil
+}
+
+// newSnapshotSeries converts a stored metric into a snapshot line.
+func newSnapshotSeries(metric StoredMetric) (snapshotSeries, error) {
+	var pb dto.Metric
+	if err := (*metric.PromMetric).Write(&pb); err != nil {
+		return snapshotSeries{}, err
+	}
+	data, err := protojson.Marshal(&pb)
+	if err != nil {
+		return snapshotSeries{}, err
+	}
+	return snapshotSeries{
+		Name:          metric.name,
+		Help:          metric.help,
+		Unit:          metric.Unit,
+		Type:          metric.typ.String(),
+		Source:        metric.Source,
+		SourceTime:    metric.SourceTime,
+		Metric:        data,
+		InsertionTime: metric.InsertionTime,
+		Expiration:    metric.ExpirationTime,
+		Timestamp:     metric.Timestamp,
+		ScanTimestamp: metric.ScanTimestamp,
+		Retain:        metric.Retain,
+		Owner:         metric.Owner,
+	}, nil
+}
+
+// LoadSnapshot restores the series saved by SaveSnapshot at path, with their
+// original insertion and expiration times. It returns the number of series
+// restored, of series that expired since the snapshot was taken and of
+// invalid lines, which are both skipped. Restored series are stored like any
+// other: series defined by several sources go through the conflict policy,
+// and those beyond the series limit are dropped. Series already stored for
+// the same source are kept over those of the snapshot, and the current
+// external labels apply to the restored series. If path does not exist, the
+// error wraps os.ErrNotExist.
+func (c *TimeAwareCollector) LoadSnapshot(path string) (restored, expired, invalid int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return 0, 0, 0, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	type restoredSeries struct {
+		key    string
+		metric StoredMetric
+	}
+	now := time.Now()
+	var newMetrics []restoredSeries
+	for n := 2; err != io.EOF; n++ {
+		line, err = r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, 0, 0, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var series snapshotSeries
+		if jsonErr := json.Unmarshal(line, &series); jsonErr != nil {
+			log.Printf("Skipping invalid line %d of snapshot %s: %v\n", n, path, jsonErr)
+			invalid++
+			continue
+		}
+		if now.After(series.Expiration) {
+			expired++
+			continue
+		}
+		key, metric, restoreErr := c.restoreSeries(series)
+		if restoreErr != nil {
+			log.Printf("Skipping line %d of snapshot %s, series %s of %s: %v\n", n, path, series.Name, series.Source, restoreErr)
+			invalid++
+			continue
+		}
+		newMetrics = append(newMetrics, restoredSeries{key, metric})
+	}
+
+	c.metricsMutex.Lock()
+	defer c.metricsMutex.Unlock()
+	limited := 0
+	for _, series := range newMetrics {
+		k, metric := series.key, series.metric
+		if c.storedLocked(k, metric.Source) {
+			continue
+		}
+		_, stored := c.metrics[k]
+		_, conflicting := c.conflicts[k]
+		if !stored && !conflicting && c.maxSeries > 0 && len(c.metrics) >= c.maxSeries {
+			limited++
+			continue
+		}
+		c.storeLocked(metric.Source, k, metric)
+		restored++
+	}
+	if limited > 0 {
+		log.Printf("Series limit of %d reached, %d series of snapshot %s not restored\n", c.maxSeries, limited, path)
+	}
+	return restored, expired, invalid, nil
+}
+
+// storedLocked reports whether source already defines the series k. The caller
+// must hold metricsMutex.
+func (c *TimeAwareCollector) storedLocked(k, source string) bool {
+	if cf, ok := c.conflicts[k]; ok {
+		_, ok := cf.candidates[source]
+		return ok
+	}
+	metric, ok := c.metrics[k]
+	return ok && metric.Source == source
+}
+
+// restoreSeries rebuilds a stored metric from a snapshot line.
+func (c *TimeAwareCollector) restoreSeries(series snapshotSeries) (string, StoredMetric, error) {
+	var pb dto.Metric
+	if err := protojson.Unmarshal(series.Metric, &pb); err != nil {
+		return "", StoredMetric{}, err
+	}
+	labels := make(map[string]string, len(pb.GetLabel()))
+	for _, label := range pb.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	typ, ok := dto.MetricType_value[series.Type]
+	if !ok {
+		return "", StoredMetric{}, fmt.Errorf("unsupported type %q", series.Type)
+	}
+	fullname, desc, labelValues := c.newDesc(series.Name, series.Help, labels)
+	promMetric, err := newConstMetric(desc, dto.MetricType(typ), &pb, labelValues)
+	if err != nil {
+		return "", StoredMetric{}, err
+	}
+
+	metric := StoredMetric{
+		InsertionTime:  series.InsertionTime,
+		PromMetric:     &promMetric,
+		ExpirationTime: series.Expiration,
+		Timestamp:      series.Timestamp,
+		ScanTimestamp:  series.ScanTimestamp,
+		Retain:         series.Retain,
+		Owner:          series.Owner,
+		Source:         series.Source,
+		SourceTime:     series.SourceTime,
+		Unit:           series.Unit,
+		name:           series.Name,
+		help:           series.Help,
+		typ:            dto.MetricType(typ),
+	}
+	addOpenMetricsData(&metric, &pb, series.Source)
+	return fullname, metric, nil
+}
+
+// newConstMetric builds a metric of the given type with the values of pb.
+func newConstMetric(desc *prometheus.Desc, typ dto.MetricType, pb *dto.Metric, labelValues []string) (prometheus.Metric, error) {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, pb.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, pb.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_UNTYPED:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, pb.GetUntyped().GetValue(), labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		count, sum, buckets := histogramValues(pb.GetHistogram())
+		return prometheus.NewConstHistogram(desc, count, sum, buckets, labelValues...)
+	case dto.MetricType_SUMMARY:
+		count, sum, quantiles := summaryValues(pb.GetSummary())
+		return prometheus.NewConstSummary(desc, count, sum, quantiles, labelValues...)
+	}
+	return nil, fmt.Errorf("unsupported type %s", typ)
+}
@@ -0,0 +1,202 @@
+package collector
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// saveSnapshot saves c to a snapshot file and returns its path.
+func saveSnapshot(t *testing.T, c *TimeAwareCollector) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	if _, err := c.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "a.prom", `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{code="200"} 10
+requests_total{code="500"} 2
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 3
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 1.5
+latency_seconds_count 5
+`)
+	store(t, c, "b.prom", "# TYPE up gauge\nup 1 1700000000000\n")
+	if err := c.UpdateSource("c.prom", gauges(c, "c.prom", 3, time.Hour, "kept"), UpdateRetain); err != nil {
+		t.Fatal(err)
+	}
+	path := saveSnapshot(t, c)
+
+	restored := NewTimeAwareCollector(time.Hour)
+	n, expired, invalid, err := restored.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || expired != 0 || invalid != 0 {
+		t.Errorf("LoadSnapshot() = %d restored, %d expired, %d invalid, want 5, 0, 0", n, expired, invalid)
+	}
+	got, want := gatherFamilies(t, restored), gatherFamilies(t, c)
+	if len(got) != len(want) {
+		t.Fatalf("restored %d families, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("restored family %v, want %v", got[i], want[i])
+		}
+	}
+	if got, want := restored.Sources(), c.Sources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored sources %v, want %v", got, want)
+	}
+
+	// Retained series are still retained once restored.
+	restored.RemoveSource("c.prom", UpdateRetain)
+	if _, ok := gather(t, restored)["kept{}"]; !ok {
+		t.Error("retained series removed with its source after a restore")
+	}
+}
+
+func TestSnapshotConflicts(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictReject, ConflictFileLabel} {
+		t.Run(string(policy), func(t *testing.T) {
+			c := NewTimeAwareCollector(time.Hour)
+			c.SetConflictPolicy(policy)
+			store(t, c, "a.prom", "m 1\n")
+			store(t, c, "b.prom", "m 2\n")
+			path := saveSnapshot(t, c)
+
+			restored := NewTimeAwareCollector(time.Hour)
+			restored.SetConflictPolicy(policy)
+			if n, _, _, err := restored.LoadSnapshot(path); err != nil || n != 2 {
+				t.Fatalf("LoadSnapshot() = %d, %v, want both versions restored", n, err)
+			}
+			if got, want := seriesNames(t, restored), seriesNames(t, c); !reflect.DeepEqual(got, want) {
+				t.Errorf("series = %v, want %v", got, want)
+			}
+			if got := restored.SeriesConflicts(); len(got) != 1 || len(got[0].Sources) != 2 {
+				t.Errorf("SeriesConflicts() = %+v, want m defined by both sources", got)
+			}
+
+			// The conflict ends like any other once a source drops the series.
+			restored.RemoveSource("a.prom", UpdateReplace)
+			if got, want := seriesNames(t, restored), []string{"m{}"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("series after removing a source = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSnapshotKeepsStoredSeries(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "a.prom", "m 1\n")
+	store(t, c, "b.prom", "n 1\n")
+	path := saveSnapshot(t, c)
+
+	restored := NewTimeAwareCollector(time.Hour)
+	store(t, restored, "a.prom", "m 2\n")
+	if n, _, _, err := restored.LoadSnapshot(path); err != nil || n != 1 {
+		t.Fatalf("LoadSnapshot() = %d, %v, want only n restored", n, err)
+	}
+	series := gather(t, restored)
+	if got := value(series["m{}"]); got != 2 {
+		t.Errorf("m = %v, want the stored value 2", got)
+	}
+	if _, ok := series["n{}"]; !ok {
+		t.Error("n not restored")
+	}
+}
+
+func TestSnapshotSeriesLimit(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "a.prom", "a 1\nb 1\nc 1\n")
+	path := saveSnapshot(t, c)
+
+	restored := NewTimeAwareCollector(time.Hour)
+	restored.SetMaxSeries(2)
+	if n, _, _, err := restored.LoadSnapshot(path); err != nil || n != 2 {
+		t.Errorf("LoadSnapshot() = %d, %v, want 2 series restored", n, err)
+	}
+	if got := len(gather(t, restored)); got != 2 {
+		t.Errorf("%d series restored, want the limit of 2", got)
+	}
+}
+
+func TestSnapshotSkipsInvalidLines(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	store(t, c, "a.prom", "a 1\nb 1\n")
+	path := saveSnapshot(t, c)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	var corrupted []byte
+	corrupted = append(corrupted, lines[0]...)
+	corrupted = append(corrupted, "{not json\n"...)
+	corrupted = append(corrupted, bytes.Replace(lines[1], []byte(`"type":"UNTYPED"`), []byte(`"type":"SPARKLINE"`), 1)...)
+	corrupted = append(corrupted, lines[2]...)
+	if err := os.WriteFile(path, corrupted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewTimeAwareCollector(time.Hour)
+	n, _, invalid, err := restored.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || invalid != 2 {
+		t.Errorf("LoadSnapshot() = %d restored, %d invalid, want 1, 2", n, invalid)
+	}
+}
+
+func TestSnapshotExpiredSeries(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	c.UpdateSource("a", gauges(c, "a", 1, 50*time.Millisecond, "short"), UpdateReplace)
+	c.UpdateSource("b", gauges(c, "b", 1, time.Hour, "long"), UpdateReplace)
+	path := saveSnapshot(t, c)
+	time.Sleep(100 * time.Millisecond)
+
+	restored := NewTimeAwareCollector(time.Hour)
+	n, expired, _, err := restored.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || expired != 1 {
+		t.Errorf("LoadSnapshot() = %d restored, %d expired, want 1, 1", n, expired)
+	}
+	if got, want := seriesNames(t, restored), []string{"long{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+	c := NewTimeAwareCollector(time.Hour)
+	if _, _, _, err := c.LoadSnapshot(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("LoadSnapshot() of a missing file = %v, want os.ErrNotExist", err)
+	}
+	for name, content := range map[string]string{
+		"header":  "not json\n",
+		"version": `{"version":99}` + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := c.LoadSnapshot(path); err == nil {
+			t.Errorf("LoadSnapshot() with an invalid %s succeeded", name)
+		}
+	}
+}
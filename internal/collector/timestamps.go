@@ -0,0 +1,83 @@
+package collector
+
+import "time"
+
+// TimestampPolicy controls what happens to the samples of a file or push that
+// have a timestamp.
+type TimestampPolicy string
+
+const (
+	// TimestampHonor exports the timestamps as they are.
+	TimestampHonor TimestampPolicy = "honor"
+	// TimestampDrop removes the timestamps: the samples are exported without
+	// one, so that the scraper stamps them.
+	TimestampDrop TimestampPolicy = "drop"
+	// TimestampMtime replaces the timestamps with the modification time of
+	// the file, or the time of the push.
+	TimestampMtime TimestampPolicy = "mtime"
+	// TimestampClamp moves the timestamps older than the maximum age or
+	// further than the maximum future in the future to the nearest bound.
+	TimestampClamp TimestampPolicy = "clamp"
+	// TimestampReject drops the samples whose timestamp is older than the
+	// maximum age or further than the maximum future in the future.
+	TimestampReject TimestampPolicy = "reject"
+)
+
+// Outcomes of a TimestampPolicy, as counted by ApplyTimestampPolicy.
+const (
+	TimestampHonored  = "honored"
+	TimestampDropped  = "dropped"
+	TimestampReplaced = "mtime"
+	TimestampClamped  = "clamped"
+	TimestampRejected = "rejected"
+)
+
+// ApplyTimestampPolicy applies policy to the metrics that have a sample
+// timestamp, and returns the number of metrics of each outcome. The rejected
+// metrics are removed from metrics. The policy starts from SampleTimestamp, so
+// it can be applied again to the same metrics at every scan. mtime is the
+// modification time of their source. The window of clamp and reject is
+// relative to now: a zero maxAge or maxFuture means no limit on that side.
+func ApplyTimestampPolicy(metrics map[string]StoredMetric, policy TimestampPolicy, maxAge, maxFuture time.Duration, mtime time.Time) map[string]int {
+	now := time.Now()
+	oldest := now.Add(-maxAge)
+	newest := now.Add(maxFuture)
+	outcomes := make(map[string]int)
+	for k, metric := range metrics {
+		ts := metric.SampleTimestamp
+		if ts.IsZero() {
+			continue
+		}
+		switch policy {
+		case TimestampDrop:
+			metric.Timestamp = time.Time{}
+			outcomes[TimestampDropped]++
+		case TimestampMtime:
+			metric.Timestamp = mtime
+			outcomes[TimestampReplaced]++
+		case TimestampClamp, TimestampReject:
+			bound := ts
+			if maxAge > 0 && ts.Before(oldest) {
+				bound = oldest
+			} else if maxFuture > 0 && ts.After(newest) {
+				bound = newest
+			}
+			if bound.Equal(ts) {
+				metric.Timestamp = ts
+				outcomes[TimestampHonored]++
+			} else if policy == TimestampReject {
+				delete(metrics, k)
+				outcomes[TimestampRejected]++
+				continue
+			} else {
+				metric.Timestamp = bound.Truncate(time.Millisecond)
+				outcomes[TimestampClamped]++
+			}
+		default:
+			metric.Timestamp = ts
+			outcomes[TimestampHonored]++
+		}
+		metrics[k] = metric
+	}
+	return outcomes
+}
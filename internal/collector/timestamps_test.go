@@ -0,0 +1,142 @@
+package collector
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/parser"
+)
+
+func TestApplyTimestampPolicy(t *testing.T) {
+	now := time.Now()
+	mtime := now.Add(-time.Minute).Truncate(time.Millisecond)
+	ms := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).UnixMilli(), 10) }
+	data := "recent 1 " + ms(-time.Minute) + "\nold 1 " + ms(-48*time.Hour) + "\nfuture 1 " + ms(time.Hour) + "\nplain 1\n"
+
+	tests := []struct {
+		policy TimestampPolicy
+		// want are the timestamps of the series after the policy, relative
+		// to now, or the mtime when mtime is true. nil means no timestamp,
+		// except for plain which is stamped at scan time, and a series left
+		// out was rejected.
+		want     map[string]*time.Duration
+		mtime    bool
+		outcomes map[string]int
+	}{
+		{
+			policy:   TimestampHonor,
+			want:     map[string]*time.Duration{"recent": dur(-time.Minute), "old": dur(-48 * time.Hour), "future": dur(time.Hour), "plain": nil},
+			outcomes: map[string]int{TimestampHonored: 3},
+		},
+		{
+			policy:   TimestampDrop,
+			want:     map[string]*time.Duration{"recent": nil, "old": nil, "future": nil, "plain": nil},
+			outcomes: map[string]int{TimestampDropped: 3},
+		},
+		{
+			policy:   TimestampMtime,
+			mtime:    true,
+			want:     map[string]*time.Duration{"recent": dur(0), "old": dur(0), "future": dur(0), "plain": nil},
+			outcomes: map[string]int{TimestampReplaced: 3},
+		},
+		{
+			policy:   TimestampClamp,
+			want:     map[string]*time.Duration{"recent": dur(-time.Minute), "old": dur(-time.Hour), "future": dur(10 * time.Minute), "plain": nil},
+			outcomes: map[string]int{TimestampHonored: 1, TimestampClamped: 2},
+		},
+		{
+			policy:   TimestampReject,
+			want:     map[string]*time.Duration{"recent": dur(-time.Minute), "plain": nil},
+			outcomes: map[string]int{TimestampHonored: 1, TimestampRejected: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			result, err := parser.ParseData([]byte(data), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := NewTimeAwareCollector(time.Hour)
+			metrics, _ := c.FromResult(result, "f", 0, false)
+			outcomes := ApplyTimestampPolicy(metrics, tt.policy, time.Hour, 10*time.Minute, mtime)
+			if !reflect.DeepEqual(outcomes, tt.outcomes) {
+				t.Errorf("outcomes = %v, want %v", outcomes, tt.outcomes)
+			}
+			if err := c.UpdateSource("f", metrics, UpdateReplace); err != nil {
+				t.Fatal(err)
+			}
+			series := gather(t, c)
+			if len(series) != len(tt.want) {
+				t.Errorf("%d series exported, want %d", len(series), len(tt.want))
+			}
+			for name, want := range tt.want {
+				m, ok := series[name+"{}"]
+				if !ok {
+					t.Errorf("%s missing", name)
+					continue
+				}
+				switch {
+				case name == "plain":
+					// Samples without timestamp are stamped at scan time.
+					if m.TimestampMs == nil {
+						t.Error("plain exported without timestamp, want the scan time")
+					}
+				case want == nil:
+					if m.TimestampMs != nil {
+						t.Errorf("%s exported with timestamp %d, want none", name, m.GetTimestampMs())
+					}
+				default:
+					ts := now.Add(*want)
+					if tt.mtime {
+						ts = mtime
+					}
+					if diff := m.GetTimestampMs() - ts.UnixMilli(); diff < -1000 || diff > 1000 {
+						t.Errorf("timestamp of %s is %s off", name, time.Duration(diff)*time.Millisecond)
+					}
+				}
+			}
+		})
+	}
+}
+
+// dur returns a pointer to d.
+func dur(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestDroppedTimestampNotRenewed(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	result, err := parser.ParseData([]byte("a 1 1700000000000\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := c.FromResult(result, "f", 0, false)
+	ApplyTimestampPolicy(metrics, TimestampDrop, 0, 0, time.Time{})
+	for _, metric := range metrics {
+		if metric = metric.Renew(time.Now()); metric.ScanTimestamp || !metric.Timestamp.IsZero() {
+			t.Errorf("metric stored with timestamp %v (scan time %v), want none", metric.Timestamp, metric.ScanTimestamp)
+		}
+	}
+}
+
+func TestApplyTimestampPolicyAgain(t *testing.T) {
+	c := NewTimeAwareCollector(time.Hour)
+	stamp := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	result, err := parser.ParseData([]byte("a 1 "+strconv.FormatInt(stamp.UnixMilli(), 10)+"\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := c.FromResult(result, "f", 0, false)
+
+	// A second application starts from the timestamp of the sample, not
+	// from the result of the first one.
+	ApplyTimestampPolicy(metrics, TimestampClamp, 30*time.Second, 0, time.Time{})
+	outcomes := ApplyTimestampPolicy(metrics, TimestampHonor, 0, 0, time.Time{})
+	for _, metric := range metrics {
+		if !metric.Timestamp.Equal(stamp) || outcomes[TimestampHonored] != 1 {
+			t.Errorf("timestamp = %v with outcomes %v, want %v honored", metric.Timestamp, outcomes, stamp)
+		}
+	}
+}
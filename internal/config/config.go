@@ -0,0 +1,497 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/relabel"
+	"textfile_exporter/internal/webconfig"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of the configuration file. Every setting also has a
+// command-line flag, which provides its default value.
+type Config struct {
+	Web       WebConfig       `yaml:"web"`
+	Push      PushConfig      `yaml:"push"`
+	Scanner   ScannerConfig   `yaml:"scanner"`
+	Collector CollectorConfig `yaml:"collector"`
+	Log       LogConfig       `yaml:"log"`
+	// Relabel holds the relabeling rules applied to the series of every
+	// directory and to pushed series, before those of each directory.
+	Relabel []relabel.Config `yaml:"relabel_configs"`
+	// Directories lists the scanned directories. It is read by Load, which
+	// fills the keys missing from each entry from Scanner.
+	Directories []DirectoryConfig `yaml:"-"`
+}
+
+// WebConfig holds the settings of the web server. TLS and basic
+// authentication are configured either inline, with the same keys as in the
+// web configuration file, or by pointing ConfigFile to such a file.
+type WebConfig struct {
+	ListenAddress             string `yaml:"listen_address"`
+	ConfigFile                string `yaml:"config_file"`
+	webconfig.WebConfig       `yaml:",inline"`
+	EnableOpenMetrics         bool `yaml:"enable_openmetrics"`
+	OpenMetricsCreatedSamples bool `yaml:"openmetrics_created_samples"`
+	EnablePush                bool `yaml:"enable_push"`
+	EnableLifecycle           bool `yaml:"enable_lifecycle"`
+}
+
+// PushConfig holds the settings of the push API. PersistDir, if set, is where
+// pushed metrics are written so that they survive restarts. It must not be
+// scanned, since the scanner would then export the pushes a second time.
+// MaxBodySize is the largest accepted push, in bytes, or 0 for no limit.
+type PushConfig struct {
+	PersistDir  string `yaml:"persist_dir"`
+	MaxBodySize int64  `yaml:"max_body_size"`
+}
+
+// ScannerConfig holds the settings of the textfile directory scanner. When
+// several directories are configured, it provides their default settings.
+type ScannerConfig struct {
+	Directory               string                          `yaml:"directory"`
+	Recursive               bool                            `yaml:"recursive"`
+	Watch                   bool                            `yaml:"watch"`
+	ContentHash             bool                            `yaml:"content_hash"`
+	Interval                time.Duration                   `yaml:"interval"`
+	UpdateMode              collector.UpdateMode            `yaml:"update_mode"`
+	PathUpdateModes         map[string]collector.UpdateMode `yaml:"path_update_modes"`
+	FilesMinAge             bool                            `yaml:"files_min_age"`
+	FilesMinAgeDuration     time.Duration                   `yaml:"files_min_age_duration"`
+	OldFilesExternalCommand string                          `yaml:"old_files_external_command"`
+	FilePattern             string                          `yaml:"file_pattern"`
+	TTL                     time.Duration                   `yaml:"ttl"`
+	Labels                  map[string]string               `yaml:"labels"`
+	PathLabels              []PathLabelConfig               `yaml:"path_labels"`
+	PathLabelConflict       string                          `yaml:"path_label_conflict"`
+	Relabel                 []relabel.Config                `yaml:"relabel_configs"`
+	Include                 []string                        `yaml:"include"`
+	IncludeRegex            []string                        `yaml:"include_regex"`
+	Exclude                 []string                        `yaml:"exclude"`
+	ExcludeRegex            []string                        `yaml:"exclude_regex"`
+	FileMetrics             bool                            `yaml:"file_metrics"`
+	FileMetricsMaxFiles     int                             `yaml:"file_metrics_max_files"`
+	SettleTime              time.Duration                   `yaml:"settle_time"`
+	SkipTempFiles           bool                            `yaml:"skip_temp_files"`
+	LockFileSuffix          string                          `yaml:"lock_file_suffix"`
+	OnParseError            string                          `yaml:"on_parse_error"`
+	LastGoodMaxAge          time.Duration                   `yaml:"last_good_max_age"`
+	MaxSeriesPerFile        int                             `yaml:"max_series_per_file"`
+	MaxSeriesPerFamily      int                             `yaml:"max_series_per_family"`
+	SeriesLimitAction       string                          `yaml:"series_limit_action"`
+	TimestampPolicy         string                          `yaml:"timestamp_policy"`
+	TimestampMaxAge         time.Duration                   `yaml:"timestamp_max_age"`
+	TimestampMaxFuture      time.Duration                   `yaml:"timestamp_max_future"`
+	UntimestampedSamples    string                          `yaml:"untimestamped_samples"`
+}
+
+// PathLabelConfig is a rule that derives labels from the path of a file,
+// relative to the scanned directory, with forward slashes. Exactly one of
+// Regex, whose named groups become labels, and Template is set. A template is
+// a path where "{name}" matches one path segment into the label name, and "*"
+// matches any part of a segment, such as "{team}/{job}.prom".
+type PathLabelConfig struct {
+	Regex    string `yaml:"regex"`
+	Template string `yaml:"template"`
+}
+
+// Compile returns the regular expression of the rule.
+func (p PathLabelConfig) Compile() (*regexp.Regexp, error) {
+	switch {
+	case p.Regex != "" && p.Template != "":
+		return nil, fmt.Errorf("only one of regex and template can be set")
+	case p.Regex != "":
+		return regexp.Compile(p.Regex)
+	case p.Template != "":
+		return regexp.Compile(templateRegex(p.Template))
+	}
+	return nil, fmt.Errorf("one of regex and template must be set")
+}
+
+// templateRegex converts a path template into an anchored regular expression.
+func templateRegex(template string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for template != "" {
+		switch {
+		case strings.HasPrefix(template, "{") && strings.Contains(template, "}"):
+			end := strings.Index(template, "}")
+			b.WriteString("(?P<" + template[1:end] + ">[^/]+)")
+			template = template[end+1:]
+		case template[0] == '*':
+			b.WriteString("[^/]*")
+			template = template[1:]
+		default:
+			end := strings.IndexAny(template[1:], "{*") + 1
+			if end == 0 {
+				end = len(template)
+			}
+			b.WriteString(regexp.QuoteMeta(template[:end]))
+			template = template[end:]
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// DirectoryConfig holds the settings of one of several scanned directories.
+type DirectoryConfig struct {
+	// Name identifies the directory in the internal metrics. It defaults to
+	// the directory path.
+	Name          string `yaml:"name"`
+	ScannerConfig `yaml:",inline"`
+}
+
+// CollectorConfig holds the settings of the in-memory metric store.
+// ExternalLabels are added to every series; ExternalLabelsPolicy tells whether
+// they "preserve" or "override" the labels of the same name of a series.
+// MaxSeries is the maximum number of series stored, 0 meaning no limit. If
+// SnapshotFile is set, the stored series are saved to it every
+// SnapshotInterval and restored from it at startup. ConflictPolicy tells which
+// version of a series defined by several files is exported. MetadataPolicy
+// tells which help text a metric is exported with when files disagree, unless
+// MetadataOverrides sets it by metric name.
+type CollectorConfig struct {
+	MemoryMaxAge         time.Duration                     `yaml:"memory_max_age"`
+	ExternalLabels       map[string]string                 `yaml:"external_labels"`
+	ExternalLabelsPolicy string                            `yaml:"external_labels_policy"`
+	MaxSeries            int                               `yaml:"max_series"`
+	SnapshotFile         string                            `yaml:"snapshot_file"`
+	SnapshotInterval     time.Duration                     `yaml:"snapshot_interval"`
+	ConflictPolicy       string                            `yaml:"conflict_policy"`
+	MetadataPolicy       string                            `yaml:"metadata_policy"`
+	MetadataOverrides    map[string]MetadataOverrideConfig `yaml:"metadata_overrides"`
+}
+
+// MetadataOverrideConfig is the help text and type a metric is exported with,
+// whatever the files say. Empty fields are not overridden.
+type MetadataOverrideConfig struct {
+	Help string `yaml:"help"`
+	Type string `yaml:"type"`
+}
+
+// LogConfig holds the logging settings.
+type LogConfig struct {
+	Level string `yaml:"level"`
+}
+
+// Load reads the configuration file at path. Settings missing from the file
+// keep their value from defaults, usually built from the command-line flags.
+// Maps such as path_update_modes replace the default entirely when present.
+// The result is validated.
+func Load(path string, defaults Config) (*Config, error) {
+	log.Printf("Loading configuration from: %s", path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// The directories are decoded once the scanner section is known, since
+	// it provides their defaults.
+	raw := struct {
+		Config      `yaml:",inline"`
+		Directories []yaml.Node `yaml:"directories"`
+	}{Config: defaults}
+	raw.Scanner.PathUpdateModes = nil
+	raw.Scanner.Labels = nil
+	raw.Collector.ExternalLabels = nil
+	if err := decodeStrict(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config YAML: %w", err)
+	}
+	cfg := raw.Config
+	if cfg.Scanner.PathUpdateModes == nil {
+		cfg.Scanner.PathUpdateModes = defaults.Scanner.PathUpdateModes
+	}
+	if cfg.Scanner.Labels == nil {
+		cfg.Scanner.Labels = defaults.Scanner.Labels
+	}
+	if cfg.Collector.ExternalLabels == nil {
+		cfg.Collector.ExternalLabels = defaults.Collector.ExternalLabels
+	}
+	cfg.Directories = nil
+	for i := range raw.Directories {
+		dir := DirectoryConfig{ScannerConfig: cfg.Scanner}
+		dir.PathUpdateModes, dir.Labels = nil, nil
+		node, err := yaml.Marshal(&raw.Directories[i])
+		if err == nil {
+			err = decodeStrict(node, &dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse directories[%d]: %w", i, err)
+		}
+		if dir.PathUpdateModes == nil {
+			dir.PathUpdateModes = cfg.Scanner.PathUpdateModes
+		}
+		if dir.Labels == nil {
+			dir.Labels = cfg.Scanner.Labels
+		}
+		if dir.Name == "" {
+			dir.Name = dir.Directory
+		}
+		cfg.Directories = append(cfg.Directories, dir)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// decodeStrict decodes YAML data into out, rejecting unknown keys. Empty data
+// leaves out unchanged.
+func decodeStrict(data []byte, out interface{}) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// ScanDirectories returns the directories to scan: the entries of
+// Directories, or the directory of the scanner section if there are none.
+func (c *Config) ScanDirectories() []DirectoryConfig {
+	if len(c.Directories) > 0 {
+		return c.Directories
+	}
+	return []DirectoryConfig{{Name: c.Scanner.Directory, ScannerConfig: c.Scanner}}
+}
+
+// Validate checks that the settings are consistent and usable.
+func (c *Config) Validate() error {
+	if c.Web.ListenAddress == "" {
+		return fmt.Errorf("web.listen_address must not be empty")
+	}
+	if c.Web.ConfigFile != "" && (c.Web.TLS != nil || c.Web.BasicAuth != nil) {
+		return fmt.Errorf("web.config_file cannot be combined with inline tls_server_config or basic_auth")
+	}
+	if _, err := relabel.Compile(c.Relabel, "global"); err != nil {
+		return err
+	}
+	if err := c.Scanner.validate("scanner"); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	for i, dir := range c.Directories {
+		if err := dir.validate(fmt.Sprintf("directories[%d]", i)); err != nil {
+			return err
+		}
+		if names[dir.Name] {
+			return fmt.Errorf("directories[%d]: duplicate name %q", i, dir.Name)
+		}
+		names[dir.Name] = true
+		path := filepath.Clean(dir.Directory)
+		if paths[path] {
+			return fmt.Errorf("directories[%d]: directory %s is already listed", i, dir.Directory)
+		}
+		paths[path] = true
+	}
+	if err := c.validatePersistDir(); err != nil {
+		return err
+	}
+	if c.Push.MaxBodySize < 0 {
+		return fmt.Errorf("push.max_body_size must not be negative, got %d", c.Push.MaxBodySize)
+	}
+	if c.Collector.MemoryMaxAge <= 0 {
+		return fmt.Errorf("collector.memory_max_age must be positive, got %s", c.Collector.MemoryMaxAge)
+	}
+	for name := range c.Collector.ExternalLabels {
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("collector.external_labels: invalid label name %q", name)
+		}
+	}
+	switch c.Collector.ExternalLabelsPolicy {
+	case "preserve", "override":
+	default:
+		return fmt.Errorf("invalid collector.external_labels_policy %q, must be one of: preserve, override", c.Collector.ExternalLabelsPolicy)
+	}
+	if c.Collector.MaxSeries < 0 {
+		return fmt.Errorf("collector.max_series must not be negative, got %d", c.Collector.MaxSeries)
+	}
+	if c.Collector.SnapshotInterval <= 0 {
+		return fmt.Errorf("collector.snapshot_interval must be positive, got %s", c.Collector.SnapshotInterval)
+	}
+	switch c.Collector.ConflictPolicy {
+	case "newest_file", "newest_timestamp", "reject", "file_label":
+	default:
+		return fmt.Errorf("invalid collector.conflict_policy %q, must be one of: newest_file, newest_timestamp, reject, file_label", c.Collector.ConflictPolicy)
+	}
+	switch c.Collector.MetadataPolicy {
+	case "first", "longest":
+	default:
+		return fmt.Errorf("invalid collector.metadata_policy %q, must be one of: first, longest", c.Collector.MetadataPolicy)
+	}
+	for name, override := range c.Collector.MetadataOverrides {
+		if !model.IsValidLegacyMetricName(name) {
+			return fmt.Errorf("collector.metadata_overrides: invalid metric name %q", name)
+		}
+		switch override.Type {
+		case "", "counter", "gauge", "untyped", "histogram", "summary":
+		default:
+			return fmt.Errorf("invalid collector.metadata_overrides[%s].type %q, must be one of: counter, gauge, untyped, histogram, summary", name, override.Type)
+		}
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid log.level %q, must be one of: debug, info, warn, error", c.Log.Level)
+	}
+	return nil
+}
+
+// validatePersistDir checks that push.persist_dir is not read by a scanner:
+// it must not be a scanned directory, nor be below a directory scanned
+// recursively.
+func (c *Config) validatePersistDir() error {
+	if c.Push.PersistDir == "" {
+		return nil
+	}
+	persistDir, err := filepath.Abs(c.Push.PersistDir)
+	if err != nil {
+		return fmt.Errorf("push.persist_dir: %w", err)
+	}
+	for _, dir := range c.ScanDirectories() {
+		scanned, err := filepath.Abs(dir.Directory)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir.Name, err)
+		}
+		rel, err := filepath.Rel(scanned, persistDir)
+		if err != nil {
+			continue
+		}
+		if rel == "." || (dir.Recursive && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return fmt.Errorf("push.persist_dir %s must not be scanned, but it is read from the textfile directory %s", c.Push.PersistDir, dir.Directory)
+		}
+	}
+	return nil
+}
+
+// validate checks the scanner settings found under the given key.
+func (c *ScannerConfig) validate(key string) error {
+	if c.Directory == "" {
+		return fmt.Errorf("%s.directory must not be empty", key)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("%s.interval must be positive, got %s", key, c.Interval)
+	}
+	if _, err := collector.ParseUpdateMode(string(c.UpdateMode)); err != nil {
+		return fmt.Errorf("%s.update_mode: %w", key, err)
+	}
+	for pattern, mode := range c.PathUpdateModes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s.path_update_modes: invalid pattern %q: %w", key, pattern, err)
+		}
+		if _, err := collector.ParseUpdateMode(string(mode)); err != nil {
+			return fmt.Errorf("%s.path_update_modes[%s]: %w", key, pattern, err)
+		}
+	}
+	if c.FilesMinAgeDuration < 0 {
+		return fmt.Errorf("%s.files_min_age_duration must not be negative, got %s", key, c.FilesMinAgeDuration)
+	}
+	if _, err := filepath.Match(c.FilePattern, ""); err != nil {
+		return fmt.Errorf("%s.file_pattern: invalid pattern %q: %w", key, c.FilePattern, err)
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("%s.ttl must not be negative, got %s", key, c.TTL)
+	}
+	if c.FileMetricsMaxFiles < 0 {
+		return fmt.Errorf("%s.file_metrics_max_files must not be negative, got %d", key, c.FileMetricsMaxFiles)
+	}
+	if c.SettleTime < 0 {
+		return fmt.Errorf("%s.settle_time must not be negative, got %s", key, c.SettleTime)
+	}
+	if strings.ContainsRune(c.LockFileSuffix, filepath.Separator) {
+		return fmt.Errorf("%s.lock_file_suffix must not contain a path separator, got %q", key, c.LockFileSuffix)
+	}
+	switch c.OnParseError {
+	case "drop", "keep_last":
+	default:
+		return fmt.Errorf("invalid %s.on_parse_error %q, must be one of: drop, keep_last", key, c.OnParseError)
+	}
+	if c.LastGoodMaxAge < 0 {
+		return fmt.Errorf("%s.last_good_max_age must not be negative, got %s", key, c.LastGoodMaxAge)
+	}
+	if c.MaxSeriesPerFile < 0 {
+		return fmt.Errorf("%s.max_series_per_file must not be negative, got %d", key, c.MaxSeriesPerFile)
+	}
+	if c.MaxSeriesPerFamily < 0 {
+		return fmt.Errorf("%s.max_series_per_family must not be negative, got %d", key, c.MaxSeriesPerFamily)
+	}
+	switch c.SeriesLimitAction {
+	case "reject", "truncate", "keep_last":
+	default:
+		return fmt.Errorf("invalid %s.series_limit_action %q, must be one of: reject, truncate, keep_last", key, c.SeriesLimitAction)
+	}
+	switch c.TimestampPolicy {
+	case "honor", "drop", "mtime", "clamp", "reject":
+	default:
+		return fmt.Errorf("invalid %s.timestamp_policy %q, must be one of: honor, drop, mtime, clamp, reject", key, c.TimestampPolicy)
+	}
+	if c.TimestampMaxAge < 0 {
+		return fmt.Errorf("%s.timestamp_max_age must not be negative, got %s", key, c.TimestampMaxAge)
+	}
+	if c.TimestampMaxFuture < 0 {
+		return fmt.Errorf("%s.timestamp_max_future must not be negative, got %s", key, c.TimestampMaxFuture)
+	}
+	switch c.UntimestampedSamples {
+	case "scan_time", "mtime", "none":
+	default:
+		return fmt.Errorf("invalid %s.untimestamped_samples %q, must be one of: scan_time, mtime, none", key, c.UntimestampedSamples)
+	}
+	for name := range c.Labels {
+		if !model.LabelName(name).IsValidLegacy() {
+			return fmt.Errorf("%s.labels: invalid label name %q", key, name)
+		}
+	}
+	for i, rule := range c.PathLabels {
+		re, err := rule.Compile()
+		if err != nil {
+			return fmt.Errorf("%s.path_labels[%d]: %w", key, i, err)
+		}
+		named := false
+		for _, name := range re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if !model.LabelName(name).IsValidLegacy() {
+				return fmt.Errorf("%s.path_labels[%d]: invalid label name %q", key, i, name)
+			}
+			named = true
+		}
+		if !named {
+			return fmt.Errorf("%s.path_labels[%d]: no named group or {name} placeholder", key, i)
+		}
+	}
+	switch c.PathLabelConflict {
+	case "keep_file", "override", "error":
+	default:
+		return fmt.Errorf("invalid %s.path_label_conflict %q, must be one of: keep_file, override, error", key, c.PathLabelConflict)
+	}
+	if _, err := relabel.Compile(c.Relabel, key); err != nil {
+		return fmt.Errorf("%s.%w", key, err)
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("%s: invalid glob %q", key, pattern)
+		}
+	}
+	for _, expr := range append(append([]string{}, c.IncludeRegex...), c.ExcludeRegex...) {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("%s: invalid regular expression %q: %w", key, expr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/webconfig"
+)
+
+// testDefaults returns a valid configuration, like the one built from the
+// default command-line flags.
+func testDefaults() Config {
+	var cfg Config
+	cfg.Web.ListenAddress = ":9014"
+	cfg.Scanner = ScannerConfig{
+		Directory:            "/var/lib/textfile",
+		Interval:             30 * time.Second,
+		UpdateMode:           collector.UpdateReplace,
+		PathUpdateModes:      map[string]collector.UpdateMode{"default/*": collector.UpdateRetain},
+		Labels:               map[string]string{"env": "default"},
+		PathLabelConflict:    "keep_file",
+		OnParseError:         "drop",
+		SeriesLimitAction:    "reject",
+		TimestampPolicy:      "honor",
+		UntimestampedSamples: "scan_time",
+	}
+	cfg.Collector = CollectorConfig{
+		MemoryMaxAge:         15 * time.Minute,
+		ExternalLabelsPolicy: "preserve",
+		SnapshotInterval:     time.Minute,
+		ConflictPolicy:       "newest_file",
+		MetadataPolicy:       "first",
+	}
+	cfg.Log.Level = "info"
+	return cfg
+}
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEmptyKeepsDefaults(t *testing.T) {
+	cfg, err := Load(writeConfig(t, ""), testDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testDefaults()
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Errorf("Load() = %+v, want the defaults %+v", *cfg, want)
+	}
+}
+
+func TestLoadOverridesDefaults(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+web:
+  listen_address: ":9100"
+  enable_openmetrics: true
+scanner:
+  directory: /tmp/metrics
+  interval: 10s
+  recursive: true
+  path_update_modes:
+    "batch/*": retain
+  labels:
+    team: infra
+collector:
+  memory_max_age: 1h
+  external_labels:
+    region: eu
+log:
+  level: debug
+`), testDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Web.ListenAddress != ":9100" || !cfg.Web.EnableOpenMetrics {
+		t.Errorf("web = %+v", cfg.Web)
+	}
+	if cfg.Scanner.Directory != "/tmp/metrics" || cfg.Scanner.Interval != 10*time.Second || !cfg.Scanner.Recursive {
+		t.Errorf("scanner = %+v", cfg.Scanner)
+	}
+	if cfg.Scanner.OnParseError != "drop" {
+		t.Errorf("scanner.on_parse_error = %q, want the default", cfg.Scanner.OnParseError)
+	}
+	// Maps replace the default entirely.
+	if want := map[string]collector.UpdateMode{"batch/*": collector.UpdateRetain}; !reflect.DeepEqual(cfg.Scanner.PathUpdateModes, want) {
+		t.Errorf("scanner.path_update_modes = %v, want %v", cfg.Scanner.PathUpdateModes, want)
+	}
+	if want := map[string]string{"team": "infra"}; !reflect.DeepEqual(cfg.Scanner.Labels, want) {
+		t.Errorf("scanner.labels = %v, want %v", cfg.Scanner.Labels, want)
+	}
+	if cfg.Collector.MemoryMaxAge != time.Hour || cfg.Collector.ExternalLabels["region"] != "eu" {
+		t.Errorf("collector = %+v", cfg.Collector)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Errorf("log.level = %q, want debug", cfg.Log.Level)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "scanner:\n  directroy: /tmp\n", "field directroy not found"},
+		{"bad duration", "scanner:\n  interval: soon\n", "failed to parse config YAML"},
+		{"invalid value", "scanner:\n  interval: 0s\n", "scanner.interval must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content), testDefaults())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yml"), testDefaults()); err == nil {
+		t.Error("Load() of a missing file succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"empty listen address", func(c *Config) { c.Web.ListenAddress = "" }, "web.listen_address"},
+		{"empty directory", func(c *Config) { c.Scanner.Directory = "" }, "scanner.directory"},
+		{"update mode", func(c *Config) { c.Scanner.UpdateMode = "merge" }, "scanner.update_mode"},
+		{"path update mode", func(c *Config) { c.Scanner.PathUpdateModes = map[string]collector.UpdateMode{"[": "retain"} }, "invalid pattern"},
+		{"file pattern", func(c *Config) { c.Scanner.FilePattern = "[" }, "scanner.file_pattern"},
+		{"negative ttl", func(c *Config) { c.Scanner.TTL = -time.Second }, "scanner.ttl"},
+		{"label name", func(c *Config) { c.Scanner.Labels = map[string]string{"a-b": "x"} }, "invalid label name"},
+		{"memory max age", func(c *Config) { c.Collector.MemoryMaxAge = 0 }, "collector.memory_max_age"},
+		{"external label", func(c *Config) { c.Collector.ExternalLabels = map[string]string{"__x": "y"} }, "collector.external_labels"},
+		{"external labels policy", func(c *Config) { c.Collector.ExternalLabelsPolicy = "merge" }, "external_labels_policy"},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }, "log.level"},
+		{"scanned persist dir", func(c *Config) { c.Push.PersistDir = "/var/lib/textfile/" }, "push.persist_dir"},
+		{"max body size", func(c *Config) { c.Push.MaxBodySize = -1 }, "push.max_body_size"},
+		{"persist dir below a recursive scan", func(c *Config) {
+			c.Scanner.Recursive = true
+			c.Push.PersistDir = "/var/lib/textfile/push"
+		}, "push.persist_dir"},
+		{"config file and inline tls", func(c *Config) {
+			c.Web.ConfigFile = "web.yml"
+			c.Web.BasicAuth = &webconfig.BasicAuthConfig{}
+		}, "web.config_file"},
+	}
+	if err := (&Config{}).Validate(); err == nil {
+		t.Error("Validate() of an empty configuration succeeded")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testDefaults()
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate() of the defaults failed: %v", err)
+			}
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePersistDir(t *testing.T) {
+	for _, dir := range []string{"/var/lib/push", "/var/lib/textfile-push", "/var/lib/textfile/push"} {
+		cfg := testDefaults()
+		cfg.Push.PersistDir = dir
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate() with push.persist_dir %s failed: %v", dir, err)
+		}
+	}
+}
+
+func TestLoadDirectories(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+scanner:
+  interval: 10s
+  labels:
+    env: prod
+directories:
+  - name: team-a
+    directory: /data/a
+    recursive: true
+    ttl: 1h
+  - directory: /data/b
+    interval: 1m
+    labels:
+      team: b
+`), testDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := cfg.ScanDirectories()
+	if len(dirs) != 2 {
+		t.Fatalf("ScanDirectories() returned %d directories, want 2", len(dirs))
+	}
+	a, b := dirs[0], dirs[1]
+	if a.Name != "team-a" || !a.Recursive || a.TTL != time.Hour || a.Interval != 10*time.Second {
+		t.Errorf("directories[0] = %+v", a)
+	}
+	if !reflect.DeepEqual(a.Labels, map[string]string{"env": "prod"}) || a.OnParseError != "drop" {
+		t.Errorf("directories[0] does not inherit the scanner section: %+v", a)
+	}
+	if b.Name != "/data/b" || b.Recursive || b.Interval != time.Minute {
+		t.Errorf("directories[1] = %+v", b)
+	}
+	if !reflect.DeepEqual(b.Labels, map[string]string{"team": "b"}) {
+		t.Errorf("directories[1].labels = %v, want them to replace the scanner ones", b.Labels)
+	}
+
+	// Without directories, the scanner section is the only one.
+	cfg, err = Load(writeConfig(t, ""), testDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs := cfg.ScanDirectories(); len(dirs) != 1 || dirs[0].Name != "/var/lib/textfile" || dirs[0].Directory != "/var/lib/textfile" {
+		t.Errorf("ScanDirectories() = %+v, want the scanner directory", dirs)
+	}
+}
+
+func TestLoadDirectoriesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"duplicate name", "directories:\n  - {name: a, directory: /x}\n  - {name: a, directory: /y}\n", `duplicate name "a"`},
+		{"duplicate path", "directories:\n  - {name: a, directory: /x}\n  - {name: b, directory: /x/}\n", "already listed"},
+		{"unknown key", "directories:\n  - {directory: /x, recursve: true}\n", "directories[0]"},
+		{"invalid setting", "directories:\n  - {directory: /x, interval: 0s}\n", "directories[0].interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content), testDefaults())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathLabelCompile(t *testing.T) {
+	tests := []struct {
+		rule  PathLabelConfig
+		path  string
+		match map[string]string
+	}{
+		{PathLabelConfig{Template: "{team}/{job}.prom"}, "infra/backup.prom", map[string]string{"team": "infra", "job": "backup"}},
+		{PathLabelConfig{Template: "{team}/{job}.prom"}, "infra/sub/backup.prom", nil},
+		{PathLabelConfig{Template: "{team}/{job}.prom"}, "infra/backupxprom", nil},
+		{PathLabelConfig{Template: "hosts/{host}/*.prom"}, "hosts/db1/cpu.prom", map[string]string{"host": "db1"}},
+		{PathLabelConfig{Template: "{job}_*.prom"}, "backup_2024.prom", map[string]string{"job": "backup"}},
+		{PathLabelConfig{Regex: `^(?P<team>[^/]+)/`}, "infra/a/b.prom", map[string]string{"team": "infra"}},
+	}
+	for _, tt := range tests {
+		re, err := tt.rule.Compile()
+		if err != nil {
+			t.Errorf("Compile(%+v) failed: %v", tt.rule, err)
+			continue
+		}
+		var got map[string]string
+		if match := re.FindStringSubmatch(tt.path); match != nil {
+			got = make(map[string]string)
+			for i, name := range re.SubexpNames() {
+				if name != "" {
+					got[name] = match[i]
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.match) {
+			t.Errorf("%+v on %s = %v, want %v", tt.rule, tt.path, got, tt.match)
+		}
+	}
+
+	for _, rule := range []PathLabelConfig{{}, {Regex: "a", Template: "b"}, {Regex: "("}, {Template: "{a-b}"}} {
+		if _, err := rule.Compile(); err == nil {
+			t.Errorf("Compile(%+v) succeeded, want an error", rule)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// DirectiveLabelPrefix starts the names of the reserved labels that are
+// directives to the exporter rather than labels of the series. They are
+// removed before the series are exported.
+const DirectiveLabelPrefix = "__tfe_"
+
+// Directive labels.
+const (
+	// LabelTTL is how long the series is kept in memory, as a duration such
+	// as "2h" or "1d".
+	LabelTTL = DirectiveLabelPrefix + "ttl"
+	// LabelHonorTimestamps is "false" to replace the timestamp of the series
+	// with the time it is read, like for a series without timestamp.
+	LabelHonorTimestamps = DirectiveLabelPrefix + "honor_timestamps"
+	// LabelRetain is "true" to keep the series until it expires when it
+	// vanishes from its file or the file is removed.
+	LabelRetain = DirectiveLabelPrefix + "retain"
+	// LabelOwner names the team that owns the series.
+	LabelOwner = DirectiveLabelPrefix + "owner"
+)
+
+// directiveComment starts the comment lines that set directives for all the
+// series of a file, or of a metric family with the "metric" key, e.g.
+// "# TFE ttl=26h" or "# TFE ttl=5m metric=job_last_run".
+const directiveComment = "# TFE "
+
+// directiveKeys maps the keys of directive comments to their label.
+var directiveKeys = map[string]string{
+	"ttl":              LabelTTL,
+	"honor_timestamps": LabelHonorTimestamps,
+	"retain":           LabelRetain,
+	"owner":            LabelOwner,
+}
+
+// ParseTTL parses the value of a ttl directive, which must be a positive
+// duration.
+func ParseTTL(value string) (time.Duration, error) {
+	d, err := model.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %s", value)
+	}
+	return time.Duration(d), nil
+}
+
+// checkDirective validates the value of a directive label.
+func checkDirective(name, value string) error {
+	switch name {
+	case LabelTTL:
+		_, err := ParseTTL(value)
+		return err
+	case LabelHonorTimestamps, LabelRetain:
+		_, err := strconv.ParseBool(value)
+		return err
+	case LabelOwner:
+		if value == "" {
+			return fmt.Errorf("owner must not be empty")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown directive %s", name)
+}
+
+// directiveError builds an Error of the invalid_directive category.
+func directiveError(data []byte, line int, msg string) *Error {
+	e := newError(data, line, msg)
+	e.Category = CategoryInvalidDirective
+	return e
+}
+
+// applyDirectives validates the directive labels of the series of families,
+// then adds the directives of the "# TFE" comments of data as labels to the
+// series that do not set them. A directive for a metric family overrides one
+// for the whole file, and a later comment overrides an earlier one.
+func applyDirectives(data []byte, families map[string]*dto.MetricFamily) *Error {
+	fileLabels := make(map[string]string)
+	familyLabels := make(map[string]map[string]string)
+	for i, raw := range bytes.Split(data, []byte("\n")) {
+		line := strings.TrimSuffix(string(raw), "\r")
+		if !strings.HasPrefix(line, directiveComment) {
+			continue
+		}
+		labels := make(map[string]string)
+		metric := ""
+		for _, field := range strings.Fields(strings.TrimPrefix(line, directiveComment)) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return directiveError(data, i+1, fmt.Sprintf("invalid directive %q, expected key=value", field))
+			}
+			if key == "metric" {
+				if _, ok := families[value]; !ok {
+					return directiveError(data, i+1, fmt.Sprintf("directive for unknown metric %q", value))
+				}
+				metric = value
+				continue
+			}
+			name, ok := directiveKeys[key]
+			if !ok {
+				return directiveError(data, i+1, fmt.Sprintf("unknown directive %q", key))
+			}
+			if err := checkDirective(name, value); err != nil {
+				return directiveError(data, i+1, fmt.Sprintf("invalid directive %q: %v", field, err))
+			}
+			labels[name] = value
+		}
+		target := fileLabels
+		if metric != "" {
+			if familyLabels[metric] == nil {
+				familyLabels[metric] = make(map[string]string)
+			}
+			target = familyLabels[metric]
+		}
+		for name, value := range labels {
+			target[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, m := range families[name].GetMetric() {
+			present := make(map[string]bool)
+			for _, l := range m.GetLabel() {
+				if !strings.HasPrefix(l.GetName(), DirectiveLabelPrefix) {
+					continue
+				}
+				if err := checkDirective(l.GetName(), l.GetValue()); err != nil {
+					return directiveError(data, 0, fmt.Sprintf("invalid label %s=%q of %s: %v", l.GetName(), l.GetValue(), name, err))
+				}
+				present[l.GetName()] = true
+			}
+			added := false
+			for _, labels := range []map[string]string{familyLabels[name], fileLabels} {
+				for label, value := range labels {
+					if !present[label] {
+						m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(label), Value: proto.String(value)})
+						present[label] = true
+						added = true
+					}
+				}
+			}
+			if added {
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// directiveLabels returns the directive labels of the series of family name
+// of result, in the order of the series, formatted as name=value.
+func directiveLabels(result *Result, name string) [][]string {
+	var series [][]string
+	for _, m := range result.Families[name].GetMetric() {
+		labels := []string{}
+		for _, l := range m.GetLabel() {
+			if strings.HasPrefix(l.GetName(), DirectiveLabelPrefix) {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+		}
+		series = append(series, labels)
+	}
+	return series
+}
+
+func TestTTLDirectives(t *testing.T) {
+	result, err := ParseData([]byte(`# TFE ttl=26h
+# TFE metric=backup_duration_seconds ttl=30m
+# TYPE backup_last_success gauge
+backup_last_success 1
+# TYPE backup_duration_seconds gauge
+backup_duration_seconds{step="dump"} 12
+backup_duration_seconds{step="upload",__tfe_ttl="5m"} 30
+# TFE ttl=1d
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][][]string{
+		// A later comment overrides an earlier one for the whole file.
+		"backup_last_success": {{"__tfe_ttl=1d"}},
+		// A family directive overrides the file one, and a label both.
+		"backup_duration_seconds": {{"__tfe_ttl=30m"}, {"__tfe_ttl=5m"}},
+	}
+	for name, want := range tests {
+		if got := directiveLabels(result, name); !reflect.DeepEqual(got, want) {
+			t.Errorf("directives of %s = %v, want %v", name, got, want)
+		}
+	}
+
+	// Files without directives are left as they are.
+	result, err = ParseData([]byte("a{x=\"1\"} 1\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := directiveLabels(result, "a"), [][]string{{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("directives of a = %v, want %v", got, want)
+	}
+}
+
+func TestSeriesDirectives(t *testing.T) {
+	result, err := ParseData([]byte(`# TFE honor_timestamps=false retain=true owner=backup
+# TFE metric=b owner=storage
+a 1
+b 1
+b{x="1",__tfe_retain="false"} 2
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][][]string{
+		"a": {{"__tfe_honor_timestamps=false", "__tfe_owner=backup", "__tfe_retain=true"}},
+		"b": {
+			{"__tfe_honor_timestamps=false", "__tfe_owner=storage", "__tfe_retain=true"},
+			{"__tfe_honor_timestamps=false", "__tfe_owner=storage", "__tfe_retain=false"},
+		},
+	}
+	for name, want := range tests {
+		if got := directiveLabels(result, name); !reflect.DeepEqual(got, want) {
+			t.Errorf("directives of %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := map[string]time.Duration{
+		"5m":    5 * time.Minute,
+		"26h":   26 * time.Hour,
+		"1d":    24 * time.Hour,
+		"1h30m": 90 * time.Minute,
+	}
+	for value, want := range tests {
+		if got, err := ParseTTL(value); err != nil || got != want {
+			t.Errorf("ParseTTL(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "0s", "-1h", "soon", "5"} {
+		if _, err := ParseTTL(value); err == nil {
+			t.Errorf("ParseTTL(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"missing value", "# TFE ttl\na 1\n", 1},
+		{"unknown key", "a 1\n# TFE lifetime=1h\n", 2},
+		{"invalid ttl", "# TFE ttl=soon\na 1\n", 1},
+		{"zero ttl", "# TFE ttl=0s\na 1\n", 1},
+		{"unknown metric", "# TFE metric=b ttl=1h\na 1\n", 1},
+		{"invalid ttl label", "a{__tfe_ttl=\"-5m\"} 1\n", 0},
+		{"unknown label", "a{__tfe_lifetime=\"1h\"} 1\n", 0},
+		{"invalid honor_timestamps", "# TFE honor_timestamps=maybe\na 1\n", 1},
+		{"invalid retain label", "a{__tfe_retain=\"forever\"} 1\n", 0},
+		{"empty owner", "# TFE owner=\na 1\n", 1},
+		{"empty owner label", "a{__tfe_owner=\"\"} 1\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseData([]byte(tt.input), false)
+			var parseErr *Error
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ParseData() error = %v, want an *Error", err)
+			}
+			if parseErr.Category != CategoryInvalidDirective || parseErr.Line != tt.line {
+				t.Errorf("error %q at line %d with category %s, want line %d with category %s",
+					parseErr.Msg, parseErr.Line, parseErr.Category, tt.line, CategoryInvalidDirective)
+			}
+		})
+	}
+}
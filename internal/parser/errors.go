@@ -0,0 +1,194 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// Categories of parse errors.
+const (
+	// CategoryRead means the file could not be read.
+	CategoryRead = "read"
+	// CategorySyntax is any malformed line not covered by another category.
+	CategorySyntax = "syntax"
+	// CategoryInvalidName means a metric name is not valid.
+	CategoryInvalidName = "invalid_name"
+	// CategoryInvalidLabel means a label name or value is not valid, or a
+	// label is repeated.
+	CategoryInvalidLabel = "invalid_label"
+	// CategoryInvalidValue means a sample value or timestamp is not valid.
+	CategoryInvalidValue = "invalid_value"
+	// CategoryBadType means a metric type is unknown, or a sample does not
+	// fit the type of its family.
+	CategoryBadType = "bad_type"
+	// CategoryDuplicateSeries means the same series appears twice.
+	CategoryDuplicateSeries = "duplicate_series"
+	// CategoryDuplicateMetadata means a TYPE, HELP or UNIT line is repeated or
+	// comes after the samples of its family.
+	CategoryDuplicateMetadata = "duplicate_metadata"
+	// CategoryLabelConflict means a label of the file has another value than
+	// the one the exporter would inject, such as a label derived from the path.
+	CategoryLabelConflict = "label_conflict"
+	// CategorySeriesLimit means a file has more series than allowed, in total
+	// or for a metric family.
+	CategorySeriesLimit = "series_limit"
+	// CategoryInvalidDirective means a "# TFE" comment or a reserved __tfe_
+	// label is unknown or has an invalid value.
+	CategoryInvalidDirective = "invalid_directive"
+)
+
+// maxErrorText is the maximum length of the offending text kept in an Error.
+const maxErrorText = 256
+
+// Error is a parse error located in a file. Line and Column start at 1 and
+// are zero when unknown. The column is a best effort that points to the
+// offending token when the message names it.
+type Error struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Category string `json:"category"`
+	Msg      string `json:"message"`
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		if e.File == "" {
+			b.WriteString("line ")
+		}
+		b.WriteString(strconv.Itoa(e.Line))
+		b.WriteString(":")
+		if e.Column > 0 {
+			b.WriteString(strconv.Itoa(e.Column))
+			b.WriteString(":")
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// newError builds an Error for the given line of data, numbered from 1, or
+// for the whole data if line is 0.
+func newError(data []byte, line int, msg string) *Error {
+	e := &Error{Line: line, Category: categorize(msg), Msg: msg}
+	if line <= 0 {
+		return e
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	if line > len(lines) {
+		return e
+	}
+	text := strings.TrimSuffix(string(lines[line-1]), "\r")
+	if token, ok := quotedToken(msg); ok && token != "" {
+		if i := strings.Index(text, token); i >= 0 {
+			e.Column = i + 1
+		}
+	}
+	if len(text) > maxErrorText {
+		text = text[:maxErrorText] + "..."
+	}
+	e.Text = text
+	return e
+}
+
+// toError converts an error of the text format parser into an Error.
+func toError(data []byte, err error) *Error {
+	var parseErr expfmt.ParseError
+	if errors.As(err, &parseErr) {
+		return newError(data, parseErr.Line, parseErr.Msg)
+	}
+	return newError(data, 0, err.Error())
+}
+
+// quotedToken returns the first Go-quoted string found in msg.
+func quotedToken(msg string) (string, bool) {
+	i := strings.IndexByte(msg, '"')
+	if i < 0 {
+		return "", false
+	}
+	prefix, err := strconv.QuotedPrefix(msg[i:])
+	if err != nil {
+		return "", false
+	}
+	token, err := strconv.Unquote(prefix)
+	return token, err == nil
+}
+
+// categoryRules maps substrings of the messages of both parsers to
+// categories. The first match wins.
+var categoryRules = []struct {
+	substr   string
+	category string
+}{
+	{"second TYPE", CategoryDuplicateMetadata},
+	{"second HELP", CategoryDuplicateMetadata},
+	{"second UNIT", CategoryDuplicateMetadata},
+	{"defined twice", CategoryDuplicateMetadata},
+	{"after its samples", CategoryDuplicateMetadata},
+	{"duplicate series", CategoryDuplicateSeries},
+	{"metric type", CategoryBadType},
+	{"for a metric of type", CategoryBadType},
+	{"has no _total sample", CategoryBadType},
+	{"is not a suffix", CategoryBadType},
+	{"exemplars are only allowed", CategoryBadType},
+	{"as value", CategoryInvalidValue},
+	{"invalid value", CategoryInvalidValue},
+	{"counter value", CategoryInvalidValue},
+	{"invalid quantile", CategoryInvalidValue},
+	{"invalid le", CategoryInvalidValue},
+	{"timestamp", CategoryInvalidValue},
+	{"label", CategoryInvalidLabel},
+	{"metric name", CategoryInvalidName},
+}
+
+// categorize returns the category of a parse error message.
+func categorize(msg string) string {
+	for _, rule := range categoryRules {
+		if strings.Contains(msg, rule.substr) {
+			return rule.category
+		}
+	}
+	return CategorySyntax
+}
+
+// checkDuplicates returns an error for each series that appears again in
+// data, in the Prometheus text format. Lines that do not follow the canonical
+// `name{labels} value [timestamp]` layout are not checked.
+func checkDuplicates(data []byte) []*Error {
+	var errs []*Error
+	seen := make(map[string]int)
+	for i, raw := range bytes.Split(data, []byte("\n")) {
+		line := strings.TrimSuffix(string(raw), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSampleLine(line)
+		if err != nil {
+			continue
+		}
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].GetName() < s.labels[j].GetName() })
+		key := s.name + "\xff" + labelSignature(s.labels)
+		if first, ok := seen[key]; ok {
+			errs = append(errs, newError(data, i+1, fmt.Sprintf("duplicate series %q, first seen on line %d", s.name, first)))
+			continue
+		}
+		seen[key] = i + 1
+	}
+	return errs
+}
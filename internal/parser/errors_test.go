@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseDataErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		line     int
+		column   int
+		text     string
+		category string
+	}{
+		{"unterminated label value", "a 1\nb{x=\"1\" 2\n", 2, 6, `b{x="1" 2`, CategoryInvalidLabel},
+		{"invalid value", "a 1\nb abc\n", 2, 3, "b abc", CategoryInvalidValue},
+		{"invalid timestamp", "a 1 soon\n", 1, 5, "a 1 soon", CategoryInvalidValue},
+		{"invalid le", "# TYPE h histogram\nh_bucket{le=\"x\"} 1\n", 2, 14, `h_bucket{le="x"} 1`, CategoryInvalidValue},
+		{"unknown type", "# TYPE a weird\na 1\n", 1, 10, "# TYPE a weird", CategoryBadType},
+		{"TYPE after samples", "a 1\n# TYPE a counter\n", 2, 8, "# TYPE a counter", CategoryDuplicateMetadata},
+		{"second HELP", "# HELP a one\n# HELP a two\na 1\n", 2, 8, "# HELP a two", CategoryDuplicateMetadata},
+		{"invalid label name", "a{1x=\"1\"} 1\n", 1, 1, `a{1x="1"} 1`, CategoryInvalidLabel},
+		{"invalid metric name", "1a 1\n", 1, 0, "1a 1", CategoryInvalidName},
+		{"quoted metric name", "a 1\n{\"my.metric\"} 1\n", 2, 3, `{"my.metric"} 1`, CategoryInvalidName},
+		{"quoted label name", "a{\"a.b\"=\"x\"} 1\n", 1, 4, `a{"a.b"="x"} 1`, CategoryInvalidLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseData([]byte(tt.input), false)
+			var parseErr *Error
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ParseData() error = %v, want an *Error", err)
+			}
+			if parseErr.Line != tt.line || parseErr.Column != tt.column || parseErr.Text != tt.text || parseErr.Category != tt.category {
+				t.Errorf("error %q at %d:%d on %q with category %s, want %d:%d on %q with category %s",
+					parseErr.Msg, parseErr.Line, parseErr.Column, parseErr.Text, parseErr.Category,
+					tt.line, tt.column, tt.text, tt.category)
+			}
+		})
+	}
+}
+
+func TestDuplicateSeriesWarnings(t *testing.T) {
+	result, err := ParseData([]byte("a{x=\"1\"} 1\nb 2\na{x=\"1\"} 3\nb 4\n"), false)
+	if err != nil {
+		t.Fatalf("ParseData() error = %v, want duplicates to be accepted", err)
+	}
+	if len(result.Warnings) != 2 {
+		t.Fatalf("Warnings = %v, want one for each repeated series", result.Warnings)
+	}
+	if w := result.Warnings[0]; w.Line != 3 || w.Column != 1 || w.Text != `a{x="1"} 3` || w.Category != CategoryDuplicateSeries {
+		t.Errorf("Warnings[0] = %+v, want the duplicate of a on line 3", w)
+	}
+
+	// OpenMetrics forbids duplicates, so they stay an error there.
+	_, err = ParseData([]byte("a 1\na 2\n# EOF\n"), false)
+	var parseErr *Error
+	if !errors.As(err, &parseErr) || parseErr.Category != CategoryDuplicateSeries {
+		t.Errorf("ParseData() of OpenMetrics error = %v, want a duplicate series", err)
+	}
+}
+
+func TestErrorText(t *testing.T) {
+	long := "a{x=\"" + strings.Repeat("v", 2*maxErrorText) + "\"} abc"
+	_, err := ParseData([]byte(long+"\n"), false)
+	var parseErr *Error
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("ParseData() error = %v, want an *Error", err)
+	}
+	if want := long[:maxErrorText] + "..."; parseErr.Text != want {
+		t.Errorf("text = %q, want it truncated to %d bytes", parseErr.Text, maxErrorText)
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	tests := []struct {
+		err  Error
+		want string
+	}{
+		{Error{File: "/d/a.prom", Line: 3, Column: 5, Msg: "bad"}, "/d/a.prom:3:5: bad"},
+		{Error{File: "/d/a.prom", Line: 3, Msg: "bad"}, "/d/a.prom:3: bad"},
+		{Error{File: "/d/a.prom", Msg: "bad"}, "/d/a.prom: bad"},
+		{Error{Line: 3, Column: 5, Msg: "bad"}, "line 3:5: bad"},
+		{Error{Msg: "bad"}, "bad"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestQuotedNamesRejectedByBothParsers(t *testing.T) {
+	for _, input := range []string{
+		"{\"my.metric\",\"a.b\"=\"x\"} 1\n",
+		"my_metric{\"a.b\"=\"x\"} 1\n",
+	} {
+		for _, openMetrics := range []bool{false, true} {
+			data := input
+			if openMetrics {
+				data += "# EOF\n"
+			}
+			if result, err := ParseData([]byte(data), false); err == nil {
+				t.Errorf("ParseData(%q) = %v, want an error", data, result.Families)
+			}
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// omSuffixes lists the sample name suffixes allowed for each OpenMetrics type.
+var omSuffixes = map[string][]string{
+	"counter":   {"_total", "_created"},
+	"gauge":     {""},
+	"histogram": {"_bucket", "_count", "_sum", "_created"},
+	"summary":   {"", "_count", "_sum", "_created"},
+	"info":      {"_info"},
+	"stateset":  {""},
+	"unknown":   {""},
+}
+
+// omFamily accumulates the samples of one OpenMetrics metric family.
+type omFamily struct {
+	name       string
+	typ        string
+	help       *string
+	unit       string
+	hasSamples bool
+	mf         *dto.MetricFamily
+	metrics    map[string]*dto.Metric
+	// samples holds the name and labels of the samples seen so far, to
+	// reject duplicates.
+	samples map[string]bool
+}
+
+// omSample is a single parsed sample line.
+type omSample struct {
+	name      string
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp *int64
+	exemplar  *dto.Exemplar
+}
+
+// ParseOpenMetrics parses data in the OpenMetrics text format into metric
+// families. The returned map is keyed by the name the families are exposed
+// under in the classic text format: counters get their "_total" suffix back
+// and info metrics their "_info" suffix. Units are returned separately, keyed
+// the same way, since dto.MetricFamily cannot carry them.
+//
+// Info and stateset families are converted to gauges. Gauge histograms are
+// rejected, since they cannot be exported. Errors are returned as *Error.
+func ParseOpenMetrics(data []byte) (map[string]*dto.MetricFamily, map[string]string, error) {
+	p := omParser{families: make(map[string]*omFamily)}
+	lines := bytes.Split(data, []byte("\n"))
+	eof := false
+	for i, raw := range lines {
+		line := string(raw)
+		if eof {
+			if line != "" || i != len(lines)-1 {
+				return nil, nil, newError(data, i+1, "unexpected content after # EOF")
+			}
+			continue
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if err := p.parseLine(line); err != nil {
+			return nil, nil, newError(data, i+1, err.Error())
+		}
+	}
+	if !eof {
+		return nil, nil, newError(data, len(lines), "missing # EOF")
+	}
+	families, units, err := p.result()
+	if err != nil {
+		return nil, nil, newError(data, 0, err.Error())
+	}
+	return families, units, nil
+}
+
+type omParser struct {
+	families map[string]*omFamily
+	order    []*omFamily
+	current  *omFamily
+}
+
+func (p *omParser) parseLine(line string) error {
+	if line == "" {
+		return nil
+	}
+	if strings.HasPrefix(line, "#") {
+		return p.parseComment(line)
+	}
+	return p.parseSample(line)
+}
+
+// parseComment handles the TYPE, HELP and UNIT metadata lines. Any other
+// comment is ignored.
+func (p *omParser) parseComment(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return nil
+	}
+	kind, name := fields[1], fields[2]
+	if kind != "TYPE" && kind != "HELP" && kind != "UNIT" {
+		return nil
+	}
+	if !isValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q in %s line", name, kind)
+	}
+	value := ""
+	if len(fields) == 4 {
+		value = fields[3]
+	}
+
+	fam := p.family(name)
+	if fam.hasSamples {
+		return fmt.Errorf("%s line for %s after its samples", kind, name)
+	}
+	switch kind {
+	case "TYPE":
+		if fam.typ != "" {
+			return fmt.Errorf("second TYPE line for %s", name)
+		}
+		if value == "gaugehistogram" {
+			return fmt.Errorf("metric type %q of %s is not supported", value, name)
+		}
+		if _, ok := omSuffixes[value]; !ok {
+			return fmt.Errorf("invalid metric type %q for %s", value, name)
+		}
+		fam.typ = value
+	case "HELP":
+		if fam.help != nil {
+			return fmt.Errorf("second HELP line for %s", name)
+		}
+		help, err := unescape(value)
+		if err != nil {
+			return fmt.Errorf("invalid HELP for %s: %w", name, err)
+		}
+		fam.help = &help
+	case "UNIT":
+		if fam.unit != "" {
+			return fmt.Errorf("second UNIT line for %s", name)
+		}
+		if value != "" && !strings.HasSuffix(name, "_"+value) {
+			return fmt.Errorf("unit %q is not a suffix of %s", value, name)
+		}
+		fam.unit = value
+	}
+	p.current = fam
+	return nil
+}
+
+// family returns the family called name, creating it if needed.
+func (p *omParser) family(name string) *omFamily {
+	fam, ok := p.families[name]
+	if !ok {
+		fam = &omFamily{name: name, metrics: make(map[string]*dto.Metric), samples: make(map[string]bool)}
+		p.families[name] = fam
+		p.order = append(p.order, fam)
+	}
+	return fam
+}
+
+// familyFor finds the family a sample belongs to and returns it with the
+// suffix of the sample name. Samples that match no declared family start an
+// unknown-typed family of their own.
+func (p *omParser) familyFor(name string) (*omFamily, string, error) {
+	if p.current != nil {
+		if suffix, ok := p.current.match(name); ok {
+			return p.current, suffix, nil
+		}
+	}
+	for _, fam := range p.order {
+		if suffix, ok := fam.match(name); ok {
+			return fam, suffix, nil
+		}
+	}
+	if fam, ok := p.families[name]; ok {
+		return nil, "", fmt.Errorf("sample %s is not valid for a metric of type %s", name, fam.omType())
+	}
+	return p.family(name), "", nil
+}
+
+// match reports whether a sample name belongs to the family and returns the
+// suffix it carries.
+func (fam *omFamily) match(name string) (string, bool) {
+	if !strings.HasPrefix(name, fam.name) {
+		return "", false
+	}
+	suffix := name[len(fam.name):]
+	for _, s := range omSuffixes[fam.omType()] {
+		if s == suffix {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+func (fam *omFamily) omType() string {
+	if fam.typ == "" {
+		return "unknown"
+	}
+	return fam.typ
+}
+
+func (p *omParser) parseSample(line string) error {
+	s, err := parseSampleLine(line)
+	if err != nil {
+		return err
+	}
+	fam, suffix, err := p.familyFor(s.name)
+	if err != nil {
+		return err
+	}
+	fam.hasSamples = true
+	p.current = fam
+	return fam.add(suffix, s)
+}
+
+// add stores a sample in the dto.Metric it belongs to.
+func (fam *omFamily) add(suffix string, s *omSample) error {
+	typ := fam.omType()
+	if fam.mf == nil {
+		fam.mf = &dto.MetricFamily{Name: proto.String(fam.name)}
+	}
+
+	// Histogram buckets and summary quantiles share a dto.Metric with the
+	// other samples of the same series, so they are grouped without their le
+	// or quantile label.
+	var special string
+	switch {
+	case typ == "histogram" && suffix == "_bucket":
+		special = "le"
+	case typ == "summary" && suffix == "":
+		special = "quantile"
+	}
+	labels := make([]*dto.LabelPair, 0, len(s.labels))
+	var specialValue *string
+	for _, l := range s.labels {
+		if special != "" && l.GetName() == special {
+			specialValue = l.Value
+			continue
+		}
+		labels = append(labels, l)
+	}
+	if special != "" && specialValue == nil {
+		return fmt.Errorf("sample %s is missing the %s label", s.name, special)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+	sig := labelSignature(labels)
+	sample := s.name + "\xff" + sig
+	if specialValue != nil {
+		sample += special + "\xff" + *specialValue
+	}
+	if fam.samples[sample] {
+		return fmt.Errorf("duplicate series %q with the same labels", s.name)
+	}
+	fam.samples[sample] = true
+	m, ok := fam.metrics[sig]
+	if !ok {
+		m = &dto.Metric{Label: labels}
+		fam.metrics[sig] = m
+		fam.mf.Metric = append(fam.mf.Metric, m)
+	}
+	if s.timestamp != nil {
+		m.TimestampMs = s.timestamp
+	}
+	if s.exemplar != nil && !(typ == "counter" && suffix == "_total") && suffix != "_bucket" {
+		return fmt.Errorf("exemplars are only allowed on counters and histogram buckets, found one on %s", s.name)
+	}
+
+	switch typ {
+	case "counter":
+		if m.Counter == nil {
+			m.Counter = &dto.Counter{}
+		}
+		switch suffix {
+		case "_total":
+			if s.value < 0 || math.IsNaN(s.value) {
+				return fmt.Errorf("invalid counter value %v for %s", s.value, s.name)
+			}
+			m.Counter.Value = proto.Float64(s.value)
+			m.Counter.Exemplar = s.exemplar
+		case "_created":
+			m.Counter.CreatedTimestamp = secondsToTimestamp(s.value)
+		}
+	case "gauge", "stateset", "info":
+		m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+	case "unknown":
+		m.Untyped = &dto.Untyped{Value: proto.Float64(s.value)}
+	case "summary":
+		if m.Summary == nil {
+			m.Summary = &dto.Summary{}
+		}
+		switch suffix {
+		case "":
+			q, err := strconv.ParseFloat(*specialValue, 64)
+			if err != nil {
+				return fmt.Errorf("invalid quantile %q for %s", *specialValue, s.name)
+			}
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(s.value)})
+		case "_count":
+			count, err := countValue(s)
+			if err != nil {
+				return err
+			}
+			m.Summary.SampleCount = proto.Uint64(count)
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(s.value)
+		case "_created":
+			m.Summary.CreatedTimestamp = secondsToTimestamp(s.value)
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			m.Histogram = &dto.Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			le, err := strconv.ParseFloat(*specialValue, 64)
+			if err != nil {
+				return fmt.Errorf("invalid le %q for %s", *specialValue, s.name)
+			}
+			count, err := countValue(s)
+			if err != nil {
+				return err
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(le),
+				CumulativeCount: proto.Uint64(count),
+				Exemplar:        s.exemplar,
+			})
+		case "_count":
+			count, err := countValue(s)
+			if err != nil {
+				return err
+			}
+			m.Histogram.SampleCount = proto.Uint64(count)
+		case "_sum":
+			m.Histogram.SampleSum = proto.Float64(s.value)
+		case "_created":
+			m.Histogram.CreatedTimestamp = secondsToTimestamp(s.value)
+		}
+	}
+	return nil
+}
+
+// countValue returns the value of a _count or _bucket sample, which must be a
+// non-negative integer.
+func countValue(s *omSample) (uint64, error) {
+	if s.value < 0 || s.value != math.Trunc(s.value) || math.IsInf(s.value, 0) {
+		return 0, fmt.Errorf("invalid value %v for %s, expected a non-negative integer count", s.value, s.name)
+	}
+	return uint64(s.value), nil
+}
+
+// result converts the accumulated families into the classic text format
+// naming and types.
+func (p *omParser) result() (map[string]*dto.MetricFamily, map[string]string, error) {
+	families := make(map[string]*dto.MetricFamily, len(p.order))
+	units := make(map[string]string)
+	for _, fam := range p.order {
+		if fam.mf == nil {
+			continue
+		}
+		name := fam.name
+		switch fam.omType() {
+		case "counter":
+			name += "_total"
+			fam.mf.Type = dto.MetricType_COUNTER.Enum()
+			for _, m := range fam.mf.Metric {
+				if m.Counter.Value == nil {
+					return nil, nil, fmt.Errorf("counter %s has no _total sample", fam.name)
+				}
+			}
+		case "gauge", "stateset":
+			fam.mf.Type = dto.MetricType_GAUGE.Enum()
+		case "info":
+			name += "_info"
+			fam.mf.Type = dto.MetricType_GAUGE.Enum()
+		case "unknown":
+			fam.mf.Type = dto.MetricType_UNTYPED.Enum()
+		case "summary":
+			fam.mf.Type = dto.MetricType_SUMMARY.Enum()
+		case "histogram":
+			fam.mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		}
+		if _, ok := families[name]; ok {
+			return nil, nil, fmt.Errorf("metric family %s defined twice", name)
+		}
+		fam.mf.Name = proto.String(name)
+		fam.mf.Help = fam.help
+		families[name] = fam.mf
+		if fam.unit != "" {
+			units[name] = fam.unit
+		}
+	}
+	return families, units, nil
+}
+
+// parseSampleLine parses `name{labels} value [timestamp] [# {labels} value [timestamp]]`.
+func parseSampleLine(line string) (*omSample, error) {
+	s := &omSample{}
+	i := 0
+	for i < len(line) && isNameChar(line[i], i == 0) {
+		i++
+	}
+	s.name = line[:i]
+	if s.name == "" {
+		return nil, fmt.Errorf("invalid sample line %q", line)
+	}
+	rest := line[i:]
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		s.labels = labels
+		rest = rest[n:]
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("%s: expected a space before the value", s.name)
+	}
+	rest = rest[1:]
+
+	var exemplar string
+	if j := strings.Index(rest, " # "); j >= 0 {
+		rest, exemplar = rest[:j], rest[j+3:]
+	}
+	fields := strings.Split(rest, " ")
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("%s: unexpected content %q", s.name, rest)
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid value %q", s.name, fields[0])
+	}
+	s.value = value
+	if len(fields) == 2 {
+		ts, err := parseFloat(fields[1])
+		if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return nil, fmt.Errorf("%s: invalid timestamp %q", s.name, fields[1])
+		}
+		ms := int64(math.Round(ts * 1000))
+		s.timestamp = &ms
+	}
+	if exemplar != "" {
+		if s.exemplar, err = parseExemplar(exemplar); err != nil {
+			return nil, fmt.Errorf("%s: invalid exemplar: %w", s.name, err)
+		}
+	}
+	return s, nil
+}
+
+// parseExemplar parses `{labels} value [timestamp]`.
+func parseExemplar(text string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("expected label set, found %q", text)
+	}
+	labels, n, err := parseLabels(text)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimPrefix(text[n:], " "), " ")
+	if len(fields) > 2 || fields[0] == "" {
+		return nil, fmt.Errorf("unexpected content %q", text[n:])
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+	e := &dto.Exemplar{Label: labels, Value: proto.Float64(value)}
+	if len(fields) == 2 {
+		ts, err := parseFloat(fields[1])
+		if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return nil, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		e.Timestamp = secondsToTimestamp(ts)
+	}
+	return e, nil
+}
+
+// parseLabels parses a `{name="value",...}` label set at the start of text
+// and returns the labels and the number of bytes consumed.
+func parseLabels(text string) ([]*dto.LabelPair, int, error) {
+	var labels []*dto.LabelPair
+	seen := make(map[string]bool)
+	i := 1
+	for {
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated label set")
+		}
+		if text[i] == '}' {
+			return labels, i + 1, nil
+		}
+		start := i
+		for i < len(text) && isNameChar(text[i], i == start) && text[i] != ':' {
+			i++
+		}
+		name := text[start:i]
+		if name == "" || !strings.HasPrefix(text[i:], "=\"") {
+			return nil, 0, fmt.Errorf("invalid label name at %q", text[start:])
+		}
+		if seen[name] {
+			return nil, 0, fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+		i += 2
+
+		var value strings.Builder
+		for {
+			if i >= len(text) {
+				return nil, 0, fmt.Errorf("unterminated value for label %q", name)
+			}
+			c := text[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' {
+				if i+1 >= len(text) {
+					return nil, 0, fmt.Errorf("unterminated value for label %q", name)
+				}
+				switch text[i+1] {
+				case '\\':
+					value.WriteByte('\\')
+				case '"':
+					value.WriteByte('"')
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return nil, 0, fmt.Errorf("invalid escape sequence in label %q", name)
+				}
+				i += 2
+				continue
+			}
+			value.WriteByte(c)
+			i++
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value.String())})
+
+		if i < len(text) && text[i] == ',' {
+			i++
+		} else if i < len(text) && text[i] != '}' {
+			return nil, 0, fmt.Errorf("expected ',' or '}' after label %q", name)
+		}
+	}
+}
+
+// unescape resolves the escape sequences allowed in HELP text.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		i++
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case '"':
+			b.WriteByte('"')
+		default:
+			return "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func parseFloat(s string) (float64, error) {
+	// Reject forms strconv accepts but OpenMetrics does not, such as hex
+	// floats or underscores.
+	if strings.ContainsAny(s, "xX_pP") {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func secondsToTimestamp(seconds float64) *timestamppb.Timestamp {
+	sec, frac := math.Modf(seconds)
+	return timestamppb.New(time.Unix(int64(sec), int64(math.Round(frac*1e9))))
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func isValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelSignature builds a key identifying a sorted label set.
+func labelSignature(labels []*dto.LabelPair) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.GetName())
+		b.WriteByte(0)
+		b.WriteString(l.GetValue())
+		b.WriteByte(0)
+	}
+	return b.String()
+}
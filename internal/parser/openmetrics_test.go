@@ -0,0 +1,311 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		check func(t *testing.T, families map[string]*dto.MetricFamily, units map[string]string)
+	}{
+		{
+			name: "counter with created and exemplar",
+			input: `# TYPE requests counter
+# HELP requests Requests served.
+requests_total{code="200"} 10 1700000000.5 # {trace_id="abc"} 1 1699999999
+requests_created{code="200"} 1600000000.25
+# EOF
+`,
+			check: func(t *testing.T, families map[string]*dto.MetricFamily, _ map[string]string) {
+				mf := families["requests_total"]
+				if mf == nil || mf.GetType() != dto.MetricType_COUNTER || mf.GetHelp() != "Requests served." {
+					t.Fatalf("requests_total = %v, want a counter with its help", mf)
+				}
+				m := mf.Metric[0]
+				if m.GetCounter().GetValue() != 10 || m.GetTimestampMs() != 1700000000500 {
+					t.Errorf("value, timestamp = %v, %d", m.GetCounter().GetValue(), m.GetTimestampMs())
+				}
+				if got, want := m.GetCounter().GetCreatedTimestamp().AsTime(), time.Unix(1600000000, 250000000); !got.Equal(want) {
+					t.Errorf("created = %v, want %v", got, want)
+				}
+				e := m.GetCounter().GetExemplar()
+				if e.GetValue() != 1 || len(e.Label) != 1 || e.Label[0].GetValue() != "abc" || e.GetTimestamp().AsTime().Unix() != 1699999999 {
+					t.Errorf("exemplar = %v", e)
+				}
+			},
+		},
+		{
+			name: "histogram",
+			input: `# TYPE latency_seconds histogram
+# UNIT latency_seconds seconds
+latency_seconds_bucket{le="0.5"} 1 # {trace_id="x"} 0.3
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_count 3
+latency_seconds_sum 2.5
+latency_seconds_created 1600000000
+# EOF`,
+			check: func(t *testing.T, families map[string]*dto.MetricFamily, units map[string]string) {
+				mf := families["latency_seconds"]
+				if mf.GetType() != dto.MetricType_HISTOGRAM {
+					t.Fatalf("type = %v, want histogram", mf.GetType())
+				}
+				h := mf.Metric[0].GetHistogram()
+				if h.GetSampleCount() != 3 || h.GetSampleSum() != 2.5 || len(h.Bucket) != 2 {
+					t.Errorf("histogram = %v", h)
+				}
+				if h.Bucket[0].GetExemplar().GetValue() != 0.3 {
+					t.Errorf("bucket exemplar = %v, want 0.3", h.Bucket[0].GetExemplar())
+				}
+				if h.GetCreatedTimestamp().AsTime().Unix() != 1600000000 {
+					t.Errorf("created = %v", h.GetCreatedTimestamp())
+				}
+				if units["latency_seconds"] != "seconds" {
+					t.Errorf("units = %v, want seconds", units)
+				}
+			},
+		},
+		{
+			name: "summary",
+			input: `# TYPE rpc summary
+rpc{quantile="0.9"} 4
+rpc_count 7
+rpc_sum 20
+# EOF
+`,
+			check: func(t *testing.T, families map[string]*dto.MetricFamily, _ map[string]string) {
+				s := families["rpc"].Metric[0].GetSummary()
+				if s.GetSampleCount() != 7 || s.GetSampleSum() != 20 || len(s.Quantile) != 1 || s.Quantile[0].GetValue() != 4 {
+					t.Errorf("summary = %v", s)
+				}
+			},
+		},
+		{
+			name: "info, stateset and unknown",
+			input: `# TYPE build info
+build_info{version="1.2"} 1
+# TYPE state stateset
+state{state="a"} 1
+state{state="b"} 0
+other 3
+# EOF
+`,
+			check: func(t *testing.T, families map[string]*dto.MetricFamily, _ map[string]string) {
+				if mf := families["build_info"]; mf.GetType() != dto.MetricType_GAUGE {
+					t.Errorf("build_info = %v, want a gauge", mf)
+				}
+				if mf := families["state"]; mf.GetType() != dto.MetricType_GAUGE || len(mf.Metric) != 2 {
+					t.Errorf("state = %v, want two gauges", mf)
+				}
+				if mf := families["other"]; mf.GetType() != dto.MetricType_UNTYPED || mf.Metric[0].GetUntyped().GetValue() != 3 {
+					t.Errorf("other = %v, want untyped 3", mf)
+				}
+			},
+		},
+		{
+			name: "escaping",
+			input: `# HELP g A "quoted" \\ help\nwith two lines.
+# TYPE g gauge
+g{path="C:\\dir",msg="say \"hi\"\n"} 1
+# EOF
+`,
+			check: func(t *testing.T, families map[string]*dto.MetricFamily, _ map[string]string) {
+				mf := families["g"]
+				if got, want := mf.GetHelp(), "A \"quoted\" \\ help\nwith two lines."; got != want {
+					t.Errorf("help = %q, want %q", got, want)
+				}
+				labels := map[string]string{}
+				for _, l := range mf.Metric[0].Label {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["path"] != `C:\dir` || labels["msg"] != "say \"hi\"\n" {
+					t.Errorf("labels = %q", labels)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			families, units, err := ParseOpenMetrics([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, families, units)
+		})
+	}
+}
+
+func TestParseOpenMetricsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		line     int
+		column   int
+		category string
+	}{
+		{
+			name:     "missing EOF",
+			input:    "a 1\n",
+			line:     2,
+			category: CategorySyntax,
+		},
+		{
+			name:     "content after EOF",
+			input:    "a 1\n# EOF\nb 2\n",
+			line:     3,
+			category: CategorySyntax,
+		},
+		{
+			name:     "gauge histogram",
+			input:    "# TYPE q gaugehistogram\nq_bucket{le=\"+Inf\"} 1\nq_gcount 1\n# EOF\n",
+			line:     1,
+			column:   10,
+			category: CategoryBadType,
+		},
+		{
+			name:     "negative bucket count",
+			input:    "# TYPE h histogram\nh_bucket{le=\"+Inf\"} -1\n# EOF\n",
+			line:     2,
+			category: CategoryInvalidValue,
+		},
+		{
+			name:     "NaN histogram count",
+			input:    "# TYPE h histogram\nh_bucket{le=\"+Inf\"} 1\nh_count NaN\n# EOF\n",
+			line:     3,
+			category: CategoryInvalidValue,
+		},
+		{
+			name:     "fractional summary count",
+			input:    "# TYPE s summary\ns_count 1.5\n# EOF\n",
+			line:     2,
+			category: CategoryInvalidValue,
+		},
+		{
+			name:     "negative counter",
+			input:    "# TYPE c counter\nc_total -1\n# EOF\n",
+			line:     2,
+			category: CategoryInvalidValue,
+		},
+		{
+			name:     "counter without _total",
+			input:    "# TYPE c counter\nc_created 1\n# EOF\n",
+			category: CategoryBadType,
+		},
+		{
+			name:     "counter sample without suffix",
+			input:    "# TYPE c counter\nc 1\n# EOF\n",
+			line:     2,
+			category: CategoryBadType,
+		},
+		{
+			name:     "exemplar on a gauge",
+			input:    "# TYPE g gauge\ng 1 # {a=\"b\"} 1\n# EOF\n",
+			line:     2,
+			category: CategoryBadType,
+		},
+		{
+			name:     "unknown type",
+			input:    "# TYPE g weird\n# EOF\n",
+			line:     1,
+			column:   10,
+			category: CategoryBadType,
+		},
+		{
+			name:     "unit not a suffix",
+			input:    "# TYPE g gauge\n# UNIT g seconds\n# EOF\n",
+			line:     2,
+			column:   10,
+			category: CategoryBadType,
+		},
+		{
+			name:     "second TYPE",
+			input:    "# TYPE g gauge\n# TYPE g counter\n# EOF\n",
+			line:     2,
+			category: CategoryDuplicateMetadata,
+		},
+		{
+			name:     "HELP after samples",
+			input:    "# TYPE g gauge\ng 1\n# HELP g late\n# EOF\n",
+			line:     3,
+			category: CategoryDuplicateMetadata,
+		},
+		{
+			name:     "duplicate series",
+			input:    "g{a=\"1\"} 1\ng{a=\"1\"} 2\n# EOF\n",
+			line:     2,
+			column:   1,
+			category: CategoryDuplicateSeries,
+		},
+		{
+			name:     "invalid escape",
+			input:    "g{a=\"\\t\"} 1\n# EOF\n",
+			line:     1,
+			column:   3,
+			category: CategoryInvalidLabel,
+		},
+		{
+			name:     "duplicate label",
+			input:    "g{a=\"1\",a=\"2\"} 1\n# EOF\n",
+			line:     1,
+			column:   3,
+			category: CategoryInvalidLabel,
+		},
+		{
+			name:     "invalid value",
+			input:    "g 0x1\n# EOF\n",
+			line:     1,
+			column:   3,
+			category: CategoryInvalidValue,
+		},
+		{
+			name:     "invalid timestamp",
+			input:    "g 1 soon\n# EOF\n",
+			line:     1,
+			column:   5,
+			category: CategoryInvalidValue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseOpenMetrics([]byte(tt.input))
+			var parseErr *Error
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("ParseOpenMetrics() error = %v, want an *Error", err)
+			}
+			if parseErr.Line != tt.line || parseErr.Column != tt.column || parseErr.Category != tt.category {
+				t.Errorf("error %q at %d:%d with category %s, want %d:%d with category %s",
+					parseErr.Msg, parseErr.Line, parseErr.Column, parseErr.Category, tt.line, tt.column, tt.category)
+			}
+		})
+	}
+}
+
+func TestParseDataDetectsOpenMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		openMetrics bool
+		want        bool
+	}{
+		{"text", "a 1\n", false, false},
+		{"EOF trailer", "a 1\n# EOF\n", false, true},
+		{"EOF trailer without newline", "a 1\n# EOF", false, true},
+		{"om extension", "a 1\n# EOF\n", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseData([]byte(tt.input), tt.openMetrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.OpenMetrics != tt.want {
+				t.Errorf("OpenMetrics = %v, want %v", result.OpenMetrics, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,56 @@
 package parser
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
 )
 
-// ParseMF reads a file in the Prometheus text exposition format and parses it
-// into a map of MetricFamily protocol buffer items.
-func ParseMF(path string) (map[string]*dto.MetricFamily, error) {
+// Result is the content of a parsed metrics file.
+type Result struct {
+	Families map[string]*dto.MetricFamily
+	// Units maps family names to the unit declared with "# UNIT". It is only
+	// filled for OpenMetrics input.
+	Units map[string]string
+	// OpenMetrics is true if the file was parsed as OpenMetrics.
+	OpenMetrics bool
+	// Warnings lists the problems that did not fail the parse, such as a
+	// series that appears twice in the Prometheus text format, in which case
+	// the last sample wins.
+	Warnings []*Error
+}
+
+// Parse reads a file in the Prometheus text exposition format or in the
+// OpenMetrics text format. OpenMetrics is assumed for files with the .om
+// extension and for files ending with the "# EOF" trailer. Errors are
+// returned as *Error, with File set to path.
+func Parse(path string) (*Result, error) {
+	result, err := parse(path)
+	if err != nil {
+		var parseErr *Error
+		if !errors.As(err, &parseErr) {
+			parseErr = &Error{Category: CategoryRead, Msg: err.Error()}
+		}
+		parseErr.File = path
+		return nil, parseErr
+	}
+	for _, warning := range result.Warnings {
+		warning.File = path
+	}
+	return result, nil
+}
+
+func parse(path string) (*Result, error) {
 	path = filepath.Clean(path)
 	if !filepath.IsAbs(path) {
 		path = filepath.Clean(string(os.PathSeparator) + path)
@@ -18,16 +58,173 @@ func ParseMF(path string) (map[string]*dto.MetricFamily, error) {
 	}
 	path = filepath.Clean(path)
 
-	reader, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer reader.Close()
+
+	return ParseData(data, strings.HasSuffix(path, ".om"))
+}
+
+// ParseData parses metrics that were not read from a file, such as the body
+// of a push. The data is parsed as OpenMetrics if openMetrics is true or if it
+// ends with the "# EOF" trailer, and in the Prometheus text format otherwise.
+// Errors are returned as *Error. A metric or label name that is not a valid
+// legacy Prometheus name is an error, even when quoted. A series that appears
+// twice is an error in OpenMetrics, and only a warning in the Prometheus text
+// format, which the exporter has always accepted. The directives of "# TFE"
+// comments are turned into reserved labels of the series they apply to, see
+// DirectiveLabelPrefix.
+func ParseData(data []byte, openMetrics bool) (*Result, error) {
+	if openMetrics || IsOpenMetrics(data) {
+		families, units, err := ParseOpenMetrics(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := applyDirectives(data, families); err != nil {
+			return nil, err
+		}
+		return &Result{Families: families, Units: units, OpenMetrics: true}, nil
+	}
 
 	var parser expfmt.TextParser
-	mf, err := parser.TextToMetricFamilies(reader)
+	mf, err := parser.TextToMetricFamilies(bytes.NewReader(data))
 	if err != nil {
+		return nil, toError(data, err)
+	}
+	if err := checkNames(data, mf); err != nil {
+		return nil, err
+	}
+	if err := applyDirectives(data, mf); err != nil {
 		return nil, err
 	}
-	return mf, nil
+	return &Result{Families: mf, Warnings: checkDuplicates(data)}, nil
+}
+
+// checkNames returns an error for the first metric or label name of families,
+// by family name, that is not a valid legacy Prometheus name. The text format
+// parser accepts quoted UTF-8 names, which the OpenMetrics parser rejects and
+// the rest of the exporter does not support.
+func checkNames(data []byte, families map[string]*dto.MetricFamily) *Error {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !model.IsValidLegacyMetricName(name) {
+			return newError(data, lineOf(data, strconv.Quote(name)), fmt.Sprintf("invalid metric name %q", name))
+		}
+		for _, m := range families[name].GetMetric() {
+			for _, l := range m.GetLabel() {
+				if !model.LabelName(l.GetName()).IsValidLegacy() {
+					return newError(data, lineOf(data, strconv.Quote(l.GetName())), fmt.Sprintf("invalid label name %q", l.GetName()))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lineOf returns the number, from 1, of the first line of data that contains
+// token, or 0 if none does.
+func lineOf(data []byte, token string) int {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.Contains(line, []byte(token)) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Clone returns a deep copy of r, which can be modified without changing r.
+func (r *Result) Clone() *Result {
+	clone := &Result{
+		Families:    make(map[string]*dto.MetricFamily, len(r.Families)),
+		Units:       make(map[string]string, len(r.Units)),
+		OpenMetrics: r.OpenMetrics,
+	}
+	for name, mf := range r.Families {
+		clone.Families[name] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	for name, unit := range r.Units {
+		clone.Units[name] = unit
+	}
+	return clone
+}
+
+// SetLabels sets labels on every series of r, replacing the values of the
+// labels with the same name.
+func (r *Result) SetLabels(labels map[string]string) {
+	r.setLabels(labels, true)
+}
+
+// AddLabels sets labels on every series of r that does not have them yet.
+// Labels already present keep their value.
+func (r *Result) AddLabels(labels map[string]string) {
+	r.setLabels(labels, false)
+}
+
+// ConflictingLabel returns the first series of r, by family name, that has
+// one of labels with another value, along with the name of that label.
+func (r *Result) ConflictingLabel(labels map[string]string) (family, name string, ok bool) {
+	names := make([]string, 0, len(r.Families))
+	for name := range r.Families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, family := range names {
+		for _, m := range r.Families[family].GetMetric() {
+			for _, l := range m.GetLabel() {
+				if value, ok := labels[l.GetName()]; ok && value != l.GetValue() {
+					return family, l.GetName(), true
+				}
+			}
+		}
+	}
+	return "", "", false
+}
+
+func (r *Result) setLabels(labels map[string]string, override bool) {
+	for _, mf := range r.Families {
+		for _, m := range mf.GetMetric() {
+			pairs := make([]*dto.LabelPair, 0, len(m.GetLabel())+len(labels))
+			present := make(map[string]bool, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				present[l.GetName()] = true
+				if _, ok := labels[l.GetName()]; !ok || !override {
+					pairs = append(pairs, l)
+				}
+			}
+			for name, value := range labels {
+				if present[name] && !override {
+					continue
+				}
+				name, value := name, value
+				pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+			m.Label = pairs
+		}
+	}
+}
+
+// ParseMF reads a file in the Prometheus text exposition format (or in the
+// OpenMetrics text format, see Parse) and parses it into a map of
+// MetricFamily protocol buffer items.
+func ParseMF(path string) (map[string]*dto.MetricFamily, error) {
+	result, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return result.Families, nil
+}
+
+// IsOpenMetrics reports whether data ends with the OpenMetrics "# EOF" line.
+func IsOpenMetrics(data []byte) bool {
+	data = bytes.TrimRight(data, "\n")
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return string(data) == "# EOF"
 }
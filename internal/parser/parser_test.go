@@ -0,0 +1,28 @@
+package parser
+
+import "testing"
+
+func TestResultClone(t *testing.T) {
+	result, err := ParseData([]byte("# TYPE a_bytes gauge\n# UNIT a_bytes bytes\na_bytes{x=\"1\"} 1\n# EOF\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := result.Clone()
+	clone.SetLabels(map[string]string{"x": "2"})
+	clone.Units["a_bytes"] = "seconds"
+	delete(clone.Families, "a_bytes")
+
+	mf, ok := result.Families["a_bytes"]
+	if !ok {
+		t.Fatal("deleting a family of the clone deleted it from the original")
+	}
+	if got := mf.Metric[0].Label[0].GetValue(); got != "1" {
+		t.Errorf("label of the original = %q, want 1", got)
+	}
+	if got := result.Units["a_bytes"]; got != "bytes" {
+		t.Errorf("unit of the original = %q, want bytes", got)
+	}
+	if !clone.OpenMetrics {
+		t.Error("clone is not OpenMetrics")
+	}
+}
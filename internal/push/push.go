@@ -0,0 +1,463 @@
+package push
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/parser"
+	"textfile_exporter/internal/relabel"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// PathPrefix is the path under which the push API is served. Pushes go to
+// PathPrefix + "job/<job>{/<label>/<value>}", like with the Pushgateway.
+const PathPrefix = "/metrics/"
+
+// Config holds the settings of a Handler.
+//
+// - PersistDir: If not empty, every group of pushed metrics is also written to
+// a .prom file in this directory, which Restore reads back after a restart. It
+// must not be scanned as a textfile directory.
+// - MaxBodySize: The largest accepted request body, in bytes. Larger pushes
+// are rejected with 413 Request Entity Too Large. If zero, there is no limit.
+//
+// Relabel holds the relabeling rules applied to the pushed series.
+//
+// - TimestampPolicy: What happens to the pushed samples that have a timestamp.
+// With collector.TimestampMtime, the time of the push is used.
+// - TimestampMaxAge and TimestampMaxFuture: The window of
+// collector.TimestampClamp and collector.TimestampReject. If zero, there is no
+// limit on that side.
+type Config struct {
+	PersistDir         string
+	MaxBodySize        int64
+	Relabel            []*relabel.Rule
+	TimestampPolicy    collector.TimestampPolicy
+	TimestampMaxAge    time.Duration
+	TimestampMaxFuture time.Duration
+}
+
+// Metrics groups the internal metrics updated by a Handler.
+//
+// - PushesTotal: A counter of successful requests, by HTTP method.
+// - PushErrorsTotal: A counter of rejected or failed requests, by reason.
+// - DroppedFamiliesTotal: A counter of pushed metric families dropped because
+// their type is not supported, by type.
+// - RelabelDroppedTotal: A counter of series dropped by relabeling, by scope
+// and index of the rule.
+// - SampleTimestampsTotal: A counter of the pushed samples with a timestamp,
+// by outcome of the timestamp policy.
+type Metrics struct {
+	PushesTotal           *prometheus.CounterVec
+	PushErrorsTotal       *prometheus.CounterVec
+	DroppedFamiliesTotal  *prometheus.CounterVec
+	RelabelDroppedTotal   *prometheus.CounterVec
+	SampleTimestampsTotal *prometheus.CounterVec
+}
+
+// Handler implements a Pushgateway-compatible API: PUT replaces all the
+// metrics of a grouping key, POST only replaces the metric families with the
+// same names as the pushed ones, and DELETE removes the grouping key. The
+// pushed metrics get the labels of their grouping key and are stored in the
+// TimeAwareCollector with the default expiration.
+type Handler struct {
+	cfg     Config
+	coll    *collector.TimeAwareCollector
+	metrics Metrics
+
+	mu     sync.Mutex
+	groups map[string]*parser.Result
+}
+
+// NewHandler creates a Handler that stores the pushed metrics in coll.
+func NewHandler(cfg Config, coll *collector.TimeAwareCollector, metrics Metrics) *Handler {
+	return &Handler{
+		cfg:     cfg,
+		coll:    coll,
+		metrics: metrics,
+		groups:  make(map[string]*parser.Result),
+	}
+}
+
+// SetConfig replaces the configuration of h, e.g. after a reload. The metrics
+// already pushed are kept.
+func (h *Handler) SetConfig(cfg Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg = cfg
+}
+
+// groupingKey is the set of labels that identifies a group of pushed metrics.
+type groupingKey struct {
+	labels map[string]string
+	// id is the canonical form of labels: job first, then the other labels
+	// in alphabetical order. It is safe to use in a file name.
+	id string
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := parseGroupingKey(strings.TrimPrefix(r.URL.EscapedPath(), PathPrefix))
+	if err != nil {
+		h.metrics.PushErrorsTotal.WithLabelValues("invalid_grouping_key").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/vnd.google.protobuf") {
+			h.metrics.PushErrorsTotal.WithLabelValues("unsupported_format").Inc()
+			http.Error(w, "only the text and OpenMetrics formats are supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		h.mu.Lock()
+		maxBodySize := h.cfg.MaxBodySize
+		h.mu.Unlock()
+		if maxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		}
+		data, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.metrics.PushErrorsTotal.WithLabelValues("body_too_large").Inc()
+			http.Error(w, fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			h.metrics.PushErrorsTotal.WithLabelValues("read_error").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := parser.ParseData(data, strings.HasPrefix(r.Header.Get("Content-Type"), expfmt.OpenMetricsType))
+		if err != nil {
+			log.Printf("Error parsing push for %s: %v\n", key.id, err)
+			h.metrics.PushErrorsTotal.WithLabelValues("parse_error").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, warning := range result.Warnings {
+			log.Printf("Warning parsing push for %s: %v\n", key.id, warning)
+		}
+		if err := h.push(key, result, r.Method == http.MethodPut); errors.Is(err, collector.ErrSeriesLimit) {
+			log.Printf("Error storing push for %s: %v\n", key.id, err)
+			h.metrics.PushErrorsTotal.WithLabelValues("series_limit").Inc()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			log.Printf("Error storing push for %s: %v\n", key.id, err)
+			h.metrics.PushErrorsTotal.WithLabelValues("persist_error").Inc()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.metrics.PushesTotal.WithLabelValues(r.Method).Inc()
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := h.delete(key); err != nil {
+			log.Printf("Error deleting push for %s: %v\n", key.id, err)
+			h.metrics.PushErrorsTotal.WithLabelValues("persist_error").Inc()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.metrics.PushesTotal.WithLabelValues(r.Method).Inc()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// push stores result for key. With replace, the metric families previously
+// pushed for key are discarded; otherwise only the families with the same
+// name are. Nothing changes if the collector cannot hold the new series.
+func (h *Handler) push(key groupingKey, result *parser.Result, replace bool) error {
+	for name, mf := range result.Families {
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_COUNTER, dto.MetricType_UNTYPED, dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		default:
+			log.Printf("Dropping pushed metric family %s of unsupported type %s\n", name, mf.GetType())
+			h.metrics.DroppedFamiliesTotal.WithLabelValues(strings.ToLower(mf.GetType().String())).Inc()
+			delete(result.Families, name)
+			continue
+		}
+	}
+	result.SetLabels(key.labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !replace {
+		if old, ok := h.groups[key.id]; ok {
+			result = merge(old, result)
+		}
+	}
+	source := h.source(key)
+	if err := h.store(source, result); err != nil {
+		return err
+	}
+	if h.cfg.PersistDir != "" {
+		if err := writeFile(h.path(key), result); err != nil {
+			h.rollback(key, source)
+			return err
+		}
+	}
+	h.groups[key.id] = result
+	return nil
+}
+
+// rollback stores again the metrics previously pushed for key, after a push
+// that could not be persisted. The caller must hold h.mu.
+func (h *Handler) rollback(key groupingKey, source string) {
+	old, ok := h.groups[key.id]
+	if !ok {
+		h.coll.RemoveSource(source, collector.UpdateReplace)
+		return
+	}
+	if err := h.store(source, old); err != nil {
+		log.Printf("Error restoring push for %s: %v\n", key.id, err)
+	}
+}
+
+// store relabels a copy of result, applies the timestamp policy to it and
+// hands its metrics to the collector as source. result itself is kept as
+// pushed, since it is what gets persisted and merged with later pushes, so
+// that restored pushes go through the same steps with the settings in use.
+func (h *Handler) store(source string, result *parser.Result) error {
+	relabeled := result.Clone()
+	for rule, n := range relabel.Apply(h.cfg.Relabel, relabeled) {
+		h.metrics.RelabelDroppedTotal.WithLabelValues(rule.Scope, strconv.Itoa(rule.Index)).Add(float64(n))
+	}
+	newMetrics, _ := h.coll.FromResult(relabeled, source, 0, false)
+	outcomes := collector.ApplyTimestampPolicy(newMetrics, h.cfg.TimestampPolicy, h.cfg.TimestampMaxAge, h.cfg.TimestampMaxFuture, time.Now())
+	if count := outcomes[collector.TimestampRejected]; count > 0 {
+		log.Printf("Rejected %d pushed samples of %s with a timestamp out of the accepted window\n", count, source)
+	}
+	for outcome, count := range outcomes {
+		h.metrics.SampleTimestampsTotal.WithLabelValues(outcome).Add(float64(count))
+	}
+	return h.coll.UpdateSource(source, newMetrics, collector.UpdateReplace)
+}
+
+// delete removes the metrics pushed for key.
+func (h *Handler) delete(key groupingKey) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cfg.PersistDir != "" {
+		if err := os.Remove(h.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	delete(h.groups, key.id)
+	h.coll.RemoveSource(h.source(key), collector.UpdateReplace)
+	return nil
+}
+
+// Restore stores the groups persisted in PersistDir, usually at startup. A
+// file that cannot be read is logged and skipped. It returns the number of
+// restored groups.
+func (h *Handler) Restore() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cfg.PersistDir == "" {
+		return 0, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(h.cfg.PersistDir, "push_*.prom"))
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, path := range paths {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "push_"), ".prom")
+		key, err := parseGroupingKeyID(id)
+		if err != nil {
+			log.Printf("Skipping persisted push %s: %v\n", path, err)
+			continue
+		}
+		result, err := parser.Parse(path)
+		if err != nil {
+			log.Printf("Error reading persisted push %s: %v\n", path, err)
+			continue
+		}
+		if err := h.store(h.source(key), result); err != nil {
+			log.Printf("Error restoring persisted push %s: %v\n", path, err)
+			continue
+		}
+		h.groups[key.id] = result
+		restored++
+	}
+	return restored, nil
+}
+
+// source returns the collector source of key, a name that cannot clash with
+// a file.
+func (h *Handler) source(key groupingKey) string {
+	return "push:" + key.id
+}
+
+// path returns the file where key is persisted.
+func (h *Handler) path(key groupingKey) string {
+	return filepath.Join(h.cfg.PersistDir, "push_"+key.id+".prom")
+}
+
+// parseGroupingKey parses the escaped path of a push after PathPrefix, i.e.
+// "job/<job>{/<label>/<value>}". As with the Pushgateway, a label name can be
+// suffixed with "@base64" to pass a base64url-encoded value, which allows
+// values containing slashes or empty values.
+func parseGroupingKey(path string) (groupingKey, error) {
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(segments)%2 != 0 || (segments[0] != "job" && segments[0] != "job@base64") {
+		return groupingKey{}, fmt.Errorf("invalid path %q, expected job/<job>{/<label>/<value>}", PathPrefix+path)
+	}
+
+	labels := make(map[string]string, len(segments)/2)
+	for i := 0; i < len(segments); i += 2 {
+		name, value := segments[i], segments[i+1]
+		var err error
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			var decoded []byte
+			decoded, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			value = string(decoded)
+		} else {
+			value, err = url.PathUnescape(value)
+		}
+		if err != nil {
+			return groupingKey{}, fmt.Errorf("invalid value for label %s: %w", name, err)
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return groupingKey{}, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return groupingKey{}, fmt.Errorf("duplicate label %s", name)
+		}
+		labels[name] = value
+	}
+	return newGroupingKey(labels)
+}
+
+// parseGroupingKeyID parses the id of a grouping key, as found in the name of
+// a persisted file.
+func parseGroupingKeyID(id string) (groupingKey, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(id, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return groupingKey{}, fmt.Errorf("invalid grouping key %q", id)
+		}
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return groupingKey{}, fmt.Errorf("invalid value for label %s: %w", name, err)
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return groupingKey{}, fmt.Errorf("invalid label name %q", name)
+		}
+		labels[name] = value
+	}
+	return newGroupingKey(labels)
+}
+
+// newGroupingKey returns the grouping key of labels, which must include a job.
+func newGroupingKey(labels map[string]string) (groupingKey, error) {
+	if labels["job"] == "" {
+		return groupingKey{}, fmt.Errorf("job name is required")
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	id := "job=" + url.QueryEscape(labels["job"])
+	for _, name := range names {
+		id += "," + name + "=" + url.QueryEscape(labels[name])
+	}
+	return groupingKey{labels: labels, id: id}, nil
+}
+
+// merge returns the metric families of old, with those of result replacing
+// the families with the same name.
+func merge(old, result *parser.Result) *parser.Result {
+	merged := &parser.Result{
+		Families:    make(map[string]*dto.MetricFamily, len(old.Families)+len(result.Families)),
+		Units:       make(map[string]string),
+		OpenMetrics: old.OpenMetrics || result.OpenMetrics,
+	}
+	for _, r := range []*parser.Result{old, result} {
+		for name, mf := range r.Families {
+			merged.Families[name] = mf
+			delete(merged.Units, name)
+			if unit, ok := r.Units[name]; ok {
+				merged.Units[name] = unit
+			}
+		}
+	}
+	return merged
+}
+
+// writeFile atomically replaces path with the metric families of result. The
+// OpenMetrics format is used if any of them was pushed as OpenMetrics, so that
+// exemplars, units and created timestamps are kept.
+func writeFile(path string, result *parser.Result) error {
+	names := make([]string, 0, len(result.Families))
+	for name := range result.Families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The temporary file does not have a metrics file extension, so the
+	// scanner never reads it half-written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".push_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, name := range names {
+		mf := result.Families[name]
+		if result.OpenMetrics {
+			if unit, ok := result.Units[name]; ok {
+				mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: proto.String(unit), Metric: mf.Metric}
+			}
+			_, err = expfmt.MetricFamilyToOpenMetrics(w, mf, expfmt.WithUnit(), expfmt.WithCreatedLines())
+		} else {
+			_, err = expfmt.MetricFamilyToText(w, mf)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if result.OpenMetrics {
+		expfmt.FinalizeOpenMetrics(w)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
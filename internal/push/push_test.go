@@ -0,0 +1,402 @@
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/relabel"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// testMetrics returns a fresh set of internal metrics.
+func testMetrics() Metrics {
+	counter := func(name string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: name}, labels)
+	}
+	return Metrics{
+		PushesTotal:           counter("pushes_total", "method"),
+		PushErrorsTotal:       counter("push_errors_total", "reason"),
+		DroppedFamiliesTotal:  counter("dropped_families_total", "type"),
+		RelabelDroppedTotal:   counter("relabel_dropped_series_total", "scope", "rule"),
+		SampleTimestampsTotal: counter("sample_timestamps_total", "outcome"),
+	}
+}
+
+// newTestHandler returns a Handler and the collector it feeds.
+func newTestHandler(cfg Config) (*Handler, *collector.TimeAwareCollector) {
+	coll := collector.NewTimeAwareCollector(time.Hour)
+	return NewHandler(cfg, coll, testMetrics()), coll
+}
+
+// request sends a request to h and returns the status code.
+func request(t *testing.T, h http.Handler, method, path, contentType, body string) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// mustPush sends a push to h and fails the test if it is rejected.
+func mustPush(t *testing.T, h http.Handler, method, path, body string) {
+	t.Helper()
+	if code := request(t, h, method, path, "", body); code != http.StatusOK {
+		t.Fatalf("%s %s returned %d", method, path, code)
+	}
+}
+
+// gather collects coll and returns its samples by series, formatted as
+// name{label="value",...}.
+func gather(t *testing.T, coll prometheus.Collector) map[string]*dto.Metric {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(coll)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]*dto.Metric)
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			var labels []string
+			for _, lp := range m.Label {
+				labels = append(labels, lp.GetName()+"=\""+lp.GetValue()+"\"")
+			}
+			sort.Strings(labels)
+			series[mf.GetName()+"{"+strings.Join(labels, ",")+"}"] = m
+		}
+	}
+	return series
+}
+
+// seriesValues returns the value of the gauge and untyped samples of coll by
+// series.
+func seriesValues(t *testing.T, coll prometheus.Collector) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64)
+	for name, m := range gather(t, coll) {
+		values[name] = m.GetUntyped().GetValue() + m.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestPushSemantics(t *testing.T) {
+	tests := []struct {
+		name string
+		// steps are requests sent in order, as method, path and body.
+		steps [][3]string
+		want  map[string]float64
+	}{
+		{
+			name: "PUT replaces the group",
+			steps: [][3]string{
+				{http.MethodPut, "/metrics/job/j", "a 1\nb 1\n"},
+				{http.MethodPut, "/metrics/job/j", "c 2\n"},
+			},
+			want: map[string]float64{`c{job="j"}`: 2},
+		},
+		{
+			name: "POST replaces the families with the same name",
+			steps: [][3]string{
+				{http.MethodPut, "/metrics/job/j", "a 1\nb{x=\"1\"} 1\nb{x=\"2\"} 1\n"},
+				{http.MethodPost, "/metrics/job/j", "b{x=\"3\"} 2\nc 2\n"},
+			},
+			want: map[string]float64{`a{job="j"}`: 1, `b{job="j",x="3"}`: 2, `c{job="j"}`: 2},
+		},
+		{
+			name: "DELETE removes the group only",
+			steps: [][3]string{
+				{http.MethodPut, "/metrics/job/j/instance/i1", "a 1\n"},
+				{http.MethodPut, "/metrics/job/j/instance/i2", "a 2\n"},
+				{http.MethodDelete, "/metrics/job/j/instance/i1", ""},
+			},
+			want: map[string]float64{`a{instance="i2",job="j"}`: 2},
+		},
+		{
+			name: "grouping labels override the pushed ones",
+			steps: [][3]string{
+				{http.MethodPut, "/metrics/job/j", "a{job=\"other\",x=\"1\"} 1\n"},
+			},
+			want: map[string]float64{`a{job="j",x="1"}`: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, coll := newTestHandler(Config{})
+			for _, step := range tt.steps {
+				want := http.StatusOK
+				if step[0] == http.MethodDelete {
+					want = http.StatusAccepted
+				}
+				if code := request(t, h, step[0], step[1], "", step[2]); code != want {
+					t.Fatalf("%s %s returned %d, want %d", step[0], step[1], code, want)
+				}
+			}
+			if got := seriesValues(t, coll); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	tests := []struct {
+		name, method, path, contentType, body string
+		want                                  int
+	}{
+		{"no job", http.MethodPut, "/metrics/instance/i", "", "a 1\n", http.StatusBadRequest},
+		{"parse error", http.MethodPut, "/metrics/job/j", "", "a{ 1\n", http.StatusBadRequest},
+		{"protobuf", http.MethodPut, "/metrics/job/j", "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited", "", http.StatusUnsupportedMediaType},
+		{"method", http.MethodGet, "/metrics/job/j", "", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, coll := newTestHandler(Config{})
+			if code := request(t, h, tt.method, tt.path, tt.contentType, tt.body); code != tt.want {
+				t.Errorf("%s %s returned %d, want %d", tt.method, tt.path, code, tt.want)
+			}
+			if n := len(gather(t, coll)); n != 0 {
+				t.Errorf("collector holds %d series, want none", n)
+			}
+		})
+	}
+}
+
+func TestPushMaxBodySize(t *testing.T) {
+	h, coll := newTestHandler(Config{MaxBodySize: 8})
+	if code := request(t, h, http.MethodPut, "/metrics/job/j", "", "a 1\nb 1\nc 1\n"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("push over the size limit returned %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	if n := len(gather(t, coll)); n != 0 {
+		t.Errorf("collector holds %d series, want none", n)
+	}
+	if got := testutil.ToFloat64(h.metrics.PushErrorsTotal.WithLabelValues("body_too_large")); got != 1 {
+		t.Errorf("push_errors_total{reason=\"body_too_large\"} = %v, want 1", got)
+	}
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", "a 1\n")
+}
+
+func TestPushSeriesLimit(t *testing.T) {
+	h, coll := newTestHandler(Config{})
+	coll.SetMaxSeries(2)
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", "a 1\nb 1\n")
+	if code := request(t, h, http.MethodPost, "/metrics/job/j", "", "c 1\n"); code != http.StatusServiceUnavailable {
+		t.Errorf("push over the series limit returned %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if got := len(gather(t, coll)); got != 2 {
+		t.Errorf("collector holds %d series, want the 2 pushed first", got)
+	}
+}
+
+func TestParseGroupingKey(t *testing.T) {
+	tests := []struct {
+		path   string
+		labels map[string]string
+		id     string
+	}{
+		{"job/j", map[string]string{"job": "j"}, "job=j"},
+		{"job/j/", map[string]string{"job": "j"}, "job=j"},
+		{"job/j/zone/z/instance/i", map[string]string{"job": "j", "zone": "z", "instance": "i"}, "job=j,instance=i,zone=z"},
+		{"job/a%2Fb", map[string]string{"job": "a/b"}, "job=a%2Fb"},
+		{"job@base64/YS9i/path@base64/=", map[string]string{"job": "a/b", "path": ""}, "job=a%2Fb,path="},
+		{"job@base64/YS9i=/x/1", map[string]string{"job": "a/b", "x": "1"}, "job=a%2Fb,x=1"},
+	}
+	for _, tt := range tests {
+		key, err := parseGroupingKey(tt.path)
+		if err != nil {
+			t.Errorf("parseGroupingKey(%q) failed: %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(key.labels, tt.labels) || key.id != tt.id {
+			t.Errorf("parseGroupingKey(%q) = %v, %q, want %v, %q", tt.path, key.labels, key.id, tt.labels, tt.id)
+		}
+	}
+
+	for _, path := range []string{"", "job", "instance/i", "job/", "job/j/x", "job/j/__x/1", "job/j/x-y/1", "job/j/x/1/x/2"} {
+		if key, err := parseGroupingKey(path); err == nil {
+			t.Errorf("parseGroupingKey(%q) = %v, want an error", path, key.labels)
+		}
+	}
+}
+
+func TestPushPersist(t *testing.T) {
+	dir := t.TempDir()
+	h, _ := newTestHandler(Config{PersistDir: dir})
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", "# HELP a Help of a.\n# TYPE a gauge\na 1\nb 1\n")
+	path := filepath.Join(dir, "push_job=j.prom")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"# HELP a Help of a.\n", `a{job="j"} 1` + "\n", `b{job="j"} 1` + "\n"} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("persisted file does not contain %q:\n%s", line, data)
+		}
+	}
+
+	// After a restart, the group is restored and a POST merges with it.
+	h, coll := newTestHandler(Config{PersistDir: dir})
+	if n, err := h.Restore(); err != nil || n != 1 {
+		t.Fatalf("Restore() = %d, %v, want 1 group", n, err)
+	}
+	want := map[string]float64{`a{job="j"}`: 1, `b{job="j"}`: 1}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after the restart = %v, want %v", got, want)
+	}
+	mustPush(t, h, http.MethodPost, "/metrics/job/j", "b 2\n")
+	want = map[string]float64{`a{job="j"}`: 1, `b{job="j"}`: 2}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after the merge = %v, want %v", got, want)
+	}
+
+	if code := request(t, h, http.MethodDelete, "/metrics/job/j", "", ""); code != http.StatusAccepted {
+		t.Fatalf("DELETE returned %d", code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("persisted file still exists after DELETE: %v", err)
+	}
+}
+
+func TestPushPersistOpenMetrics(t *testing.T) {
+	dir := t.TempDir()
+	h, _ := newTestHandler(Config{PersistDir: dir})
+	body := `# TYPE size_bytes gauge
+# UNIT size_bytes bytes
+size_bytes 10
+# TYPE runs counter
+runs_total 3 # {trace_id="t"} 1
+runs_created 1600000000
+# EOF
+`
+	if code := request(t, h, http.MethodPut, "/metrics/job/j", "application/openmetrics-text; version=1.0.0", body); code != http.StatusOK {
+		t.Fatalf("PUT returned %d", code)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "push_job=j.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"# UNIT size_bytes bytes\n", `runs_total{job="j"} 3.0 # {trace_id="t"} 1.0`, `runs_created{job="j"} 1.6e+09`, "# EOF\n"} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("persisted file does not contain %q:\n%s", line, data)
+		}
+	}
+}
+
+func TestPushRelabelPersistsPushedSeries(t *testing.T) {
+	dir := t.TempDir()
+	rules, err := relabel.Compile([]relabel.Config{
+		{SourceLabels: []string{"env"}, Regex: proto.String("dev"), Action: relabel.Drop},
+		{SourceLabels: []string{"__name__"}, Regex: proto.String("legacy_(.*)"), TargetLabel: "__name__", Replacement: proto.String("app_$1")},
+	}, "global")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, coll := newTestHandler(Config{PersistDir: dir, Relabel: rules})
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", "legacy_a{env=\"prod\"} 1\nlegacy_a{env=\"dev\"} 2\n")
+	mustPush(t, h, http.MethodPost, "/metrics/job/j", "legacy_b 3\n")
+
+	want := map[string]float64{`app_a{env="prod",job="j"}`: 1, `app_b{job="j"}`: 3}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(h.metrics.RelabelDroppedTotal.WithLabelValues("global", "0")); got != 2 {
+		t.Errorf("relabel_dropped_series_total = %v, want the dev series counted at each push", got)
+	}
+
+	// The file holds the series as pushed, and they are relabeled once more
+	// when they are restored.
+	data, err := os.ReadFile(filepath.Join(dir, "push_job=j.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`legacy_a{env="prod",job="j"} 1`, `legacy_a{env="dev",job="j"} 2`, `legacy_b{job="j"} 3`} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("persisted file does not contain %q:\n%s", line, data)
+		}
+	}
+	h, coll = newTestHandler(Config{PersistDir: dir, Relabel: rules})
+	if _, err := h.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after the restart = %v, want %v", got, want)
+	}
+}
+
+func TestPushRestore(t *testing.T) {
+	dir := t.TempDir()
+	h, _ := newTestHandler(Config{PersistDir: dir})
+	mustPush(t, h, http.MethodPut, "/metrics/job/j/instance@base64/YS9i", "a 1\n")
+	mustPush(t, h, http.MethodPut, "/metrics/job/k", "b 2\n")
+	// Files that are not pushes are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "push_instance=x.prom"), []byte("c 3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.prom"), []byte("d 4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, coll := newTestHandler(Config{PersistDir: dir})
+	if n, err := h.Restore(); err != nil || n != 2 {
+		t.Fatalf("Restore() = %d, %v, want 2 groups", n, err)
+	}
+	want := map[string]float64{`a{instance="a/b",job="j"}`: 1, `b{job="k"}`: 2}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after the restart = %v, want %v", got, want)
+	}
+
+	// The restored groups can be deleted like the pushed ones.
+	if code := request(t, h, http.MethodDelete, "/metrics/job/j/instance@base64/YS9i", "", ""); code != http.StatusAccepted {
+		t.Fatalf("DELETE returned %d", code)
+	}
+	want = map[string]float64{`b{job="k"}`: 2}
+	if got := seriesValues(t, coll); !reflect.DeepEqual(got, want) {
+		t.Errorf("series after the DELETE = %v, want %v", got, want)
+	}
+}
+
+func TestPushTimestampPolicy(t *testing.T) {
+	old := strconv.FormatInt(time.Now().Add(-48*time.Hour).UnixMilli(), 10)
+	body := "stamped 1 " + old + "\nplain 2\n"
+
+	h, coll := newTestHandler(Config{TimestampPolicy: collector.TimestampReject, TimestampMaxAge: time.Hour})
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", body)
+	if want := map[string]float64{`plain{job="j"}`: 2}; !reflect.DeepEqual(seriesValues(t, coll), want) {
+		t.Errorf("series = %v, want %v", seriesValues(t, coll), want)
+	}
+	if got := testutil.ToFloat64(h.metrics.SampleTimestampsTotal.WithLabelValues(collector.TimestampRejected)); got != 1 {
+		t.Errorf("rejected timestamps = %v, want 1", got)
+	}
+
+	dir := t.TempDir()
+	h, coll = newTestHandler(Config{PersistDir: dir, TimestampPolicy: collector.TimestampDrop})
+	mustPush(t, h, http.MethodPut, "/metrics/job/j", body)
+	if m := gather(t, coll)[`stamped{job="j"}`]; m == nil || m.TimestampMs != nil {
+		t.Errorf("stamped = %v, want it exported without timestamp", m)
+	}
+	// The file keeps the timestamps as pushed, and the policy applies again
+	// when they are restored.
+	data, err := os.ReadFile(filepath.Join(dir, "push_job=j.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := `stamped{job="j"} 1 ` + old; !strings.Contains(string(data), line) {
+		t.Errorf("persisted file does not contain %q:\n%s", line, data)
+	}
+}
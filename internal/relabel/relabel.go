@@ -0,0 +1,220 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"textfile_exporter/internal/parser"
+
+	"github.com/prometheus/common/model"
+)
+
+// Action is what a relabeling rule does with the series it matches.
+type Action string
+
+const (
+	// Replace sets TargetLabel to Replacement, expanded with the groups
+	// matched by Regex in the source value.
+	Replace Action = "replace"
+	// Keep drops the series whose source value does not match Regex.
+	Keep Action = "keep"
+	// Drop drops the series whose source value matches Regex.
+	Drop Action = "drop"
+	// HashMod sets TargetLabel to the hash of the source value modulo Modulus.
+	HashMod Action = "hashmod"
+	// LabelMap copies the labels whose name matches Regex to the name given
+	// by Replacement.
+	LabelMap Action = "labelmap"
+	// LabelDrop removes the labels whose name matches Regex.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep removes the labels whose name does not match Regex.
+	LabelKeep Action = "labelkeep"
+)
+
+// Default values of the optional fields of Config.
+const (
+	DefaultSeparator   = ";"
+	DefaultRegex       = "(.*)"
+	DefaultReplacement = "$1"
+)
+
+// Config is a relabeling rule, with the same fields as the relabel_configs
+// of Prometheus. The source value is the values of SourceLabels joined by
+// Separator. The metric name is the __name__ label.
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       Action   `yaml:"action"`
+}
+
+// Rule is a compiled relabeling rule. Scope and Index identify it in the
+// internal metrics.
+type Rule struct {
+	Scope       string
+	Index       int
+	action      Action
+	source      []string
+	separator   string
+	regex       *regexp.Regexp
+	modulus     uint64
+	target      string
+	replacement string
+}
+
+// Compile checks and compiles rules. scope names the set of rules, such as
+// "global" or the name of a directory.
+func Compile(configs []Config, scope string) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for i, c := range configs {
+		rule, err := compile(c)
+		if err != nil {
+			return nil, fmt.Errorf("relabel_configs[%d]: %w", i, err)
+		}
+		rule.Scope = scope
+		rule.Index = i
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compile(c Config) (*Rule, error) {
+	r := &Rule{
+		action:      c.Action,
+		source:      c.SourceLabels,
+		separator:   DefaultSeparator,
+		modulus:     c.Modulus,
+		target:      c.TargetLabel,
+		replacement: DefaultReplacement,
+	}
+	if r.action == "" {
+		r.action = Replace
+	}
+	if c.Separator != nil {
+		r.separator = *c.Separator
+	}
+	if c.Replacement != nil {
+		r.replacement = *c.Replacement
+	}
+	expr := DefaultRegex
+	if c.Regex != nil {
+		expr = *c.Regex
+	}
+	// Like in Prometheus, the regular expression must match the whole value.
+	regex, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", expr, err)
+	}
+	r.regex = regex
+	for _, name := range r.source {
+		if !model.LabelName(name).IsValidLegacy() {
+			return nil, fmt.Errorf("invalid source label %q", name)
+		}
+	}
+
+	switch r.action {
+	case Replace:
+		if r.target == "" {
+			return nil, fmt.Errorf("target_label is required for action %s", r.action)
+		}
+	case HashMod:
+		if !model.LabelName(r.target).IsValidLegacy() {
+			return nil, fmt.Errorf("invalid target_label %q for action %s", r.target, r.action)
+		}
+		if r.modulus == 0 {
+			return nil, fmt.Errorf("modulus must be positive for action %s", r.action)
+		}
+	case Keep, Drop:
+		if len(r.source) == 0 {
+			return nil, fmt.Errorf("source_labels are required for action %s", r.action)
+		}
+	case LabelMap, LabelDrop, LabelKeep:
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.action)
+	}
+	return r, nil
+}
+
+// Process applies rules in order to the labels of a series, including its
+// __name__, and modifies them in place. It returns the rule that dropped the
+// series, or nil if the series is kept. A series left without a metric name
+// is dropped by the rule that removed it. Labels starting with "__", other
+// than __name__ and the directive labels of the parser, are removed once all
+// rules were applied.
+func Process(rules []*Rule, labels map[string]string) *Rule {
+	for _, rule := range rules {
+		if !rule.apply(labels) || labels[model.MetricNameLabel] == "" {
+			return rule
+		}
+	}
+	for name := range labels {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) && name != model.MetricNameLabel && !strings.HasPrefix(name, parser.DirectiveLabelPrefix) {
+			delete(labels, name)
+		}
+	}
+	return nil
+}
+
+// apply applies the rule to labels and reports whether the series is kept.
+func (r *Rule) apply(labels map[string]string) bool {
+	values := make([]string, 0, len(r.source))
+	for _, name := range r.source {
+		values = append(values, labels[name])
+	}
+	value := strings.Join(values, r.separator)
+
+	switch r.action {
+	case Keep:
+		return r.regex.MatchString(value)
+	case Drop:
+		return !r.regex.MatchString(value)
+	case Replace:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.target, value, match))
+		if !model.LabelName(target).IsValidLegacy() {
+			return true
+		}
+		replacement := string(r.regex.ExpandString(nil, r.replacement, value, match))
+		if replacement == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replacement
+		}
+	case HashMod:
+		sum := md5.Sum([]byte(value))
+		labels[r.target] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % r.modulus)
+	case LabelMap:
+		for _, name := range sortedNames(labels) {
+			if r.regex.MatchString(name) {
+				labels[r.regex.ReplaceAllString(name, r.replacement)] = labels[name]
+			}
+		}
+	case LabelDrop, LabelKeep:
+		for name := range labels {
+			if r.regex.MatchString(name) == (r.action == LabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// sortedNames returns the label names in order, so that LabelMap gives the
+// same result whatever the map iteration order.
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,195 @@
+package relabel
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"textfile_exporter/internal/parser"
+)
+
+func str(s string) *string { return &s }
+
+// mustCompile compiles configs, failing the test on error.
+func mustCompile(t *testing.T, configs ...Config) []*Rule {
+	t.Helper()
+	rules, err := Compile(configs, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []Config
+		labels  map[string]string
+		want    map[string]string
+		dropped int // index of the rule that drops the series, or -1
+	}{
+		{
+			name:    "replace with groups",
+			configs: []Config{{SourceLabels: []string{"__name__"}, Regex: str("legacy_(.*)"), TargetLabel: "__name__", Replacement: str("app_$1")}},
+			labels:  map[string]string{"__name__": "legacy_jobs", "a": "1"},
+			want:    map[string]string{"__name__": "app_jobs", "a": "1"},
+			dropped: -1,
+		},
+		{
+			name:    "replace without match",
+			configs: []Config{{SourceLabels: []string{"a"}, Regex: str("x"), TargetLabel: "b", Replacement: str("y")}},
+			labels:  map[string]string{"__name__": "m", "a": "1"},
+			want:    map[string]string{"__name__": "m", "a": "1"},
+			dropped: -1,
+		},
+		{
+			name:    "replace with separator and empty replacement",
+			configs: []Config{{SourceLabels: []string{"a", "b"}, Separator: str("/"), Regex: str("1/2"), TargetLabel: "a", Replacement: str("")}},
+			labels:  map[string]string{"__name__": "m", "a": "1", "b": "2"},
+			want:    map[string]string{"__name__": "m", "b": "2"},
+			dropped: -1,
+		},
+		{
+			name:    "keep",
+			configs: []Config{{SourceLabels: []string{"env"}, Regex: str("prod"), Action: Keep}},
+			labels:  map[string]string{"__name__": "m", "env": "dev"},
+			dropped: 0,
+		},
+		{
+			name: "drop",
+			configs: []Config{
+				{SourceLabels: []string{"a"}, TargetLabel: "b"},
+				{SourceLabels: []string{"env"}, Regex: str("dev|test"), Action: Drop},
+			},
+			labels:  map[string]string{"__name__": "m", "env": "dev"},
+			dropped: 1,
+		},
+		{
+			name:    "hashmod",
+			configs: []Config{{SourceLabels: []string{"host"}, Modulus: 1, TargetLabel: "shard", Action: HashMod}},
+			labels:  map[string]string{"__name__": "m", "host": "db1"},
+			want:    map[string]string{"__name__": "m", "host": "db1", "shard": "0"},
+			dropped: -1,
+		},
+		{
+			name:    "labelmap",
+			configs: []Config{{Regex: str("meta_(.+)"), Replacement: str("$1"), Action: LabelMap}},
+			labels:  map[string]string{"__name__": "m", "meta_team": "infra"},
+			want:    map[string]string{"__name__": "m", "meta_team": "infra", "team": "infra"},
+			dropped: -1,
+		},
+		{
+			name:    "labeldrop",
+			configs: []Config{{Regex: str("request_.*"), Action: LabelDrop}},
+			labels:  map[string]string{"__name__": "m", "request_id": "1", "a": "1"},
+			want:    map[string]string{"__name__": "m", "a": "1"},
+			dropped: -1,
+		},
+		{
+			name:    "labelkeep",
+			configs: []Config{{Regex: str("__name__|a"), Action: LabelKeep}},
+			labels:  map[string]string{"__name__": "m", "b": "1", "a": "1"},
+			want:    map[string]string{"__name__": "m", "a": "1"},
+			dropped: -1,
+		},
+		{
+			name:    "metric name removed",
+			configs: []Config{{Regex: str("__name__"), Action: LabelDrop}},
+			labels:  map[string]string{"__name__": "m"},
+			dropped: 0,
+		},
+		{
+			name:    "reserved labels removed",
+			configs: []Config{{SourceLabels: []string{"__tmp"}, TargetLabel: "b"}},
+			labels:  map[string]string{"__name__": "m", "__tmp": "x", parser.DirectiveLabelPrefix + "ttl": "1h"},
+			want:    map[string]string{"__name__": "m", "b": "x", parser.DirectiveLabelPrefix + "ttl": "1h"},
+			dropped: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := mustCompile(t, tt.configs...)
+			rule := Process(rules, tt.labels)
+			if tt.dropped >= 0 {
+				if rule != rules[tt.dropped] {
+					t.Errorf("Process() = %v, want the series dropped by rule %d", rule, tt.dropped)
+				}
+				return
+			}
+			if rule != nil {
+				t.Fatalf("Process() dropped the series with rule %d", rule.Index)
+			}
+			if !reflect.DeepEqual(tt.labels, tt.want) {
+				t.Errorf("labels = %v, want %v", tt.labels, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{Regex: str("(")}, "invalid regex"},
+		{Config{SourceLabels: []string{"a-b"}, TargetLabel: "c"}, "invalid source label"},
+		{Config{}, "target_label is required"},
+		{Config{Action: HashMod, TargetLabel: "s"}, "modulus must be positive"},
+		{Config{Action: HashMod, TargetLabel: "$1", Modulus: 2}, "invalid target_label"},
+		{Config{Action: Drop}, "source_labels are required"},
+		{Config{Action: "rename"}, "unknown action"},
+	}
+	for _, tt := range tests {
+		_, err := Compile([]Config{{Action: LabelDrop, Regex: str("x")}, tt.config}, "test")
+		if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.HasPrefix(err.Error(), "relabel_configs[1]") {
+			t.Errorf("Compile(%+v) error = %v, want relabel_configs[1] and %q", tt.config, err, tt.want)
+		}
+	}
+
+	rules := mustCompile(t, Config{Action: LabelDrop}, Config{Action: LabelKeep})
+	for i, rule := range rules {
+		if rule.Scope != "test" || rule.Index != i {
+			t.Errorf("rules[%d] is %s/%d", i, rule.Scope, rule.Index)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	result, err := parser.ParseData([]byte(`# TYPE legacy_jobs counter
+legacy_jobs_total{env="prod"} 1
+# TYPE app_jobs_total gauge
+app_jobs_total{env="prod",x="1"} 1
+# TYPE legacy_runs gauge
+legacy_runs{env="prod"} 2
+legacy_runs{env="dev"} 3
+# TYPE size_bytes gauge
+# UNIT size_bytes bytes
+size_bytes 4
+# EOF
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := mustCompile(t,
+		Config{SourceLabels: []string{"env"}, Regex: str("dev"), Action: Drop},
+		Config{SourceLabels: []string{"__name__"}, Regex: str("legacy_(.*)"), TargetLabel: "__name__", Replacement: str("app_$1")},
+	)
+	dropped := Apply(rules, result)
+	// legacy_jobs_total is renamed into a gauge family and dropped against
+	// the last rule.
+	if want := map[*Rule]int{rules[0]: 1, rules[1]: 1}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped = %v, want %v", dropped, want)
+	}
+	var names []string
+	for name, mf := range result.Families {
+		names = append(names, name+"/"+strings.ToLower(mf.GetType().String())+"/"+strings.Repeat("*", len(mf.Metric)))
+	}
+	sort.Strings(names)
+	if want := []string{"app_jobs_total/gauge/*", "app_runs/gauge/*", "size_bytes/gauge/*"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("families = %v, want %v", names, want)
+	}
+	if want := map[string]string{"size_bytes": "bytes"}; !reflect.DeepEqual(result.Units, want) {
+		t.Errorf("units = %v, want %v", result.Units, want)
+	}
+}
@@ -0,0 +1,79 @@
+package relabel
+
+import (
+	"sort"
+	"textfile_exporter/internal/parser"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// Apply relabels every series of result. A series whose metric name changes
+// moves to the family of that name, created with the type and help of its
+// original family if needed. It returns the number of series dropped by each
+// rule. Series renamed to an invalid metric name, or into a family of another
+// type, are dropped and counted against the last rule.
+func Apply(rules []*Rule, result *parser.Result) map[*Rule]int {
+	if len(rules) == 0 {
+		return nil
+	}
+	dropped := make(map[*Rule]int)
+	last := rules[len(rules)-1]
+	families := make(map[string]*dto.MetricFamily, len(result.Families))
+	units := make(map[string]string, len(result.Units))
+
+	names := make([]string, 0, len(result.Families))
+	for name := range result.Families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mf := result.Families[name]
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+1)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			labels[model.MetricNameLabel] = name
+			if rule := Process(rules, labels); rule != nil {
+				dropped[rule]++
+				continue
+			}
+			newName := labels[model.MetricNameLabel]
+			delete(labels, model.MetricNameLabel)
+
+			target, ok := families[newName]
+			if !ok {
+				if !model.IsValidLegacyMetricName(newName) {
+					dropped[last]++
+					continue
+				}
+				target = &dto.MetricFamily{Name: proto.String(newName), Help: mf.Help, Type: mf.Type}
+				families[newName] = target
+				// The unit is a suffix of the name, so it only survives if
+				// the name does.
+				if unit, ok := result.Units[name]; ok && newName == name {
+					units[newName] = unit
+				}
+			} else if target.GetType() != mf.GetType() {
+				dropped[last]++
+				continue
+			}
+			m.Label = labelPairs(labels)
+			target.Metric = append(target.Metric, m)
+		}
+	}
+	result.Families = families
+	result.Units = units
+	return dropped
+}
+
+// labelPairs converts labels into sorted label pairs.
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, name := range sortedNames(labels) {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+	}
+	return pairs
+}
@@ -0,0 +1,50 @@
+package scanner
+
+import (
+	"errors"
+	"sort"
+	"textfile_exporter/internal/parser"
+)
+
+// setParseError records that file f could not be parsed because of err, and
+// counts the error by category.
+func (s *Scanner) setParseError(f string, err error) {
+	var parseErr *parser.Error
+	if !errors.As(err, &parseErr) {
+		parseErr = &parser.Error{File: f, Category: parser.CategorySyntax, Msg: err.Error()}
+	}
+	s.metrics.FileParseErrorsTotal.WithLabelValues(parseErr.Category).Inc()
+
+	s.failingMutex.Lock()
+	defer s.failingMutex.Unlock()
+	if previous, ok := s.failing[f]; ok && previous.Category != parseErr.Category {
+		s.metrics.FileParseFailing.DeleteLabelValues(f, previous.Category)
+	}
+	s.failing[f] = parseErr
+	if s.admitFile(f) {
+		s.metrics.FileParseFailing.WithLabelValues(f, parseErr.Category).Set(1)
+	}
+}
+
+// clearParseError records that file f was parsed successfully, or is gone.
+func (s *Scanner) clearParseError(f string) {
+	s.failingMutex.Lock()
+	defer s.failingMutex.Unlock()
+	if previous, ok := s.failing[f]; ok {
+		delete(s.failing, f)
+		s.metrics.FileParseFailing.DeleteLabelValues(f, previous.Category)
+	}
+}
+
+// Errors returns the current parse errors, sorted by file. It is safe to call
+// while the Scanner is running.
+func (s *Scanner) Errors() []*parser.Error {
+	s.failingMutex.Lock()
+	defer s.failingMutex.Unlock()
+	errs := make([]*parser.Error, 0, len(s.failing))
+	for _, err := range s.failing {
+		errs = append(errs, err)
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].File < errs[j].File })
+	return errs
+}
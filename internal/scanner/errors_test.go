@@ -0,0 +1,83 @@
+package scanner
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/parser"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "job.prom", "a 1\nb abc\n")
+	writeFile(t, dir, "ok.prom", "c 1\n")
+	s, _ := newTestScanner(t, dir, nil)
+	s.scan()
+
+	errs := s.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("Errors() = %v, want the error of job.prom", errs)
+	}
+	if e := errs[0]; e.File != path || e.Line != 2 || e.Column != 3 || e.Text != "b abc" || e.Category != parser.CategoryInvalidValue {
+		t.Errorf("Errors()[0] = %+v", e)
+	}
+	if got := testutil.ToFloat64(s.metrics.FileParseFailing.WithLabelValues(path, parser.CategoryInvalidValue)); got != 1 {
+		t.Errorf("file_parse_failing = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.FileParseErrorsTotal.WithLabelValues(parser.CategoryInvalidValue)); got != 1 {
+		t.Errorf("file_parse_errors_total = %v, want 1", got)
+	}
+
+	// Another error replaces the category of the failing file.
+	writeFile(t, dir, "job.prom", "a 1\n# TYPE a gauge\n")
+	setMtime(t, path, time.Now().Add(time.Minute))
+	s.scan()
+	if errs := s.Errors(); len(errs) != 1 || errs[0].Category != parser.CategoryDuplicateMetadata {
+		t.Errorf("Errors() = %v, want a duplicate metadata", errs)
+	}
+	if n := testutil.CollectAndCount(s.metrics.FileParseFailing); n != 1 {
+		t.Errorf("file_parse_failing has %d series, want the one of the new category", n)
+	}
+
+	// Fixing the file clears the error, and so does removing it.
+	writeFile(t, dir, "job.prom", "a 1\n")
+	setMtime(t, path, time.Now().Add(2*time.Minute))
+	s.scan()
+	if errs := s.Errors(); len(errs) != 0 {
+		t.Errorf("Errors() after the fix = %v, want none", errs)
+	}
+	if n := testutil.CollectAndCount(s.metrics.FileParseFailing); n != 0 {
+		t.Errorf("file_parse_failing has %d series after the fix, want none", n)
+	}
+
+	writeFile(t, dir, "job.prom", "a{ 1\n")
+	setMtime(t, path, time.Now().Add(3*time.Minute))
+	s.scan()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	s.scan()
+	if errs := s.Errors(); len(errs) != 0 {
+		t.Errorf("Errors() after the removal = %v, want none", errs)
+	}
+	if n := testutil.CollectAndCount(s.metrics.FileParseFailing); n != 0 {
+		t.Errorf("file_parse_failing has %d series after the removal, want none", n)
+	}
+}
+
+func TestDuplicateSeriesAccepted(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "job.prom", "a{x=\"1\"} 1\nb 2\na{x=\"1\"} 3\n")
+	s, coll := newTestScanner(t, dir, nil)
+	s.scan()
+
+	if errs := s.Errors(); len(errs) != 0 {
+		t.Errorf("Errors() = %v, want duplicates to be accepted", errs)
+	}
+	if m := gather(t, coll)[`a{x="1"}`]; m == nil || value(m) != 3 {
+		t.Errorf("a{x=\"1\"} = %v, want the last sample of the file", m)
+	}
+}
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FileMetrics groups the per-file gauges updated by a Scanner, all labeled by
+// file.
+//
+// - Mtime: The modification time of the file.
+// - Size: The size of the file in bytes.
+// - Series: The number of series read from the file.
+// - ParseSuccess: Whether the last parse of the file succeeded.
+// - ParseDuration: How long the last parse of the file took.
+// - ContentChange: The modification time of the file when its content last
+// changed.
+type FileMetrics struct {
+	Mtime         *prometheus.GaugeVec
+	Size          *prometheus.GaugeVec
+	Series        *prometheus.GaugeVec
+	ParseSuccess  *prometheus.GaugeVec
+	ParseDuration *prometheus.GaugeVec
+	ContentChange *prometheus.GaugeVec
+}
+
+// fileStat is what the per-file metrics report about the last read of a file.
+type fileStat struct {
+	fileinfo os.FileInfo
+	series   int
+	success  bool
+	// parsed is true if the file was parsed, rather than reused unchanged.
+	parsed   bool
+	duration time.Duration
+}
+
+// admitFile reports whether file f may have series labeled by its name: the
+// per-file gauges, and the unstable, parse failing and series limit metrics.
+// Once FileMetricsMaxFiles files have such series, no new file gets any.
+func (s *Scanner) admitFile(f string) bool {
+	if _, ok := s.fileMetrics[f]; ok {
+		return true
+	}
+	if s.cfg.FileMetricsMaxFiles > 0 && len(s.fileMetrics) >= s.cfg.FileMetricsMaxFiles {
+		if !s.fileMetricsFull {
+			log.Printf("Per-file metrics are limited to %d files in %s, skipping %s and the next files\n", s.cfg.FileMetricsMaxFiles, s.cfg.Path, f)
+			s.fileMetricsFull = true
+		}
+		return false
+	}
+	s.fileMetrics[f] = struct{}{}
+	return true
+}
+
+// setFileMetrics updates the per-file gauges of file f.
+func (s *Scanner) setFileMetrics(f string, st fileStat) {
+	if !s.cfg.FileMetrics || !s.admitFile(f) {
+		return
+	}
+
+	m := s.metrics.Files
+	m.Mtime.WithLabelValues(f).Set(float64(st.fileinfo.ModTime().UnixNano()) / 1e9)
+	m.Size.WithLabelValues(f).Set(float64(st.fileinfo.Size()))
+	m.Series.WithLabelValues(f).Set(float64(st.series))
+	if st.success {
+		m.ParseSuccess.WithLabelValues(f).Set(1)
+	} else {
+		m.ParseSuccess.WithLabelValues(f).Set(0)
+	}
+	if st.parsed {
+		m.ParseDuration.WithLabelValues(f).Set(st.duration.Seconds())
+		if st.success {
+			m.ContentChange.WithLabelValues(f).Set(float64(st.fileinfo.ModTime().UnixNano()) / 1e9)
+		}
+	}
+}
+
+// deleteFileMetrics removes all the series labeled by the name of file f.
+func (s *Scanner) deleteFileMetrics(f string) {
+	if _, ok := s.fileMetrics[f]; !ok {
+		return
+	}
+	delete(s.fileMetrics, f)
+	s.fileMetricsFull = false
+	s.deleteFileGauges(f)
+	labels := prometheus.Labels{"file": f}
+	s.metrics.UnstableFileEventsTotal.DeletePartialMatch(labels)
+	s.metrics.FileParseFailing.DeletePartialMatch(labels)
+	s.metrics.SeriesLimitHitsTotal.DeletePartialMatch(labels)
+}
+
+// deleteFileGauges removes the per-file gauges of file f.
+func (s *Scanner) deleteFileGauges(f string) {
+	m := s.metrics.Files
+	for _, vec := range []*prometheus.GaugeVec{m.Mtime, m.Size, m.Series, m.ParseSuccess, m.ParseDuration, m.ContentChange} {
+		vec.DeleteLabelValues(f)
+	}
+}
@@ -0,0 +1,102 @@
+package scanner
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fileSeries returns the number of series labeled by file f in each internal
+// metric of s that has a file label.
+func fileSeries(t *testing.T, s *Scanner, f string) map[string]int {
+	t.Helper()
+	vecs := map[string]prometheus.Collector{
+		"mtime":       s.metrics.Files.Mtime,
+		"unstable":    s.metrics.UnstableFileEventsTotal,
+		"failing":     s.metrics.FileParseFailing,
+		"limit_hits":  s.metrics.SeriesLimitHitsTotal,
+		"parse_state": s.metrics.Files.ParseSuccess,
+	}
+	counts := make(map[string]int)
+	for name, vec := range vecs {
+		for _, m := range gather(t, vec) {
+			for _, lp := range m.Label {
+				if lp.GetName() == "file" && lp.GetValue() == f {
+					counts[name]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestFileMetricsRemovedWithFile(t *testing.T) {
+	dir := t.TempDir()
+	bad := writeFile(t, dir, "bad.prom", "a{ 1\n")
+	big := writeFile(t, dir, "big.prom", "a 1\nb 1\n")
+	locked := writeFile(t, dir, "locked.prom", "c 1\n")
+	lock := writeFile(t, dir, "locked.prom.lock", "")
+	s, _ := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.FileMetrics = true
+		cfg.MaxSeriesPerFile = 1
+		cfg.LockFileSuffix = ".lock"
+	})
+	s.scan()
+	for f, metric := range map[string]string{bad: "failing", big: "limit_hits", locked: "unstable"} {
+		if got := fileSeries(t, s, f); got[metric] != 1 {
+			t.Errorf("series of %s = %v, want one in %s", f, got, metric)
+		}
+	}
+
+	for _, f := range []string{bad, big, locked, lock} {
+		if err := os.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.scan()
+	for _, f := range []string{bad, big, locked} {
+		if got := fileSeries(t, s, f); len(got) != 0 {
+			t.Errorf("series of %s after its removal = %v, want none", f, got)
+		}
+	}
+}
+
+func TestFileMetricsMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, dir, "a.prom", "a{ 1\n")
+	second := writeFile(t, dir, "b.prom", "b{ 1\n")
+	writeFile(t, dir, "c.prom", "c 1\nc2 1\n")
+	writeFile(t, dir, "d.prom", "d 1\n")
+	writeFile(t, dir, "d.prom.lock", "")
+	s, _ := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.FileMetrics = true
+		cfg.FileMetricsMaxFiles = 1
+		cfg.MaxSeriesPerFile = 1
+		cfg.LockFileSuffix = ".lock"
+	})
+	s.scan()
+	for _, vec := range []prometheus.Collector{s.metrics.FileParseFailing, s.metrics.SeriesLimitHitsTotal, s.metrics.UnstableFileEventsTotal} {
+		if n := testutil.CollectAndCount(vec); n > 1 {
+			t.Errorf("%d series labeled by file, want at most 1", n)
+		}
+	}
+	if n := len(fileSeries(t, s, first)); n == 0 {
+		t.Errorf("the first file has no series")
+	}
+	if errs := s.Errors(); len(errs) != 3 {
+		t.Errorf("Errors() = %v, want every failing file, over the limit or not", errs)
+	}
+
+	// Removing the first file makes room for another one, from the next
+	// scan on.
+	if err := os.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+	s.scan()
+	s.scan()
+	if got := fileSeries(t, s, second); got["failing"] != 1 {
+		t.Errorf("series of %s = %v, want it to take the free slot", second, got)
+	}
+}
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Filters selects the files and directories a Scanner reads. Patterns are
+// matched against paths relative to the scanned directory, with forward
+// slashes as separators. Globs support "**" to match any number of
+// directories; regular expressions match anywhere in the path unless they are
+// anchored.
+//
+// - Include, IncludeRegex: If any is set, only the files matching one of these
+// patterns are read, instead of those matching FilePattern or the default
+// extensions.
+// - Exclude, ExcludeRegex: Files and directories matching one of these
+// patterns are skipped. Excluded directories are not descended into.
+type Filters struct {
+	Include      []string
+	IncludeRegex []*regexp.Regexp
+	Exclude      []string
+	ExcludeRegex []*regexp.Regexp
+}
+
+// hasInclude reports whether include patterns are set.
+func (f Filters) hasInclude() bool {
+	return len(f.Include) > 0 || len(f.IncludeRegex) > 0
+}
+
+// included reports whether rel matches one of the include patterns.
+func (f Filters) included(rel string) bool {
+	return matchAny(f.Include, f.IncludeRegex, rel)
+}
+
+// excluded reports whether rel matches one of the exclude patterns.
+func (f Filters) excluded(rel string) bool {
+	return matchAny(f.Exclude, f.ExcludeRegex, rel)
+}
+
+func matchAny(globs []string, regexes []*regexp.Regexp, rel string) bool {
+	for _, pattern := range globs {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	for _, re := range regexes {
+		if re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns path relative to the scanned directory, with forward
+// slashes, as matched by the filters.
+func (s *Scanner) relPath(path string) string {
+	rel, err := filepath.Rel(s.cfg.Path, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// isMetricsFile reports whether the scanner reads the file at path: one
+// matching the include filters if there are any, or else one matching
+// FilePattern, or else one with the .prom extension for the Prometheus text
+// format or .om for OpenMetrics. Files matching the exclude filters, and
+// temporary files if SkipTempFiles is set, are never read.
+func (s *Scanner) isMetricsFile(path string) bool {
+	rel := s.relPath(path)
+	name := filepath.Base(path)
+	if s.cfg.SkipTempFiles && isTempFile(name) {
+		return false
+	}
+	switch {
+	case s.cfg.Filters.hasInclude():
+		if !s.cfg.Filters.included(rel) {
+			return false
+		}
+	case s.cfg.FilePattern != "":
+		if ok, _ := filepath.Match(s.cfg.FilePattern, name); !ok {
+			return false
+		}
+	default:
+		if !strings.HasSuffix(name, ".prom") && !strings.HasSuffix(name, ".om") {
+			return false
+		}
+	}
+	return !s.cfg.Filters.excluded(rel)
+}
+
+// isExcludedDir reports whether the directory at path is skipped, along with
+// everything below it. The scanned directory itself is never excluded.
+func (s *Scanner) isExcludedDir(path string) bool {
+	rel := s.relPath(path)
+	return rel != "." && s.cfg.Filters.excluded(rel)
+}
@@ -0,0 +1,116 @@
+package scanner
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	files := []string{
+		"a.prom",
+		"b.om",
+		"c.prom.txt",
+		"notes.txt",
+		"archive/old.prom",
+		"archive/2023/older.prom",
+		"team/a.prom",
+		"team/wip_b.prom",
+		"team/sub/c.prom.txt",
+	}
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		want      []string
+	}{
+		{
+			name: "default extensions",
+			want: []string{"a.prom", "archive/2023/older.prom", "archive/old.prom", "b.om", "team/a.prom", "team/wip_b.prom"},
+		},
+		{
+			name:      "file pattern",
+			configure: func(cfg *Config) { cfg.FilePattern = "*.prom.txt" },
+			want:      []string{"c.prom.txt", "team/sub/c.prom.txt"},
+		},
+		{
+			name: "include globs replace the file pattern",
+			configure: func(cfg *Config) {
+				cfg.FilePattern = "*.om"
+				cfg.Filters.Include = []string{"**/*.prom.txt", "a.prom"}
+			},
+			want: []string{"a.prom", "c.prom.txt", "team/sub/c.prom.txt"},
+		},
+		{
+			name:      "include regex",
+			configure: func(cfg *Config) { cfg.Filters.IncludeRegex = []*regexp.Regexp{regexp.MustCompile(`^team/.*\.prom$`)} },
+			want:      []string{"team/a.prom", "team/wip_b.prom"},
+		},
+		{
+			name:      "excluded directory",
+			configure: func(cfg *Config) { cfg.Filters.Exclude = []string{"archive"} },
+			want:      []string{"a.prom", "b.om", "team/a.prom", "team/wip_b.prom"},
+		},
+		{
+			name:      "excluded files",
+			configure: func(cfg *Config) { cfg.Filters.Exclude = []string{"**/wip_*", "*.om"} },
+			want:      []string{"a.prom", "archive/2023/older.prom", "archive/old.prom", "team/a.prom"},
+		},
+		{
+			name: "exclude wins over include",
+			configure: func(cfg *Config) {
+				cfg.Filters.Include = []string{"team/**"}
+				cfg.Filters.ExcludeRegex = []*regexp.Regexp{regexp.MustCompile(`wip_`), regexp.MustCompile(`^team/sub$`)}
+			},
+			want: []string{"team/a.prom"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range files {
+				content := "m{path=\"" + name + "\"} 1\n"
+				if strings.HasSuffix(name, ".om") {
+					content += "# EOF\n"
+				}
+				writeFile(t, dir, name, content)
+			}
+			s, coll := newTestScanner(t, dir, func(cfg *Config) {
+				cfg.Recursive = true
+				if tt.configure != nil {
+					tt.configure(cfg)
+				}
+			})
+			s.scan()
+			var got []string
+			for _, m := range gather(t, coll) {
+				got = append(got, m.Label[0].GetValue())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsExcludedDir(t *testing.T) {
+	s, _ := newTestScanner(t, "/data", func(cfg *Config) {
+		cfg.Filters.Exclude = []string{"archive", "**/tmp"}
+		cfg.Filters.ExcludeRegex = []*regexp.Regexp{regexp.MustCompile(`^\.`)}
+	})
+	tests := map[string]bool{
+		"/data":             false,
+		"/data/archive":     true,
+		"/data/team":        false,
+		"/data/team/tmp":    true,
+		"/data/team/tmpdir": false,
+		"/data/.git":        true,
+	}
+	for path, want := range tests {
+		if got := s.isExcludedDir(path); got != want {
+			t.Errorf("isExcludedDir(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"textfile_exporter/internal/collector"
+	"time"
+)
+
+// fingerprint identifies a version of a file. Two equal fingerprints mean the
+// file has not changed between two scans and does not need to be parsed again.
+type fingerprint struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+	hash    [sha256.Size]byte
+}
+
+// cachedFile is the result of the last successful parse of a file, before the
+// timestamp policy, which applies again at every scan. mtime is the
+// modification time of that version, and goodAt the last time the file was
+// found to match it.
+type cachedFile struct {
+	fp      fingerprint
+	metrics map[string]collector.StoredMetric
+	mtime   time.Time
+	goodAt  time.Time
+}
+
+// statFingerprint builds a fingerprint from the file metadata only.
+func statFingerprint(fileinfo os.FileInfo) fingerprint {
+	return fingerprint{
+		inode:   fileInode(fileinfo),
+		size:    fileinfo.Size(),
+		modTime: fileinfo.ModTime(),
+	}
+}
+
+// sameMetadata reports whether two fingerprints have the same inode, size
+// and modification time.
+func (fp fingerprint) sameMetadata(other fingerprint) bool {
+	return fp.inode == other.inode && fp.size == other.size && fp.modTime.Equal(other.modTime)
+}
+
+// hashFile returns the SHA-256 digest of the file content.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package scanner
+
+import "os"
+
+// fileInode is not available on this platform; files are compared on size,
+// mtime and optionally content only.
+func fileInode(fileinfo os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,121 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// scanCounts returns the number of files parsed and reused by the last scan.
+func scanCounts(s *Scanner) (parsed, reused float64) {
+	return testutil.ToFloat64(s.metrics.ScanFilesCount.WithLabelValues("parsed")),
+		testutil.ToFloat64(s.metrics.ScanFilesCount.WithLabelValues("reused"))
+}
+
+func TestScanReusesUnchangedFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentHash bool
+		// change modifies the file between the two scans.
+		change     func(t *testing.T, path string)
+		wantReused bool
+		wantValue  float64
+	}{
+		{
+			name:       "unchanged",
+			change:     func(t *testing.T, path string) {},
+			wantReused: true,
+			wantValue:  1,
+		},
+		{
+			name: "rewritten",
+			change: func(t *testing.T, path string) {
+				writeFile(t, filepath.Dir(path), "a.prom", "a 2\n")
+				setMtime(t, path, time.Now().Add(time.Minute))
+			},
+			wantValue: 2,
+		},
+		{
+			name: "touched",
+			change: func(t *testing.T, path string) {
+				setMtime(t, path, time.Now().Add(time.Minute))
+			},
+			wantValue: 1,
+		},
+		{
+			name: "renamed into place with the same size and mtime",
+			change: func(t *testing.T, path string) {
+				fileinfo, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tmp := writeFile(t, filepath.Dir(path), "a.tmp", "a 3\n")
+				setMtime(t, tmp, fileinfo.ModTime())
+				if err := os.Rename(tmp, path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantValue: 3,
+		},
+		{
+			name:        "touched with content hash",
+			contentHash: true,
+			change: func(t *testing.T, path string) {
+				setMtime(t, path, time.Now().Add(time.Minute))
+			},
+			wantReused: true,
+			wantValue:  1,
+		},
+		{
+			name:        "rewritten with content hash",
+			contentHash: true,
+			change: func(t *testing.T, path string) {
+				writeFile(t, filepath.Dir(path), "a.prom", "a 2\n")
+				setMtime(t, path, time.Now().Add(time.Minute))
+			},
+			wantValue: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeFile(t, dir, "a.prom", "a 1\n")
+			s, coll := newTestScanner(t, dir, func(cfg *Config) { cfg.ContentHash = tt.contentHash })
+			s.scan()
+			if parsed, reused := scanCounts(s); parsed != 1 || reused != 0 {
+				t.Fatalf("first scan parsed %v and reused %v files, want 1 and 0", parsed, reused)
+			}
+
+			tt.change(t, path)
+			s.scan()
+			parsed, reused := scanCounts(s)
+			if (reused == 1) != tt.wantReused || parsed+reused != 1 {
+				t.Errorf("second scan parsed %v and reused %v files, want reused %v", parsed, reused, tt.wantReused)
+			}
+			if got := value(gather(t, coll)["a{}"]); got != tt.wantValue {
+				t.Errorf("a = %v, want %v", got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestReusedFilesAreRenewed(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.prom", "a 1\nb 2 1000\n")
+	s, coll := newTestScanner(t, dir, nil)
+	s.scan()
+	first := gather(t, coll)
+
+	time.Sleep(10 * time.Millisecond)
+	s.scan()
+	second := gather(t, coll)
+	if second["a{}"].GetTimestampMs() <= first["a{}"].GetTimestampMs() {
+		t.Errorf("scan timestamp of a reused sample was not renewed: %d, then %d", first["a{}"].GetTimestampMs(), second["a{}"].GetTimestampMs())
+	}
+	if got := second["b{}"].GetTimestampMs(); got != 1000 {
+		t.Errorf("timestamp of b = %d, want the one of the file, 1000", got)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file, so that a file replaced by
+// an atomic rename is detected even if its size and mtime did not change.
+func fileInode(fileinfo os.FileInfo) uint64 {
+	if st, ok := fileinfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
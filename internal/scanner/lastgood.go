@@ -0,0 +1,45 @@
+package scanner
+
+import (
+	"log"
+	"textfile_exporter/internal/collector"
+	"time"
+)
+
+// ParseErrorPolicy controls what happens to the metrics of a file that can no
+// longer be parsed.
+type ParseErrorPolicy string
+
+const (
+	// ParseErrorDrop drops the metrics of the file, like after its deletion.
+	ParseErrorDrop ParseErrorPolicy = "drop"
+	// ParseErrorKeepLast keeps serving the metrics of the last version of the
+	// file that could be parsed, up to LastGoodMaxAge.
+	ParseErrorKeepLast ParseErrorPolicy = "keep_last"
+)
+
+// lastGood returns the metrics of the last version of file f that could be
+// parsed, extended so that they do not expire, if the policy for err allows
+// serving them. Their samples keep the timestamps of that version.
+func (s *Scanner) lastGood(f string, err error, i, n int) (map[string]collector.StoredMetric, bool) {
+	keep := s.cfg.OnParseError == ParseErrorKeepLast
+	if isSeriesLimit(err) {
+		keep = s.cfg.SeriesLimitAction == SeriesLimitKeepLast
+	}
+	cached, ok := s.cache[f]
+	if !keep || !ok {
+		return nil, false
+	}
+	age := time.Since(cached.goodAt)
+	if s.cfg.LastGoodMaxAge > 0 && age > s.cfg.LastGoodMaxAge {
+		log.Printf("%d/%d Last good version of file %s is %s old, dropping its metrics\n", i, n, f, age.Truncate(time.Second))
+		return nil, false
+	}
+	log.Printf("%d/%d Serving the last good version of file %s, %s old\n", i, n, f, age.Truncate(time.Second))
+	now := time.Now().UTC()
+	metrics := make(map[string]collector.StoredMetric, len(cached.metrics))
+	for k, metric := range cached.metrics {
+		metrics[k] = metric.Extend(now)
+	}
+	return metrics, true
+}
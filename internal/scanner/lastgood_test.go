@@ -0,0 +1,51 @@
+package scanner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastGoodKeepsTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "job.prom", "stamped 1 1700000000000\nunstamped 2\n")
+	s, coll := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.OnParseError = ParseErrorKeepLast
+	})
+	s.scan()
+	before := gather(t, coll)
+	if len(before) != 2 {
+		t.Fatalf("series = %v, want stamped and unstamped", before)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	writeFile(t, dir, "job.prom", "stamped{ 1\n")
+	setMtime(t, path, time.Now().Add(time.Minute))
+	s.scan()
+	after := gather(t, coll)
+	for _, name := range []string{"stamped{}", "unstamped{}"} {
+		m, ok := after[name]
+		if !ok {
+			t.Errorf("%s is no longer served", name)
+			continue
+		}
+		if got, want := m.GetTimestampMs(), before[name].GetTimestampMs(); got != want {
+			t.Errorf("%s timestamp = %d, want the one of the last good version, %d", name, got, want)
+		}
+		if value(m) != value(before[name]) {
+			t.Errorf("%s = %v, want %v", name, value(m), value(before[name]))
+		}
+	}
+}
+
+func TestLastGoodDrop(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "job.prom", "a 1\n")
+	s, coll := newTestScanner(t, dir, nil)
+	s.scan()
+	writeFile(t, dir, "job.prom", "a{ 1\n")
+	setMtime(t, path, time.Now().Add(time.Minute))
+	s.scan()
+	if n := len(gather(t, coll)); n != 0 {
+		t.Errorf("collector holds %d series, want none with the drop policy", n)
+	}
+}
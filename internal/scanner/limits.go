@@ -0,0 +1,123 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"textfile_exporter/internal/collector"
+	"textfile_exporter/internal/parser"
+)
+
+// SeriesLimitAction controls what happens to a file with more series than
+// MaxSeriesPerFile or MaxSeriesPerFamily, or that would take the collector
+// over its maximum number of series.
+type SeriesLimitAction string
+
+const (
+	// SeriesLimitReject drops all the metrics of the file, like a parse error.
+	SeriesLimitReject SeriesLimitAction = "reject"
+	// SeriesLimitTruncate keeps the first series of the file, in the order of
+	// their names and labels, up to the limits.
+	SeriesLimitTruncate SeriesLimitAction = "truncate"
+	// SeriesLimitKeepLast keeps serving the metrics of the last version of
+	// the file within the limits, like ParseErrorKeepLast.
+	SeriesLimitKeepLast SeriesLimitAction = "keep_last"
+)
+
+// Limits reported in the series_limit_hits_total metric.
+const (
+	limitFile   = "file"
+	limitFamily = "family"
+	limitGlobal = "global"
+)
+
+// familyName returns the name of the metric family a collector key belongs to.
+func familyName(key string) string {
+	name, _, _ := strings.Cut(key, "|")
+	return name
+}
+
+// applySeriesLimits enforces MaxSeriesPerFamily and MaxSeriesPerFile on the
+// metrics read from file f. With SeriesLimitTruncate the extra series are
+// removed from metrics; otherwise a parse error with the series_limit category
+// is returned.
+func (s *Scanner) applySeriesLimits(f string, metrics map[string]collector.StoredMetric, i, n int) error {
+	if s.cfg.MaxSeriesPerFamily <= 0 && s.cfg.MaxSeriesPerFile <= 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if max := s.cfg.MaxSeriesPerFamily; max > 0 {
+		counts := make(map[string]int)
+		for _, k := range keys {
+			counts[familyName(k)]++
+		}
+		var over []string
+		for name, count := range counts {
+			if count > max {
+				over = append(over, name)
+			}
+		}
+		sort.Strings(over)
+		for _, name := range over {
+			log.Printf("%d/%d Metric family %s of file %s has %d series, more than the limit of %d\n", i, n, name, f, counts[name], max)
+		}
+		if len(over) > 0 {
+			s.countLimitHit(f, limitFamily)
+			if s.cfg.SeriesLimitAction != SeriesLimitTruncate {
+				return &parser.Error{
+					File:     f,
+					Category: parser.CategorySeriesLimit,
+					Msg:      fmt.Sprintf("metric family %s has %d series, more than the limit of %d", over[0], counts[over[0]], max),
+				}
+			}
+			kept := keys[:0]
+			seen := make(map[string]int)
+			for _, k := range keys {
+				name := familyName(k)
+				if seen[name] >= max {
+					delete(metrics, k)
+					continue
+				}
+				seen[name]++
+				kept = append(kept, k)
+			}
+			keys = kept
+		}
+	}
+
+	if max := s.cfg.MaxSeriesPerFile; max > 0 && len(keys) > max {
+		log.Printf("%d/%d File %s has %d series, more than the limit of %d\n", i, n, f, len(keys), max)
+		s.countLimitHit(f, limitFile)
+		if s.cfg.SeriesLimitAction != SeriesLimitTruncate {
+			return &parser.Error{
+				File:     f,
+				Category: parser.CategorySeriesLimit,
+				Msg:      fmt.Sprintf("file has %d series, more than the limit of %d", len(keys), max),
+			}
+		}
+		for _, k := range keys[max:] {
+			delete(metrics, k)
+		}
+	}
+	return nil
+}
+
+// isSeriesLimit reports whether err is a series limit error.
+func isSeriesLimit(err error) bool {
+	var parseErr *parser.Error
+	return errors.As(err, &parseErr) && parseErr.Category == parser.CategorySeriesLimit
+}
+
+// countLimitHit counts a hit of the given series limit by file f.
+func (s *Scanner) countLimitHit(f, limit string) {
+	if s.admitFile(f) {
+		s.metrics.SeriesLimitHitsTotal.WithLabelValues(f, limit).Inc()
+	}
+}
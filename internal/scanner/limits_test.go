@@ -0,0 +1,169 @@
+package scanner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/parser"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeriesLimits(t *testing.T) {
+	const first = "a{x=\"1\"} 1\na{x=\"2\"} 1\nb 1\n"
+	const second = "a{x=\"1\"} 2\na{x=\"2\"} 2\na{x=\"3\"} 2\nb 2\n"
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		limit     string
+		want      []string
+		wantValue float64
+		failing   bool
+	}{
+		{
+			name:    "family limit rejects",
+			limit:   limitFamily,
+			want:    nil,
+			failing: true,
+		},
+		{
+			name:      "family limit truncates",
+			configure: func(cfg *Config) { cfg.SeriesLimitAction = SeriesLimitTruncate },
+			limit:     limitFamily,
+			want:      []string{`a{x="1"}`, `a{x="2"}`, "b{}"},
+			wantValue: 2,
+		},
+		{
+			name:      "family limit keeps the last good version",
+			configure: func(cfg *Config) { cfg.SeriesLimitAction = SeriesLimitKeepLast },
+			limit:     limitFamily,
+			want:      []string{`a{x="1"}`, `a{x="2"}`, "b{}"},
+			wantValue: 1,
+			failing:   true,
+		},
+		{
+			name: "file limit truncates",
+			configure: func(cfg *Config) {
+				cfg.MaxSeriesPerFamily = 0
+				cfg.MaxSeriesPerFile = 3
+				cfg.SeriesLimitAction = SeriesLimitTruncate
+			},
+			limit:     limitFile,
+			want:      []string{`a{x="1"}`, `a{x="2"}`, `a{x="3"}`},
+			wantValue: 2,
+		},
+		{
+			name: "file limit rejects",
+			configure: func(cfg *Config) {
+				cfg.MaxSeriesPerFamily = 0
+				cfg.MaxSeriesPerFile = 3
+			},
+			limit:   limitFile,
+			want:    nil,
+			failing: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := writeFile(t, dir, "job.prom", first)
+			s, coll := newTestScanner(t, dir, func(cfg *Config) {
+				cfg.MaxSeriesPerFamily = 2
+				if tt.configure != nil {
+					tt.configure(cfg)
+				}
+			})
+			s.scan()
+			writeFile(t, dir, "job.prom", second)
+			setMtime(t, path, time.Now().Add(time.Minute))
+			s.scan()
+
+			if got := seriesNames(t, coll); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+			for _, m := range gather(t, coll) {
+				if value(m) != tt.wantValue {
+					t.Errorf("value = %v, want %v", value(m), tt.wantValue)
+				}
+			}
+			if got := testutil.ToFloat64(s.metrics.SeriesLimitHitsTotal.WithLabelValues(path, tt.limit)); got != 1 {
+				t.Errorf("series_limit_hits_total{limit=%q} = %v, want 1", tt.limit, got)
+			}
+			errs := s.Errors()
+			if tt.failing != (len(errs) == 1) || (tt.failing && errs[0].Category != parser.CategorySeriesLimit) {
+				t.Errorf("Errors() = %v, want a series limit error: %v", errs, tt.failing)
+			}
+		})
+	}
+}
+
+func TestGlobalSeriesLimit(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.prom", "a 1\nb 1\n")
+	s, coll := newTestScanner(t, dir, nil)
+	coll.SetMaxSeries(3)
+	s.scan()
+
+	// The new file would take the collector over the limit, so it is not
+	// stored, and the series of the first one are kept.
+	big := writeFile(t, dir, "b.prom", "c 1\nd 1\n")
+	s.scan()
+	if got, want := seriesNames(t, coll), []string{"a{}", "b{}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(s.metrics.SeriesLimitHitsTotal.WithLabelValues(big, limitGlobal)); got != 1 {
+		t.Errorf("series_limit_hits_total{limit=\"global\"} = %v, want 1", got)
+	}
+
+	// It is stored at the next scan once there is room for it.
+	coll.SetMaxSeries(4)
+	s.scan()
+	if got := coll.SeriesCount(); got != 4 {
+		t.Errorf("SeriesCount() = %d, want 4", got)
+	}
+}
+
+func TestGlobalSeriesLimitAction(t *testing.T) {
+	tests := []struct {
+		action SeriesLimitAction
+		want   map[string]float64
+	}{
+		{SeriesLimitReject, map[string]float64{"a{}": 1, "b{}": 1}},
+		{SeriesLimitTruncate, map[string]float64{"a{}": 1, "b{}": 1, "c{}": 2, "d{}": 2}},
+		{SeriesLimitKeepLast, map[string]float64{"a{}": 1, "b{}": 1, "c{}": 1, "d{}": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.action), func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "a.prom", "a 1\nb 1\n")
+			path := writeFile(t, dir, "b.prom", "c 1\nd 1\n")
+			s, coll := newTestScanner(t, dir, func(cfg *Config) { cfg.SeriesLimitAction = tt.action })
+			coll.SetMaxSeries(4)
+			s.scan()
+
+			// The new version of b.prom would take the collector over
+			// the limit.
+			writeFile(t, dir, "b.prom", "c 2\nd 2\ne 2\n")
+			setMtime(t, path, time.Now().Add(time.Minute))
+			s.scan()
+			got := make(map[string]float64)
+			for name, m := range gather(t, coll) {
+				got[name] = value(m)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(s.metrics.SeriesLimitHitsTotal.WithLabelValues(path, limitGlobal)); got != 1 {
+				t.Errorf("series_limit_hits_total{limit=\"global\"} = %v, want 1", got)
+			}
+
+			// The whole file is stored at the next scan once there is room.
+			coll.SetMaxSeries(5)
+			s.scan()
+			if got := coll.SeriesCount(); got != 5 {
+				t.Errorf("SeriesCount() = %d, want 5", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package scanner
+
+import (
+	"fmt"
+	"textfile_exporter/internal/parser"
+)
+
+// LabelConflictPolicy controls what happens when a file already has a label
+// derived from its path, with another value.
+type LabelConflictPolicy string
+
+const (
+	// LabelConflictKeepFile keeps the value found in the file.
+	LabelConflictKeepFile LabelConflictPolicy = "keep_file"
+	// LabelConflictOverride replaces it with the value derived from the path.
+	LabelConflictOverride LabelConflictPolicy = "override"
+	// LabelConflictError rejects the file, like a parse error.
+	LabelConflictError LabelConflictPolicy = "error"
+)
+
+// pathLabels returns the labels derived from the path of file f by the
+// PathLabels rules. Every matching rule contributes its named groups; a later
+// rule overrides the labels of an earlier one. Empty groups are ignored.
+func (s *Scanner) pathLabels(f string) map[string]string {
+	if len(s.cfg.PathLabels) == 0 {
+		return nil
+	}
+	rel := s.relPath(f)
+	labels := make(map[string]string)
+	for _, re := range s.cfg.PathLabels {
+		match := re.FindStringSubmatch(rel)
+		if match == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" && match[i] != "" {
+				labels[name] = match[i]
+			}
+		}
+	}
+	return labels
+}
+
+// applyPathLabels adds the labels derived from the path of file f to every
+// series of result, following PathLabelConflict.
+func (s *Scanner) applyPathLabels(f string, result *parser.Result) error {
+	labels := s.pathLabels(f)
+	if len(labels) == 0 {
+		return nil
+	}
+	switch s.cfg.PathLabelConflict {
+	case LabelConflictOverride:
+		result.SetLabels(labels)
+	case LabelConflictError:
+		if family, name, ok := result.ConflictingLabel(labels); ok {
+			return &parser.Error{
+				File:     f,
+				Category: parser.CategoryLabelConflict,
+				Msg:      fmt.Sprintf("label %q of %s conflicts with the value %q derived from the path", name, family, labels[name]),
+			}
+		}
+		result.AddLabels(labels)
+	default:
+		result.AddLabels(labels)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"textfile_exporter/internal/parser"
+)
+
+func TestPathLabels(t *testing.T) {
+	rules := []*regexp.Regexp{
+		regexp.MustCompile(`^(?P<team>[^/]+)/(?P<job>[^/]+)\.prom$`),
+		regexp.MustCompile(`^(?P<team>[^/]+)/(?P<host>[^/]+)/`),
+		regexp.MustCompile(`^(?P<optional>x)?[^/]+/`),
+	}
+	s, _ := newTestScanner(t, "/data", func(cfg *Config) { cfg.PathLabels = rules })
+	tests := map[string]map[string]string{
+		"top.prom":           {},
+		"infra/backup.prom":  {"team": "infra", "job": "backup"},
+		"infra/db1/cpu.prom": {"team": "infra", "host": "db1"},
+		"xteam/db1/cpu.prom": {"team": "xteam", "host": "db1", "optional": "x"},
+		"infra/db1/a/b/c.om": {"team": "infra", "host": "db1"},
+	}
+	for path, want := range tests {
+		if got := s.pathLabels("/data/" + path); !reflect.DeepEqual(got, want) {
+			t.Errorf("pathLabels(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestPathLabelConflict(t *testing.T) {
+	tests := []struct {
+		policy LabelConflictPolicy
+		want   []string
+		err    bool
+	}{
+		{LabelConflictKeepFile, []string{`a{job="backup",team="infra"}`, `b{job="mine",team="infra"}`}, false},
+		{LabelConflictOverride, []string{`a{job="backup",team="infra"}`, `b{job="backup",team="infra"}`}, false},
+		{LabelConflictError, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, dir, "infra/backup.prom", "a 1\nb{job=\"mine\"} 2\n")
+			s, coll := newTestScanner(t, dir, func(cfg *Config) {
+				cfg.Recursive = true
+				cfg.PathLabels = []*regexp.Regexp{regexp.MustCompile(`^(?P<team>[^/]+)/(?P<job>[^/]+)\.prom$`)}
+				cfg.PathLabelConflict = tt.policy
+			})
+			s.scan()
+			if got := seriesNames(t, coll); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+			errs := s.Errors()
+			if tt.err && (len(errs) != 1 || errs[0].Category != parser.CategoryLabelConflict) {
+				t.Errorf("Errors() = %v, want a label conflict", errs)
+			}
+			if !tt.err && len(errs) != 0 {
+				t.Errorf("Errors() = %v, want none", errs)
+			}
+		})
+	}
+}
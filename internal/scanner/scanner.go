@@ -6,197 +6,777 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"textfile_exporter/internal/collector"
 	"textfile_exporter/internal/parser"
+	"textfile_exporter/internal/relabel"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	dto "github.com/prometheus/client_model/go"
 )
 
 func isOlderThanTwoHours(t time.Time) bool {
 	return time.Now().Sub(t) > 2*time.Hour
 }
 
-// Start begins the scanning loop that periodically reads .prom files from a
-// directory, parses the metrics, and updates the collector. This function is
-// intended to be run as a goroutine.
+// Config holds the settings of a Scanner.
+//
+// - Path: The directory or file to scan for metrics.
+// - Recursive: Whether to scan the directory recursively.
+// - Watch: Whether to react to inotify events instead of waiting for the next scan.
+// - EnableFilesMinAge: Flag to enable checking for old files.
+// - FilesMinAgeDuration: Duration to consider a file old.
+// - OldFilesExternalCmd: Command to run on old files.
+// - ScanInterval: How often to scan the directory. In watch mode this is the
+// interval of the full resync that catches anything the watcher missed.
+// - ContentHash: Whether to compare file contents before re-parsing a file
+// whose metadata changed.
+// - UpdateMode: Whether series that vanish from a file, or whose file is
+// deleted, are dropped immediately or retained until they expire.
+// - PathUpdateModes: UpdateMode overrides for the files or directories
+// matching a glob, relative to Path. The longest matching pattern wins.
+// - FilePattern: A glob the file names must match. If empty, the .prom and .om
+// files are read.
+// - TTL: How long the metrics read by this Scanner are kept in memory. If zero,
+// the default expiration of the collector applies.
+// - Labels: Static labels added to every series, replacing the labels with the
+// same name found in the files.
+// - PathLabels: Regular expressions matched against the path of each file,
+// relative to Path, whose named groups are added as labels to its series.
+// - PathLabelConflict: What happens when a file already has a label derived
+// from its path, with another value.
+// - Relabel: Relabeling rules applied to every series once all the labels
+// above are set.
+// - Filters: Include and exclude patterns for the files and directories to read.
+// - FileMetrics: Whether to expose per-file metrics such as mtime and size.
+// - FileMetricsMaxFiles: The maximum number of files with per-file metrics,
+// including the metrics labeled by file in Metrics. If zero, there is no limit.
+// - SettleTime: How long a file must stay unmodified before it is read.
+// - SkipTempFiles: Whether to ignore temporary files, such as *.tmp, *~ and .#*.
+// - LockFileSuffix: If not empty, a file is not read while a file with the same
+// name plus this suffix exists.
+// - OnParseError: What happens to the metrics of a file that can no longer be
+// parsed.
+// - LastGoodMaxAge: How long the last good version of a file is served with
+// ParseErrorKeepLast. If zero, it is served until the file is fixed or removed.
+// - MaxSeriesPerFile: The maximum number of series read from a file. If zero,
+// there is no limit.
+// - MaxSeriesPerFamily: The maximum number of series of a metric family read
+// from a file. If zero, there is no limit.
+// - SeriesLimitAction: What happens to a file over one of the limits above.
+// - TimestampPolicy: What happens to the samples that have a timestamp.
+// - TimestampMaxAge: How old a timestamp can be with collector.TimestampClamp
+// and collector.TimestampReject. If zero, there is no limit.
+// - TimestampMaxFuture: How far in the future a timestamp can be with
+// collector.TimestampClamp and collector.TimestampReject. If zero, there is no
+// limit.
+// - UntimestampedPolicy: The timestamp of the samples that have none.
+type Config struct {
+	Path                string
+	Recursive           bool
+	Watch               bool
+	EnableFilesMinAge   bool
+	FilesMinAgeDuration time.Duration
+	OldFilesExternalCmd string
+	ScanInterval        time.Duration
+	ContentHash         bool
+	UpdateMode          collector.UpdateMode
+	PathUpdateModes     map[string]collector.UpdateMode
+	FilePattern         string
+	TTL                 time.Duration
+	Labels              map[string]string
+	PathLabels          []*regexp.Regexp
+	PathLabelConflict   LabelConflictPolicy
+	Relabel             []*relabel.Rule
+	Filters             Filters
+	FileMetrics         bool
+	FileMetricsMaxFiles int
+	SettleTime          time.Duration
+	SkipTempFiles       bool
+	LockFileSuffix      string
+	OnParseError        ParseErrorPolicy
+	LastGoodMaxAge      time.Duration
+	MaxSeriesPerFile    int
+	MaxSeriesPerFamily  int
+	SeriesLimitAction   SeriesLimitAction
+	TimestampPolicy     collector.TimestampPolicy
+	TimestampMaxAge     time.Duration
+	TimestampMaxFuture  time.Duration
+	UntimestampedPolicy UntimestampedPolicy
+}
+
+// Metrics groups the internal metrics updated by a Scanner.
+//
+// - ScannedFilesCount: A gauge to update with the number of files found.
+// - LastScanTimestamp: A gauge to update with the timestamp of the last scan.
+// - FileScanErrorsTotal: A counter of errors encountered while listing files.
+// - FileParseErrorsTotal: A counter of errors encountered while parsing files,
+// by category.
+// - ScanFilesCount: A gauge of files parsed or reused in the last scan, by result.
+// - DroppedFamiliesTotal: A counter of metric families dropped because their
+// type is not supported, by type.
+// - UnstableFileEventsTotal: A counter of the times a file was not read because
+// it was still being written, by file and reason.
+// - FileParseFailing: A gauge set for the files whose last parse failed, by
+// file and error category.
 //
-// - promPath: The directory or file to scan for metrics.
-// - recursive: Whether to scan the directory recursively.
-// - enableFilesMinAge: Flag to enable checking for old files.
-// - filesMinAgeDuration: Duration to consider a file old.
-// - oldFilesExternalCmd: Command to run on old files.
-// - scanInterval: How often to scan the directory.
-// - coll: The TimeAwareCollector to which metrics will be added.
-// - scannedFilesCount: A gauge to update with the number of files found.
-// - lastScanTimestamp: A gauge to update with the timestamp of the last scan.
-func Start(promPath string, recursive bool, enableFilesMinAge bool, filesMinAgeDuration time.Duration, oldFilesExternalCmd string, scanInterval time.Duration, coll *collector.TimeAwareCollector, scannedFilesCount prometheus.Gauge, lastScanTimestamp prometheus.Gauge, fileScanErrorsTotal *prometheus.CounterVec, fileParseErrorsTotal *prometheus.CounterVec) {
+// Like the per-file gauges, the metrics labeled by file only exist for up to
+// FileMetricsMaxFiles files, and are removed with the file.
+// - Files: The per-file metrics.
+// - RelabelDroppedTotal: A counter of series dropped by relabeling, by scope
+// and index of the rule.
+// - SeriesLimitHitsTotal: A counter of the times a file exceeded a series
+// limit, by file and limit.
+// - SampleTimestampsTotal: A counter of the samples with a timestamp at every
+// scan, by outcome of the timestamp policy.
+type Metrics struct {
+	ScannedFilesCount       prometheus.Gauge
+	ScanFilesCount          *prometheus.GaugeVec
+	LastScanTimestamp       prometheus.Gauge
+	FileScanErrorsTotal     *prometheus.CounterVec
+	FileParseErrorsTotal    *prometheus.CounterVec
+	DroppedFamiliesTotal    *prometheus.CounterVec
+	UnstableFileEventsTotal *prometheus.CounterVec
+	FileParseFailing        *prometheus.GaugeVec
+	Files                   FileMetrics
+	RelabelDroppedTotal     *prometheus.CounterVec
+	SeriesLimitHitsTotal    *prometheus.CounterVec
+	SampleTimestampsTotal   *prometheus.CounterVec
+}
+
+// Scanner reads .prom files from a directory, parses the metrics and keeps
+// the TimeAwareCollector up to date with their content.
+type Scanner struct {
+	cfg       Config
+	coll      *collector.TimeAwareCollector
+	metrics   Metrics
+	watcher   *watcher
+	debugging bool
+	cache     map[string]cachedFile
+	// sources holds the files whose metrics were handed to the collector,
+	// which may also hold metrics from other sources such as pushes.
+	sources map[string]struct{}
+	reload  chan Config
+	// stop receives whether the metrics read are kept in the collector when
+	// the loop ends.
+	stop chan bool
+	done chan struct{}
+	// retry receives the unstable files to read again, and retrying holds
+	// the files for which a retry is pending.
+	retry    chan string
+	retrying map[string]bool
+	// failing holds the error of the files whose last parse failed. It is
+	// only written by the scanning goroutine, under failingMutex.
+	failing      map[string]*parser.Error
+	failingMutex sync.Mutex
+	// fileMetrics holds the files that have per-file metrics, and
+	// fileMetricsFull is set once a file was denied them by the limit.
+	fileMetrics     map[string]struct{}
+	fileMetricsFull bool
+}
+
+// processResult tells how processFile obtained the metrics of a file.
+type processResult int
+
+const (
+	resultError processResult = iota
+	resultParsed
+	resultReused
+	// resultUnstable means the file is still being written; its previous
+	// metrics are kept until it can be read.
+	resultUnstable
+	// resultLastGood means the file could not be parsed and the metrics of
+	// its last good version are served instead.
+	resultLastGood
+)
+
+// hasMetrics reports whether the result comes with metrics to store.
+func (r processResult) hasMetrics() bool {
+	return r == resultParsed || r == resultReused || r == resultLastGood
+}
+
+// New creates a Scanner that feeds coll with the metrics found in cfg.Path.
+func New(cfg Config, coll *collector.TimeAwareCollector, metrics Metrics) *Scanner {
+	cfg.Path = filepath.Clean(cfg.Path)
+	return &Scanner{
+		cfg:     cfg,
+		coll:    coll,
+		metrics: metrics,
+		cache:   make(map[string]cachedFile),
+		sources: make(map[string]struct{}),
+		reload:  make(chan Config),
+		stop:    make(chan bool),
+		done:    make(chan struct{}),
+		retry:   make(chan string),
+
+		retrying: make(map[string]bool),
+		failing:  make(map[string]*parser.Error),
+
+		fileMetrics: make(map[string]struct{}),
+	}
+}
+
+// Start begins the scanning loop that periodically reads .prom files from a
+// directory, parses the metrics, and updates the collector. In watch mode,
+// files are also re-read as soon as the watcher reports a change. This
+// function is intended to be run as a goroutine.
+func (s *Scanner) Start() {
+	defer close(s.done)
+	events := s.startWatcher()
+	ticker := time.NewTicker(s.cfg.ScanInterval)
+	defer ticker.Stop()
+
+	s.adoptSources()
+	s.scan()
 	for {
-		lastScanTimestamp.SetToCurrentTime()
-		fileinfo, err := os.Stat(promPath)
-        if err != nil {
-            log.Printf("Error stating path %s: %v\n", promPath, err)
-            fileScanErrorsTotal.WithLabelValues("stat_path_error").Inc()
-            continue
-        }
-		var debugging bool
-
-		// Enable debug logging if a 'debug_tfe' file exists and is recent.
-		if fs, err := os.Stat(promPath + "/debug_tfe"); err == nil {
-			if !isOlderThanTwoHours(fs.ModTime()) {
-				debugging = true
-			}
-		}
-		if debugging {
-			log.Printf("*** DEBUG MODE ENABLED ***\n")
-		}
-
-		var files []string
-		if fileinfo.IsDir() {
-			if recursive {
-				err := filepath.WalkDir(promPath, func(path string, d fs.DirEntry, err error) error {
-					if err != nil {
-						return err
-					}
-					if !d.IsDir() && strings.HasSuffix(d.Name(), ".prom") {
-						files = append(files, path)
-					}
-					return nil
-				})
-				if err != nil {
-					log.Printf("Error walking directory %s: %v\n", promPath, err)
-					fileScanErrorsTotal.WithLabelValues("walkdir_error").Inc()
-					continue
+		select {
+		case <-ticker.C:
+			s.scan()
+		case ev, ok := <-events:
+			if !ok {
+				log.Printf("Watcher stopped, falling back to polling every %s\n", s.cfg.ScanInterval)
+				s.watcher = nil
+				events = nil
+				continue
+			}
+			s.handleEvent(ev)
+		case cfg := <-s.reload:
+			if s.watcher != nil {
+				s.watcher.close()
+				s.watcher = nil
+			}
+			cfg.Path = filepath.Clean(cfg.Path)
+			s.cfg = cfg
+			// Parsed files are cached with the settings they were read with,
+			// so all are parsed again. Their metrics are kept as the last
+			// good version in case they no longer parse.
+			for f, cached := range s.cache {
+				s.cache[f] = cachedFile{metrics: cached.metrics, mtime: cached.mtime, goodAt: cached.goodAt}
+			}
+			if cfg.FileMetricsMaxFiles > 0 && len(s.fileMetrics) > cfg.FileMetricsMaxFiles {
+				for f := range s.fileMetrics {
+					s.deleteFileMetrics(f)
 				}
-			} else {
-				entries, err := os.ReadDir(promPath)
-                if err != nil {
-                    log.Printf("Error reading directory %s: %v\n", promPath, err)
-                    fileScanErrorsTotal.WithLabelValues("readdir_error").Inc()
-                    continue
-                }
-				for _, entry := range entries {
-					if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".prom") {
-						files = append(files, filepath.Join(promPath, entry.Name()))
-					}
+			} else if !cfg.FileMetrics {
+				for f := range s.fileMetrics {
+					s.deleteFileGauges(f)
+				}
+			}
+			events = s.startWatcher()
+			ticker.Reset(s.cfg.ScanInterval)
+			s.scan()
+		case f := <-s.retry:
+			delete(s.retrying, f)
+			s.handleEvent(watchEvent{op: opFileChanged, path: f})
+		case keep := <-s.stop:
+			if s.watcher != nil {
+				s.watcher.close()
+				s.watcher = nil
+			}
+			if keep {
+				return
+			}
+			for source := range s.sources {
+				s.forget(source)
+			}
+			for f := range s.failing {
+				s.clearParseError(f)
+			}
+			for f := range s.fileMetrics {
+				s.deleteFileMetrics(f)
+			}
+			return
+		}
+	}
+}
+
+// Reload replaces the configuration of a running Scanner. A full scan with the
+// new settings starts right away: the metrics already stored are kept, and
+// those of files that are no longer found, e.g. after a change of Path, are
+// removed like after a deletion.
+func (s *Scanner) Reload(cfg Config) {
+	s.reload <- cfg
+}
+
+// Stop ends the scanning loop and waits for it to return. The metrics read by
+// the Scanner are removed from the collector, unless they are retained until
+// they expire.
+func (s *Scanner) Stop() {
+	s.stop <- false
+	<-s.done
+}
+
+// Shutdown ends the scanning loop and waits for it to return, leaving the
+// metrics read by the Scanner in the collector, e.g. to save them in a
+// snapshot on exit.
+func (s *Scanner) Shutdown() {
+	s.stop <- true
+	<-s.done
+}
+
+// startWatcher starts the watcher if watch mode is enabled and returns its
+// events, or nil when polling.
+func (s *Scanner) startWatcher() <-chan watchEvent {
+	if !s.cfg.Watch {
+		return nil
+	}
+	w, err := newWatcher()
+	if err != nil {
+		log.Printf("Error starting watcher, falling back to polling every %s: %v\n", s.cfg.ScanInterval, err)
+		return nil
+	}
+	s.watcher = w
+	log.Printf("Watching %s for changes\n", s.cfg.Path)
+	return w.events
+}
+
+// store hands the metrics read from file f to the collector. If the collector
+// is full, SeriesLimitAction applies: the first series that fit are stored
+// with SeriesLimitTruncate, the metrics of f are dropped with
+// SeriesLimitReject, and those the collector already holds for f are left as
+// they are with SeriesLimitKeepLast. The store is tried again at the next scan.
+func (s *Scanner) store(f string, newMetrics map[string]collector.StoredMetric) {
+	s.sources[f] = struct{}{}
+	if s.cfg.SeriesLimitAction == SeriesLimitTruncate {
+		if dropped := s.coll.UpdateSourceTruncated(f, newMetrics, s.updateMode(f)); dropped > 0 {
+			log.Printf("Stored %d of the %d series of file %s: %v\n", len(newMetrics)-dropped, len(newMetrics), f, collector.ErrSeriesLimit)
+			s.countLimitHit(f, limitGlobal)
+		}
+		return
+	}
+	if err := s.coll.UpdateSource(f, newMetrics, s.updateMode(f)); err != nil {
+		log.Printf("Error storing the %d series of file %s: %v\n", len(newMetrics), f, err)
+		s.countLimitHit(f, limitGlobal)
+		if s.cfg.SeriesLimitAction == SeriesLimitReject {
+			s.forget(f)
+		}
+	}
+}
+
+// adoptSources takes over the sources of the collector that are files this
+// Scanner would read, such as those restored from a snapshot, so that the
+// first scan handles the files removed in the meantime like any other removal.
+func (s *Scanner) adoptSources() {
+	for _, source := range s.coll.Sources() {
+		if s.isWatchedFile(source) {
+			s.sources[source] = struct{}{}
+		}
+	}
+}
+
+// forget tells the collector that file f was removed or could not be read.
+func (s *Scanner) forget(f string) {
+	delete(s.sources, f)
+	s.coll.RemoveSource(f, s.updateMode(f))
+}
+
+// scan performs a full pass over the configured path: every file is parsed
+// again and the metrics of files that disappeared are removed.
+func (s *Scanner) scan() {
+	s.metrics.LastScanTimestamp.SetToCurrentTime()
+	fileinfo, err := os.Stat(s.cfg.Path)
+	if err != nil {
+		log.Printf("Error stating path %s: %v\n", s.cfg.Path, err)
+		s.metrics.FileScanErrorsTotal.WithLabelValues("stat_path_error").Inc()
+		return
+	}
+
+	// Enable debug logging if a 'debug_tfe' file exists and is recent.
+	s.debugging = false
+	if fs, err := os.Stat(s.cfg.Path + "/debug_tfe"); err == nil {
+		if !isOlderThanTwoHours(fs.ModTime()) {
+			s.debugging = true
+		}
+	}
+	if s.debugging {
+		log.Printf("*** DEBUG MODE ENABLED ***\n")
+	}
+
+	var files []string
+	if fileinfo.IsDir() {
+		files, err = s.listFiles(s.cfg.Path)
+		if err != nil {
+			return
+		}
+	} else {
+		s.watchDir(filepath.Dir(s.cfg.Path))
+		files = append(files, s.cfg.Path)
+	}
+	n := len(files)
+	log.Printf("Found %d files\n", n)
+	s.metrics.ScannedFilesCount.Set(float64(n))
+
+	found := make(map[string]bool, n)
+	parsed, reused, unstable, lastGood := 0, 0, 0, 0
+	for i, f := range files {
+		found[f] = true
+		printIt := s.debugging || i < 5 || i >= n-5
+		newMetrics, result := s.processFile(f, i+1, n, printIt)
+		switch result {
+		case resultParsed:
+			parsed++
+			s.store(f, newMetrics)
+		case resultReused:
+			reused++
+			s.store(f, newMetrics)
+		case resultUnstable:
+			unstable++
+		case resultLastGood:
+			lastGood++
+			s.store(f, newMetrics)
+		default:
+			s.forget(f)
+		}
+	}
+	log.Printf("Parsed %d files, reused %d unchanged files, skipped %d unstable files, kept the last good version of %d files\n", parsed, reused, unstable, lastGood)
+	s.metrics.ScanFilesCount.WithLabelValues("parsed").Set(float64(parsed))
+	s.metrics.ScanFilesCount.WithLabelValues("reused").Set(float64(reused))
+	s.metrics.ScanFilesCount.WithLabelValues("unstable").Set(float64(unstable))
+	s.metrics.ScanFilesCount.WithLabelValues("last_good").Set(float64(lastGood))
+
+	// Drop the metrics and cache entries of files that no longer exist.
+	for source := range s.sources {
+		if !found[source] {
+			s.forget(source)
+		}
+	}
+	for f := range s.cache {
+		if !found[f] {
+			s.dropFile(f)
+		}
+	}
+	for f := range s.failing {
+		if !found[f] {
+			s.dropFile(f)
+		}
+	}
+	for f := range s.fileMetrics {
+		if !found[f] {
+			s.dropFile(f)
+		}
+	}
+}
+
+// dropFile forgets the state kept about file f, which no longer exists. Its
+// metrics are removed from the collector separately, with forget.
+func (s *Scanner) dropFile(f string) {
+	delete(s.cache, f)
+	s.clearParseError(f)
+	s.deleteFileMetrics(f)
+}
+
+// listFiles returns the .prom files found in dir, descending into
+// subdirectories when the scan is recursive. In watch mode every visited
+// directory is also added to the watcher.
+func (s *Scanner) listFiles(dir string) ([]string, error) {
+	var files []string
+	if s.cfg.Recursive {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if s.isExcludedDir(path) {
+					return fs.SkipDir
 				}
+				s.watchDir(path)
+			} else if s.isMetricsFile(path) {
+				files = append(files, path)
 			}
-		} else {
-			files = append(files, promPath)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error walking directory %s: %v\n", dir, err)
+			s.metrics.FileScanErrorsTotal.WithLabelValues("walkdir_error").Inc()
+			return nil, err
+		}
+	} else {
+		s.watchDir(dir)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Printf("Error reading directory %s: %v\n", dir, err)
+			s.metrics.FileScanErrorsTotal.WithLabelValues("readdir_error").Inc()
+			return nil, err
 		}
-		n := len(files)
-		log.Printf("Found %d files\n", n)
-		scannedFilesCount.Set(float64(n))
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if !entry.IsDir() && s.isMetricsFile(path) {
+				files = append(files, path)
+			}
+		}
+	}
+	return files, nil
+}
+
+// watchDir adds dir to the watcher, if watch mode is active.
+func (s *Scanner) watchDir(dir string) {
+	if s.watcher == nil {
+		return
+	}
+	if err := s.watcher.add(dir); err != nil {
+		log.Printf("Error watching directory %s: %v\n", dir, err)
+		s.metrics.FileScanErrorsTotal.WithLabelValues("watch_error").Inc()
+	}
+}
 
-		newMetrics := make(map[string]collector.StoredMetric)
+// isWatchedFile reports whether a file reported by the watcher belongs to
+// the scanned set.
+func (s *Scanner) isWatchedFile(path string) bool {
+	if path == s.cfg.Path {
+		return true
+	}
+	if !s.isMetricsFile(path) {
+		return false
+	}
+	rel, err := filepath.Rel(s.cfg.Path, filepath.Dir(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return false
+	}
+	return rel == "." || s.cfg.Recursive
+}
 
+// updateMode returns the UpdateMode that applies to the file f. A pattern in
+// PathUpdateModes applies to the files it matches and to everything below the
+// directories it matches.
+func (s *Scanner) updateMode(f string) collector.UpdateMode {
+	mode := s.cfg.UpdateMode
+	rel, err := filepath.Rel(s.cfg.Path, f)
+	if err != nil {
+		return mode
+	}
+	longest := -1
+	for pattern, m := range s.cfg.PathUpdateModes {
+		if len(pattern) > longest && matchPathOrParent(pattern, rel) {
+			mode, longest = m, len(pattern)
+		}
+	}
+	return mode
+}
+
+// matchPathOrParent reports whether pattern matches rel or one of its parent
+// directories.
+func matchPathOrParent(pattern, rel string) bool {
+	for p := rel; p != "." && p != string(os.PathSeparator); p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleEvent updates the collector for the file or directory a watcher
+// event refers to.
+func (s *Scanner) handleEvent(ev watchEvent) {
+	// The removal of a lock file releases the file it protects.
+	if s.cfg.LockFileSuffix != "" && ev.op == opFileRemoved && strings.HasSuffix(ev.path, s.cfg.LockFileSuffix) {
+		ev = watchEvent{op: opFileChanged, path: strings.TrimSuffix(ev.path, s.cfg.LockFileSuffix)}
+	}
+
+	switch ev.op {
+	case opFileChanged:
+		if !s.isWatchedFile(ev.path) {
+			return
+		}
+		switch newMetrics, result := s.processFile(ev.path, 1, 1, true); {
+		case result.hasMetrics():
+			s.store(ev.path, newMetrics)
+		case result == resultError:
+			s.forget(ev.path)
+		}
+	case opFileRemoved:
+		if !s.isWatchedFile(ev.path) {
+			return
+		}
+		log.Printf("File %s removed\n", ev.path)
+		s.dropFile(ev.path)
+		s.forget(ev.path)
+	case opDirCreated:
+		if !s.cfg.Recursive || s.isExcludedDir(ev.path) {
+			return
+		}
+		// Files may have been written before the watch on the new directory
+		// was in place, so read everything it already contains.
+		files, err := s.listFiles(ev.path)
+		if err != nil {
+			return
+		}
+		log.Printf("Directory %s created, found %d files\n", ev.path, len(files))
 		for i, f := range files {
-			printIt := debugging || i < 5 || i >= n-5
-			if printIt {
-				log.Printf("%d/%d Processing file %s\n", i+1, n, f)
+			if newMetrics, result := s.processFile(f, i+1, len(files), true); result.hasMetrics() {
+				s.store(f, newMetrics)
 			}
-			fileinfo, err := os.Stat(f)
-			if err != nil {
-				log.Printf("%d/%d Error stat()ing file %s\n", i+1, n, f)
-				fileScanErrorsTotal.WithLabelValues("stat_file_error").Inc()
-				continue
+		}
+	case opDirRemoved:
+		prefix := ev.path + string(os.PathSeparator)
+		for source := range s.sources {
+			if strings.HasPrefix(source, prefix) {
+				s.forget(source)
 			}
-			mfs, err := parser.ParseMF(f)
-			if err != nil {
-				log.Printf("%d/%d Error parsing file %s\n", i+1, n, f)
-				fileParseErrorsTotal.WithLabelValues("parse_error").Inc()
-				continue
+		}
+		for f := range s.cache {
+			if strings.HasPrefix(f, prefix) {
+				s.dropFile(f)
+			}
+		}
+		for f := range s.failing {
+			if strings.HasPrefix(f, prefix) {
+				s.dropFile(f)
+			}
+		}
+		for f := range s.fileMetrics {
+			if strings.HasPrefix(f, prefix) {
+				s.dropFile(f)
 			}
+		}
+	case opOverflow:
+		log.Printf("Watcher event queue overflowed, rescanning %s\n", s.cfg.Path)
+		s.scan()
+	}
+}
 
-			// If enabled, execute an external command on files older than the specified duration.
-			if enableFilesMinAge && time.Now().After(fileinfo.ModTime().Add(filesMinAgeDuration)) {
-				log.Printf("%d/%d Old file %s\n", i+1, n, f)
-				parts := strings.Fields(oldFilesExternalCmd)
-				if len(parts) > 0 {
-					cmd_to_run := parts[0]
-					cmd_args := parts[1:]
-					cmd_args = append(cmd_args, f)
-					cmd := exec.Command(cmd_to_run, cmd_args...)
-					log.Printf("%d/%d Running command %s\n", i+1, n, cmd.String())
-					cmdOut, err := cmd.Output()
-					if err != nil {
-						log.Printf("%d/%d Error running command %s\n", i+1, n, cmd.String())
-					}
-					if debugging {
-						log.Printf("output:\n<<<\n%s\n>>>\n", string(cmdOut))
-					}
-				}
+// processFile builds the metrics of a single file. Files whose fingerprint
+// did not change since the last scan are not parsed again; their previous
+// metrics are renewed instead. It returns resultError if the file could not be
+// read or parsed, resultLastGood if it could not be parsed but its last good
+// version is served instead, and resultUnstable if it is still being written.
+// i and n are only used for logging.
+func (s *Scanner) processFile(f string, i, n int, printIt bool) (map[string]collector.StoredMetric, processResult) {
+	if printIt {
+		log.Printf("%d/%d Processing file %s\n", i, n, f)
+	}
+	fileinfo, err := os.Stat(f)
+	if err != nil {
+		log.Printf("%d/%d Error stat()ing file %s\n", i, n, f)
+		s.metrics.FileScanErrorsTotal.WithLabelValues("stat_file_error").Inc()
+		delete(s.cache, f)
+		return nil, resultError
+	}
+	fp := statFingerprint(fileinfo)
+	cached, hit := s.cache[f]
+	hashed := false
+	if hit && fp.sameMetadata(cached.fp) {
+		fp.hash = cached.fp.hash
+	} else if hit {
+		hit = false
+		if s.cfg.ContentHash {
+			fp.hash, err = hashFile(f)
+			hashed = err == nil
+			hit = hashed && fp.hash == cached.fp.hash
+		}
+	}
+
+	if !hit {
+		if reason := s.unstableReason(f, fileinfo); reason != "" {
+			s.reportUnstable(f, reason, i, n)
+			return nil, resultUnstable
+		}
+	}
+
+	var newMetrics map[string]collector.StoredMetric
+	result := resultParsed
+	if hit {
+		now := time.Now().UTC()
+		newMetrics = make(map[string]collector.StoredMetric, len(cached.metrics))
+		for k, metric := range cached.metrics {
+			newMetrics[k] = metric.Renew(now)
+		}
+		result = resultReused
+		if printIt {
+			log.Printf("%d/%d    unchanged, reused %d data points\n", i, n, len(newMetrics))
+		}
+		s.setFileMetrics(f, fileStat{fileinfo: fileinfo, series: len(newMetrics), success: true})
+	} else {
+		if s.cfg.ContentHash && !hashed {
+			fp.hash, _ = hashFile(f)
+		}
+		start := time.Now()
+		newMetrics, err = s.parseFile(f, fileinfo.ModTime(), i, n, printIt)
+		duration := time.Since(start)
+		if after, statErr := os.Stat(f); statErr == nil && !statFingerprint(after).sameMetadata(fp) {
+			s.reportUnstable(f, unstableChanged, i, n)
+			return nil, resultUnstable
+		}
+		s.setFileMetrics(f, fileStat{fileinfo: fileinfo, series: len(newMetrics), success: err == nil, parsed: true, duration: duration})
+		if err != nil {
+			s.setParseError(f, err)
+			if lastGood, ok := s.lastGood(f, err, i, n); ok {
+				return s.applyTimestampPolicy(f, lastGood, s.cache[f].mtime, i, n), resultLastGood
 			}
+			delete(s.cache, f)
+			return nil, resultError
+		}
+		s.clearParseError(f)
+	}
+	s.cache[f] = cachedFile{fp: fp, metrics: newMetrics, mtime: fileinfo.ModTime(), goodAt: time.Now()}
 
-			cnt := 0
-			for name, mf := range mfs {
-				labels := make(map[string]string)
-				if debugging {
-					log.Println("Metric Name: ", name)
-					log.Println("Metric Type: ", mf.GetType())
-					log.Println("Metric Help: ", mf.GetHelp())
-				}
+	s.runOldFileCommand(f, fileinfo, i, n)
+	return s.applyTimestampPolicy(f, newMetrics, fileinfo.ModTime(), i, n), result
+}
 
-				var metric_value float64
-				var metric_type prometheus.ValueType
-			out:
-				for _, m := range mf.GetMetric() {
-					switch mf.GetType() {
-					case dto.MetricType_GAUGE:
-						metric_type = prometheus.GaugeValue
-						metric_value = m.GetGauge().GetValue()
-					case dto.MetricType_COUNTER:
-						metric_type = prometheus.CounterValue
-						metric_value = m.GetCounter().GetValue()
-					case dto.MetricType_SUMMARY:
-						break out
-					case dto.MetricType_UNTYPED:
-						metric_type = prometheus.UntypedValue
-						metric_value = m.GetUntyped().GetValue()
-					case dto.MetricType_HISTOGRAM:
-						break out
-					default:
-						break out
-					}
-
-					timestamp := m.GetTimestampMs()
-					if debugging {
-						log.Println("  Metric Value: ", metric_value)
-						log.Println("  Timestamp: ", timestamp)
-					}
-					// If the metric has no timestamp, assign the current time.
-					if timestamp <= 0 {
-						timestamp = time.Now().UTC().UnixNano() / 1000000
-						if debugging {
-							log.Println("  Timestamp: ", timestamp, " (now)")
-						}
-					}
-
-					for _, label := range m.GetLabel() {
-						if debugging {
-							log.Println("  Label_Name:  ", label.GetName())
-							log.Println("  Label_Value: ", label.GetValue())
-						}
-						labels[label.GetName()] = label.GetValue()
-					}
-
-					fullname, metric := coll.CreateMetric(name, labels, metric_type, metric_value, time.Unix(0, timestamp*int64(time.Millisecond)), 0, mf.GetHelp())
-					newMetrics[fullname] = metric
-					cnt++
-
-					if debugging {
-						log.Println("-----------")
-					}
-				}
+// runOldFileCommand executes the configured external command on f if it is
+// older than the configured minimum age.
+func (s *Scanner) runOldFileCommand(f string, fileinfo os.FileInfo, i, n int) {
+	// If enabled, execute an external command on files older than the specified duration.
+	if s.cfg.EnableFilesMinAge && time.Now().After(fileinfo.ModTime().Add(s.cfg.FilesMinAgeDuration)) {
+		log.Printf("%d/%d Old file %s\n", i, n, f)
+		parts := strings.Fields(s.cfg.OldFilesExternalCmd)
+		if len(parts) > 0 {
+			cmd_to_run := parts[0]
+			cmd_args := parts[1:]
+			cmd_args = append(cmd_args, f)
+			cmd := exec.Command(cmd_to_run, cmd_args...)
+			log.Printf("%d/%d Running command %s\n", i, n, cmd.String())
+			cmdOut, err := cmd.Output()
+			if err != nil {
+				log.Printf("%d/%d Error running command %s\n", i, n, cmd.String())
 			}
-			if printIt {
-				log.Printf("%d/%d    found %d data points\n", i+1, n, cnt)
+			if s.debugging {
+				log.Printf("output:\n<<<\n%s\n>>>\n", string(cmdOut))
 			}
 		}
-		coll.ReplaceMetrics(newMetrics)
-		time.Sleep(scanInterval)
 	}
 }
 
+// parseFile parses f, modified at mtime, and converts its metric families into
+// StoredMetrics.
+func (s *Scanner) parseFile(f string, mtime time.Time, i, n int, printIt bool) (map[string]collector.StoredMetric, error) {
+	result, err := parser.Parse(f)
+	if err != nil {
+		log.Printf("%d/%d Error parsing file %v\n", i, n, err)
+		return nil, err
+	}
+	for _, warning := range result.Warnings {
+		log.Printf("%d/%d Warning parsing file %v\n", i, n, warning)
+	}
+
+	if err := s.applyPathLabels(f, result); err != nil {
+		log.Printf("%d/%d Error parsing file %v\n", i, n, err)
+		return nil, err
+	}
+	if len(s.cfg.Labels) > 0 {
+		result.SetLabels(s.cfg.Labels)
+	}
+	for rule, dropped := range relabel.Apply(s.cfg.Relabel, result) {
+		s.metrics.RelabelDroppedTotal.WithLabelValues(rule.Scope, strconv.Itoa(rule.Index)).Add(float64(dropped))
+	}
+	newMetrics, dropped := s.coll.FromResult(result, f, s.cfg.TTL, s.debugging)
+	for name, typ := range dropped {
+		log.Printf("%d/%d Dropping metric family %s of unsupported type %s\n", i, n, name, typ)
+		s.metrics.DroppedFamiliesTotal.WithLabelValues(strings.ToLower(typ.String())).Inc()
+	}
+	for k, metric := range newMetrics {
+		metric.SourceTime = mtime
+		newMetrics[k] = metric
+	}
+	s.applyUntimestampedPolicy(newMetrics, mtime)
+	if err := s.applySeriesLimits(f, newMetrics, i, n); err != nil {
+		return nil, err
+	}
+	if printIt {
+		log.Printf("%d/%d    found %d data points\n", i, n, len(newMetrics))
+	}
+	return newMetrics, nil
+}
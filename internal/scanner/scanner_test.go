@@ -0,0 +1,250 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/collector"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testMetrics returns a fresh set of internal metrics, labeled like those of
+// a single directory.
+func testMetrics() Metrics {
+	gauge := func(name string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, labels)
+	}
+	counter := func(name string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: name}, labels)
+	}
+	return Metrics{
+		ScannedFilesCount:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "scanned_files_count", Help: "scanned_files_count"}),
+		ScanFilesCount:          gauge("scan_files_count", "result"),
+		LastScanTimestamp:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "last_scan_timestamp", Help: "last_scan_timestamp"}),
+		FileScanErrorsTotal:     counter("file_scan_errors_total", "reason"),
+		FileParseErrorsTotal:    counter("file_parse_errors_total", "reason"),
+		DroppedFamiliesTotal:    counter("dropped_families_total", "type"),
+		UnstableFileEventsTotal: counter("unstable_file_events_total", "file", "reason"),
+		FileParseFailing:        gauge("file_parse_failing", "file", "category"),
+		Files: FileMetrics{
+			Mtime:         gauge("file_mtime_seconds", "file"),
+			Size:          gauge("file_size_bytes", "file"),
+			Series:        gauge("file_series", "file"),
+			ParseSuccess:  gauge("file_parse_success", "file"),
+			ParseDuration: gauge("file_parse_duration_seconds", "file"),
+			ContentChange: gauge("file_content_change_timestamp_seconds", "file"),
+		},
+		RelabelDroppedTotal:   counter("relabel_dropped_series_total", "scope", "rule"),
+		SeriesLimitHitsTotal:  counter("series_limit_hits_total", "file", "limit"),
+		SampleTimestampsTotal: counter("sample_timestamps_total", "outcome"),
+	}
+}
+
+// newTestScanner returns a Scanner of dir and the collector it feeds, with
+// the defaults of the command line flags.
+func newTestScanner(t *testing.T, dir string, configure func(*Config)) (*Scanner, *collector.TimeAwareCollector) {
+	t.Helper()
+	cfg := Config{
+		Path:                dir,
+		ScanInterval:        time.Hour,
+		UpdateMode:          collector.UpdateReplace,
+		TTL:                 time.Hour,
+		OnParseError:        ParseErrorDrop,
+		SeriesLimitAction:   SeriesLimitReject,
+		TimestampPolicy:     collector.TimestampHonor,
+		UntimestampedPolicy: UntimestampedScanTime,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	coll := collector.NewTimeAwareCollector(time.Hour)
+	return New(cfg, coll, testMetrics()), coll
+}
+
+// writeFile writes content to the file name of dir, creating its parent
+// directories, and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setMtime sets the modification time of path.
+func setMtime(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gather collects coll and returns its samples by series, formatted as
+// name{label="value",...}.
+func gather(t *testing.T, coll prometheus.Collector) map[string]*dto.Metric {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(coll)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]*dto.Metric)
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			series[seriesName(mf.GetName(), m)] = m
+		}
+	}
+	return series
+}
+
+// seriesName formats the series of metric m of family name.
+func seriesName(name string, m *dto.Metric) string {
+	var labels []string
+	for _, lp := range m.Label {
+		labels = append(labels, lp.GetName()+"=\""+lp.GetValue()+"\"")
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// seriesNames returns the sorted series of coll.
+func seriesNames(t *testing.T, coll prometheus.Collector) []string {
+	t.Helper()
+	var names []string
+	for name := range gather(t, coll) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// value returns the value of a gauge, counter or untyped sample.
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	return 0
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScanPicksUpFilesAndDeletions(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.prom", "a 1\n")
+	b := writeFile(t, dir, "b.prom", "b 2\n")
+	writeFile(t, dir, "ignored.txt", "c 3\n")
+
+	s, coll := newTestScanner(t, dir, nil)
+	s.scan()
+	if got, want := seriesNames(t, coll), []string{"a{}", "b{}"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("series = %v, want %v", got, want)
+	}
+
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	s.scan()
+	if got, want := seriesNames(t, coll), []string{"a{}"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("series after removal = %v, want %v", got, want)
+	}
+}
+
+func TestUpdateModeByPath(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.Recursive = true
+		cfg.PathUpdateModes = map[string]collector.UpdateMode{
+			"batch":          collector.UpdateRetain,
+			"batch/live":     collector.UpdateReplace,
+			"jobs_*.prom":    collector.UpdateRetain,
+			"batch/*/x.prom": collector.UpdateReplace,
+		}
+	})
+	tests := []struct {
+		path string
+		want collector.UpdateMode
+	}{
+		{"a.prom", collector.UpdateReplace},
+		{"jobs_1.prom", collector.UpdateRetain},
+		{"batch/a.prom", collector.UpdateRetain},
+		{"batch/sub/a.prom", collector.UpdateRetain},
+		{"batch/sub/x.prom", collector.UpdateReplace},
+		{"batch/live/a.prom", collector.UpdateReplace},
+	}
+	for _, tt := range tests {
+		if got := s.updateMode(filepath.Join(dir, tt.path)); got != tt.want {
+			t.Errorf("updateMode(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRetainedFileOutlivesDeletion(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "live.prom", "live 1\n")
+	batch := writeFile(t, dir, "batch/job.prom", "job 1\n")
+	s, coll := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.Recursive = true
+		cfg.PathUpdateModes = map[string]collector.UpdateMode{"batch": collector.UpdateRetain}
+	})
+	s.scan()
+
+	writeFile(t, dir, "batch/job.prom", "job 2\n")
+	setMtime(t, batch, time.Now().Add(time.Minute))
+	s.scan()
+	if err := os.Remove(batch); err != nil {
+		t.Fatal(err)
+	}
+	s.scan()
+	series := gather(t, coll)
+	if m, ok := series["job{}"]; !ok || value(m) != 2 {
+		t.Errorf("job = %v, want the last value 2 kept after the deletion", m)
+	}
+	if _, ok := series["live{}"]; !ok {
+		t.Error("live is missing")
+	}
+}
+
+func TestStopAndShutdown(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		dir := t.TempDir()
+		writeFile(t, dir, "a.prom", "a 1\n")
+		s, coll := newTestScanner(t, dir, nil)
+		go s.Start()
+		waitFor(t, "the first scan", func() bool { return len(gather(t, coll)) == 1 })
+		if keep {
+			s.Shutdown()
+		} else {
+			s.Stop()
+		}
+		if got := len(gather(t, coll)); keep && got != 1 || !keep && got != 0 {
+			t.Errorf("after stopping with keep=%v, %d series left", keep, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"log"
+	"textfile_exporter/internal/collector"
+	"time"
+)
+
+// UntimestampedPolicy controls the timestamp of the samples of a file that
+// have none.
+type UntimestampedPolicy string
+
+const (
+	// UntimestampedScanTime stamps the samples with the time of every scan.
+	UntimestampedScanTime UntimestampedPolicy = "scan_time"
+	// UntimestampedMtime stamps the samples with the modification time of
+	// the file.
+	UntimestampedMtime UntimestampedPolicy = "mtime"
+	// UntimestampedNone exports the samples without timestamp, so that the
+	// scraper stamps them.
+	UntimestampedNone UntimestampedPolicy = "none"
+)
+
+// applyTimestampPolicy returns a copy of the metrics read from file f,
+// modified at mtime, with TimestampPolicy applied to the samples that have a
+// timestamp. It runs at every scan, including for unchanged files, so that
+// the samples that leave the accepted window are clamped or rejected.
+func (s *Scanner) applyTimestampPolicy(f string, metrics map[string]collector.StoredMetric, mtime time.Time, i, n int) map[string]collector.StoredMetric {
+	applied := make(map[string]collector.StoredMetric, len(metrics))
+	for k, metric := range metrics {
+		applied[k] = metric
+	}
+	outcomes := collector.ApplyTimestampPolicy(applied, s.cfg.TimestampPolicy, s.cfg.TimestampMaxAge, s.cfg.TimestampMaxFuture, mtime)
+	if count := outcomes[collector.TimestampRejected]; count > 0 {
+		log.Printf("%d/%d Rejected %d samples of file %s with a timestamp out of the accepted window\n", i, n, count, f)
+	}
+	if count := outcomes[collector.TimestampClamped]; count > 0 && s.debugging {
+		log.Printf("%d/%d Clamped the timestamps of %d samples of file %s\n", i, n, count, f)
+	}
+	for outcome, count := range outcomes {
+		s.metrics.SampleTimestampsTotal.WithLabelValues(outcome).Add(float64(count))
+	}
+	return applied
+}
+
+// applyUntimestampedPolicy applies UntimestampedPolicy to the metrics read
+// from a file modified at mtime whose timestamp was assigned at scan time,
+// because the file had none or the honor_timestamps directive is false.
+func (s *Scanner) applyUntimestampedPolicy(metrics map[string]collector.StoredMetric, mtime time.Time) {
+	if s.cfg.UntimestampedPolicy != UntimestampedMtime && s.cfg.UntimestampedPolicy != UntimestampedNone {
+		return
+	}
+	for k, metric := range metrics {
+		if !metric.ScanTimestamp {
+			continue
+		}
+		metric.ScanTimestamp = false
+		metric.Timestamp = time.Time{}
+		if s.cfg.UntimestampedPolicy == UntimestampedMtime {
+			metric.Timestamp = mtime
+		}
+		metrics[k] = metric
+	}
+}
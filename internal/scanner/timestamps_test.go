@@ -0,0 +1,178 @@
+package scanner
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"textfile_exporter/internal/collector"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	old := strconv.FormatInt(time.Now().Add(-48*time.Hour).UnixMilli(), 10)
+	mtime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	t.Run("drop", func(t *testing.T) {
+		dir := t.TempDir()
+		setMtime(t, writeFile(t, dir, "a.prom", "stamped 1 "+old+"\nplain 1\n"), mtime)
+		s, coll := newTestScanner(t, dir, func(cfg *Config) {
+			cfg.TimestampPolicy = collector.TimestampDrop
+			cfg.UntimestampedPolicy = UntimestampedMtime
+		})
+		s.scan()
+		series := gather(t, coll)
+		// The untimestamped policy does not apply to dropped timestamps.
+		if m := series["stamped{}"]; m.TimestampMs != nil {
+			t.Errorf("stamped exported with timestamp %d, want none", m.GetTimestampMs())
+		}
+		if got := series["plain{}"].GetTimestampMs(); got != mtime.UnixMilli() {
+			t.Errorf("timestamp of plain = %d, want the mtime %d", got, mtime.UnixMilli())
+		}
+		if got := testutil.ToFloat64(s.metrics.SampleTimestampsTotal.WithLabelValues(collector.TimestampDropped)); got != 1 {
+			t.Errorf("dropped timestamps = %v, want 1", got)
+		}
+	})
+
+	t.Run("mtime", func(t *testing.T) {
+		dir := t.TempDir()
+		setMtime(t, writeFile(t, dir, "a.prom", "stamped 1 "+old+"\n"), mtime)
+		s, coll := newTestScanner(t, dir, func(cfg *Config) { cfg.TimestampPolicy = collector.TimestampMtime })
+		s.scan()
+		if got := gather(t, coll)["stamped{}"].GetTimestampMs(); got != mtime.UnixMilli() {
+			t.Errorf("timestamp of stamped = %d, want the mtime %d", got, mtime.UnixMilli())
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, dir, "a.prom", "stamped 1 "+old+"\nplain 1\n")
+		s, coll := newTestScanner(t, dir, func(cfg *Config) {
+			cfg.TimestampPolicy = collector.TimestampReject
+			cfg.TimestampMaxAge = time.Hour
+		})
+		s.scan()
+		if got, want := seriesNames(t, coll), []string{"plain{}"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("series = %v, want %v", got, want)
+		}
+		if got := testutil.ToFloat64(s.metrics.SampleTimestampsTotal.WithLabelValues(collector.TimestampRejected)); got != 1 {
+			t.Errorf("rejected timestamps = %v, want 1", got)
+		}
+	})
+}
+
+func TestTimestampPolicyAcrossScans(t *testing.T) {
+	for _, policy := range []collector.TimestampPolicy{collector.TimestampClamp, collector.TimestampReject, collector.TimestampDrop} {
+		t.Run(string(policy), func(t *testing.T) {
+			stamp := time.Now().Truncate(time.Millisecond)
+			dir := t.TempDir()
+			writeFile(t, dir, "a.prom", "stamped 1 "+strconv.FormatInt(stamp.UnixMilli(), 10)+"\nplain 1\n")
+			s, coll := newTestScanner(t, dir, func(cfg *Config) {
+				cfg.TimestampPolicy = policy
+				cfg.TimestampMaxAge = 500 * time.Millisecond
+			})
+			s.scan()
+			first := gather(t, coll)["stamped{}"]
+
+			// The file is unchanged, but its sample is now out of the
+			// window, which the second scan notices.
+			time.Sleep(600 * time.Millisecond)
+			s.scan()
+			second := gather(t, coll)["stamped{}"]
+			if got := testutil.ToFloat64(s.metrics.ScanFilesCount.WithLabelValues("reused")); got != 1 {
+				t.Fatalf("reused files = %v, want a.prom reused", got)
+			}
+
+			switch policy {
+			case collector.TimestampClamp:
+				if first.GetTimestampMs() != stamp.UnixMilli() || second.GetTimestampMs() <= stamp.UnixMilli() {
+					t.Errorf("timestamps of stamped = %d, then %d, want %d, then clamped", first.GetTimestampMs(), second.GetTimestampMs(), stamp.UnixMilli())
+				}
+			case collector.TimestampReject:
+				if first == nil || second != nil {
+					t.Errorf("stamped = %v, then %v, want it honored, then rejected", first, second)
+				}
+			case collector.TimestampDrop:
+				if first.TimestampMs != nil || second.TimestampMs != nil {
+					t.Errorf("timestamps of stamped = %v, then %v, want none", first.TimestampMs, second.TimestampMs)
+				}
+			}
+		})
+	}
+}
+
+func TestUntimestampedPolicy(t *testing.T) {
+	stamp := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	content := "plain 1\nstamped 2 " + stamp + "\nrewritten{__tfe_honor_timestamps=\"false\"} 3 " + stamp + "\n"
+
+	tests := []struct {
+		policy UntimestampedPolicy
+		// want is the timestamp of the samples without one: the scan time if
+		// zero, or none if nil.
+		want *time.Time
+	}{
+		{UntimestampedScanTime, &time.Time{}},
+		{UntimestampedMtime, &mtime},
+		{UntimestampedNone, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			setMtime(t, writeFile(t, dir, "a.prom", content), mtime)
+			s, coll := newTestScanner(t, dir, func(cfg *Config) { cfg.UntimestampedPolicy = tt.policy })
+			begin := time.Now().Truncate(time.Millisecond)
+			s.scan()
+			series := gather(t, coll)
+			if got := strconv.FormatInt(series["stamped{}"].GetTimestampMs(), 10); got != stamp {
+				t.Errorf("timestamp of stamped = %s, want the one of the file %s", got, stamp)
+			}
+			// The honor_timestamps directive makes a sample untimestamped.
+			for _, name := range []string{"plain{}", "rewritten{}"} {
+				m := series[name]
+				switch {
+				case tt.want == nil:
+					if m.TimestampMs != nil {
+						t.Errorf("%s exported with timestamp %d, want none", name, m.GetTimestampMs())
+					}
+				case tt.want.IsZero():
+					if m.TimestampMs == nil || m.GetTimestampMs() < begin.UnixMilli() {
+						t.Errorf("timestamp of %s = %v, want the scan time", name, m.TimestampMs)
+					}
+				default:
+					if got := m.GetTimestampMs(); got != tt.want.UnixMilli() {
+						t.Errorf("timestamp of %s = %d, want the mtime %d", name, got, tt.want.UnixMilli())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUntimestampedMtimeWithContentHash(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	path := writeFile(t, dir, "a.prom", "plain 1\n")
+	setMtime(t, path, mtime)
+	s, coll := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.UntimestampedPolicy = UntimestampedMtime
+		cfg.ContentHash = true
+	})
+	s.scan()
+
+	// Rewriting the same content keeps the time the content last changed.
+	setMtime(t, path, mtime.Add(time.Minute))
+	s.scan()
+	if got := gather(t, coll)["plain{}"].GetTimestampMs(); got != mtime.UnixMilli() {
+		t.Errorf("timestamp after an identical rewrite = %d, want the first mtime %d", got, mtime.UnixMilli())
+	}
+
+	writeFile(t, dir, "a.prom", "plain 2\n")
+	setMtime(t, path, mtime.Add(2*time.Minute))
+	s.scan()
+	if got := gather(t, coll)["plain{}"].GetTimestampMs(); got != mtime.Add(2*time.Minute).UnixMilli() {
+		t.Errorf("timestamp after a change = %d, want the new mtime %d", got, mtime.Add(2*time.Minute).UnixMilli())
+	}
+}
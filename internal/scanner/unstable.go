@@ -0,0 +1,76 @@
+package scanner
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reasons for which a file is considered unstable, i.e. still being written.
+const (
+	// unstableSettling means the file was modified less than SettleTime ago.
+	unstableSettling = "settling"
+	// unstableChanged means the file changed while it was being read.
+	unstableChanged = "changed_during_read"
+	// unstableLocked means the lock file of the file exists.
+	unstableLocked = "locked"
+)
+
+// tempSuffixes are the suffixes of the temporary files left by editors and
+// by writers that rename their output into place.
+var tempSuffixes = []string{"~", ".tmp", ".temp", ".swp", ".swx", ".part", ".partial"}
+
+// tempPrefix is the prefix of the lock files left by Emacs.
+const tempPrefix = ".#"
+
+// isTempFile reports whether a file name looks like a temporary file. Other
+// dotfiles, such as .backup.prom, are not temporary files.
+func isTempFile(name string) bool {
+	if strings.HasPrefix(name, tempPrefix) {
+		return true
+	}
+	for _, suffix := range tempSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unstableReason returns why the file f, whose metadata is fileinfo, should
+// not be read yet, or an empty string if it can be read.
+func (s *Scanner) unstableReason(f string, fileinfo os.FileInfo) string {
+	if s.cfg.LockFileSuffix != "" {
+		if _, err := os.Stat(f + s.cfg.LockFileSuffix); err == nil {
+			return unstableLocked
+		}
+	}
+	if s.cfg.SettleTime > 0 && time.Since(fileinfo.ModTime()) < s.cfg.SettleTime {
+		return unstableSettling
+	}
+	return ""
+}
+
+// reportUnstable counts an unstable file event and, unless the file waits for
+// its lock file to be removed, schedules another attempt to read it.
+func (s *Scanner) reportUnstable(f, reason string, i, n int) {
+	log.Printf("%d/%d File %s is still being written (%s), keeping its previous metrics\n", i, n, f, reason)
+	if s.admitFile(f) {
+		s.metrics.UnstableFileEventsTotal.WithLabelValues(f, reason).Inc()
+	}
+	if reason == unstableLocked || s.retrying[f] {
+		return
+	}
+	delay := s.cfg.SettleTime
+	if delay <= 0 {
+		delay = time.Second
+	}
+	s.retrying[f] = true
+	time.AfterFunc(delay, func() {
+		select {
+		case s.retry <- f:
+		case <-s.done:
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package scanner
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIsTempFile(t *testing.T) {
+	tests := map[string]bool{
+		"a.prom":         false,
+		".a.prom":        false,
+		".hidden":        false,
+		"a.prom~":        true,
+		"a.prom.tmp":     true,
+		"a.prom.temp":    true,
+		".a.prom.swp":    true,
+		".a.prom.swx":    true,
+		"a.prom.part":    true,
+		"a.prom.partial": true,
+		".#a.prom":       true,
+		"a.tmp.prom":     false,
+	}
+	for name, want := range tests {
+		if got := isTempFile(name); got != want {
+			t.Errorf("isTempFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSkipTempFiles(t *testing.T) {
+	for _, skip := range []bool{true, false} {
+		dir := t.TempDir()
+		for _, name := range []string{"a.prom", ".b.prom", ".#c.prom", "d.prom~", "e.prom.tmp"} {
+			writeFile(t, dir, name, "m{file=\""+name+"\"} 1\n")
+		}
+		s, coll := newTestScanner(t, dir, func(cfg *Config) {
+			cfg.SkipTempFiles = skip
+			cfg.Filters.Include = []string{"*"}
+		})
+		s.scan()
+		var got []string
+		for _, m := range gather(t, coll) {
+			got = append(got, m.Label[0].GetValue())
+		}
+		sort.Strings(got)
+		want := []string{".#c.prom", ".b.prom", "a.prom", "d.prom~", "e.prom.tmp"}
+		if skip {
+			want = []string{".b.prom", "a.prom"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("with SkipTempFiles=%v, read files = %v, want %v", skip, got, want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package scanner
+
+// watchOp is the kind of change reported by the watcher.
+type watchOp int
+
+const (
+	// opFileChanged is sent when a file was written and closed, or moved into
+	// a watched directory.
+	opFileChanged watchOp = iota
+	// opFileRemoved is sent when a file was deleted or moved out of a watched
+	// directory.
+	opFileRemoved
+	// opDirCreated is sent when a directory was created or moved into a
+	// watched directory.
+	opDirCreated
+	// opDirRemoved is sent when a directory was deleted or moved out of a
+	// watched directory.
+	opDirRemoved
+	// opOverflow is sent when the kernel dropped events and a full rescan is
+	// needed.
+	opOverflow
+)
+
+// watchEvent is a filesystem change reported by the watcher.
+type watchEvent struct {
+	op   watchOp
+	path string
+}
@@ -0,0 +1,149 @@
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the inotify events the scanner cares about. Files are
+// only reported once they are closed after writing (or renamed into place),
+// so half-written files are not parsed on every write() call.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_DELETE | unix.IN_CREATE | unix.IN_ONLYDIR
+
+// watcher reports changes in a set of directories using Linux inotify.
+type watcher struct {
+	fd     int
+	file   *os.File
+	events chan watchEvent
+	// done is closed by close, so that the reading goroutine does not block
+	// on events nobody receives anymore.
+	done chan struct{}
+
+	mu    sync.Mutex
+	paths map[int]string
+}
+
+// newWatcher creates an inotify instance and starts reading its events.
+func newWatcher() (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	w := &watcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan watchEvent, 1024),
+		done:   make(chan struct{}),
+		paths:  make(map[int]string),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// add starts watching dir. Adding a directory that is already watched is a
+// no-op, so it is safe to call on every scan.
+func (w *watcher) add(dir string) error {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return fmt.Errorf("inotify_add_watch %s: %w", dir, err)
+	}
+	w.mu.Lock()
+	w.paths[wd] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// close stops the watcher. The events channel is closed when the reading
+// goroutine exits, and the events not received yet are discarded.
+func (w *watcher) close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// send forwards ev on w.events and reports whether the watcher is still open.
+func (w *watcher) send(ev watchEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// readEvents decodes the inotify events and forwards them on w.events until
+// the inotify file descriptor fails or the watcher is closed, even if nobody
+// receives the events anymore.
+func (w *watcher) readEvents() {
+	defer close(w.events)
+
+	var buf [unix.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error reading inotify events: %v\n", err)
+			}
+			return
+		}
+
+		offset := 0
+		for offset+unix.SizeofInotifyEvent <= n {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			offset = nameEnd
+			if nameEnd > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+
+			if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+				if !w.send(watchEvent{op: opOverflow}) {
+					return
+				}
+				continue
+			}
+
+			w.mu.Lock()
+			dir, ok := w.paths[int(raw.Wd)]
+			if raw.Mask&unix.IN_IGNORED != 0 {
+				delete(w.paths, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			if ev, ok := toWatchEvent(raw.Mask, filepath.Join(dir, name)); ok && !w.send(ev) {
+				return
+			}
+		}
+	}
+}
+
+// toWatchEvent maps an inotify event mask to the change it represents.
+func toWatchEvent(mask uint32, path string) (watchEvent, bool) {
+	isDir := mask&unix.IN_ISDIR != 0
+	switch {
+	case isDir && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		return watchEvent{op: opDirCreated, path: path}, true
+	case isDir && mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		return watchEvent{op: opDirRemoved, path: path}, true
+	case isDir:
+		return watchEvent{}, false
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+		return watchEvent{op: opFileChanged, path: path}, true
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		return watchEvent{op: opFileRemoved, path: path}, true
+	}
+	return watchEvent{}, false
+}
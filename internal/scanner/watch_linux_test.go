@@ -0,0 +1,84 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestToWatchEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		mask uint32
+		want watchEvent
+		ok   bool
+	}{
+		{"close write", unix.IN_CLOSE_WRITE, watchEvent{op: opFileChanged, path: "p"}, true},
+		{"moved to", unix.IN_MOVED_TO, watchEvent{op: opFileChanged, path: "p"}, true},
+		{"delete", unix.IN_DELETE, watchEvent{op: opFileRemoved, path: "p"}, true},
+		{"moved from", unix.IN_MOVED_FROM, watchEvent{op: opFileRemoved, path: "p"}, true},
+		{"file create", unix.IN_CREATE, watchEvent{}, false},
+		{"dir create", unix.IN_CREATE | unix.IN_ISDIR, watchEvent{op: opDirCreated, path: "p"}, true},
+		{"dir moved to", unix.IN_MOVED_TO | unix.IN_ISDIR, watchEvent{op: opDirCreated, path: "p"}, true},
+		{"dir delete", unix.IN_DELETE | unix.IN_ISDIR, watchEvent{op: opDirRemoved, path: "p"}, true},
+		{"dir close", unix.IN_CLOSE_WRITE | unix.IN_ISDIR, watchEvent{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := toWatchEvent(tt.mask, "p")
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("toWatchEvent(%#x) = %v, %v, want %v, %v", tt.mask, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// TestWatcherCloseWithPendingEvents checks that closing a watcher whose events
+// are no longer received, as after a reload, stops its reading goroutine.
+func TestWatcherCloseWithPendingEvents(t *testing.T) {
+	dir := t.TempDir()
+	before := runtime.NumGoroutine()
+	w, err := newWatcher()
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+	if err := w.add(dir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= cap(w.events); i++ {
+		writeFile(t, dir, fmt.Sprintf("%d.prom", i), "a 1\n")
+	}
+	waitFor(t, "the events channel to fill up", func() bool { return len(w.events) == cap(w.events) })
+
+	w.close()
+	waitFor(t, "the reading goroutine to exit", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestWatchModeReadsNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.prom", "a 1\n")
+	s, coll := newTestScanner(t, dir, func(cfg *Config) {
+		cfg.Watch = true
+		cfg.Recursive = true
+	})
+	go s.Start()
+	defer s.Stop()
+	waitFor(t, "the first scan", func() bool { return len(gather(t, coll)) == 1 })
+
+	// A file in a directory created after the first scan is read without
+	// waiting for the next scan.
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "sub/b.prom", "b 2\n")
+	waitFor(t, "sub/b.prom", func() bool { _, ok := gather(t, coll)["b{}"]; return ok })
+
+	if err := os.Remove(filepath.Join(dir, "a.prom")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the removal of a.prom", func() bool { _, ok := gather(t, coll)["a{}"]; return !ok })
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package scanner
+
+import "errors"
+
+// watcher is not available on this platform; the scanner falls back to
+// polling.
+type watcher struct {
+	events chan watchEvent
+}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("watch mode is only supported on Linux")
+}
+
+func (w *watcher) add(dir string) error {
+	return nil
+}
+
+func (w *watcher) close() error {
+	return nil
+}